@@ -2,13 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"phantun-docker/internal/config"
-	"phantun-docker/internal/iptables"
 	"phantun-docker/internal/process"
 	"phantun-docker/internal/system"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,16 +32,24 @@ func NewHandler(cfg *config.Config, mgr *process.Manager) *Handler {
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /api/status", h.handleStatus)
 	mux.HandleFunc("GET /api/iptables", h.handleIptables)
+	mux.HandleFunc("DELETE /api/iptables/{id}", h.handleIptablesCleanup)
 	mux.HandleFunc("GET /api/config", h.handleGetConfig)
 	mux.HandleFunc("POST /api/config", h.handleSaveConfig)
 	mux.HandleFunc("DELETE /api/config", h.handleResetConfig)
 	mux.HandleFunc("POST /api/action/restart", h.handleRestart)
+	mux.HandleFunc("POST /api/instances/{id}/start", h.handleInstanceStart)
+	mux.HandleFunc("POST /api/instances/{id}/stop", h.handleInstanceStop)
+	mux.HandleFunc("POST /api/instances/{id}/restart", h.handleInstanceRestart)
+	mux.HandleFunc("GET /api/instances/{id}/resources", h.handleInstanceResources)
 	mux.HandleFunc("GET /api/logs", h.handleLogs)
+	mux.HandleFunc("GET /api/logs/history", h.handleLogHistory)
+	mux.HandleFunc("GET /api/binaries", h.handleBinaries)
+	mux.HandleFunc("POST /api/binaries", h.handleUploadBinary)
 }
 
 func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 	binInfo := h.Manager.GetBinariesInfo()
-	iptStats, _ := iptables.GetStats()
+	iptStats, _ := h.Manager.FirewallStats()
 	tunIfaces, _ := system.GetTunInterfaces()
 
 	status := map[string]interface{}{
@@ -47,7 +59,8 @@ func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"processes": h.Manager.GetStatus(),
 		"diagnostics": map[string]interface{}{
 			"binaries":   binInfo,
-			"iptables":   iptStats,
+			"iptables":   iptStats, // Rule counts of whichever backend is active
+			"firewall":   h.Manager.FirewallName(),
 			"interfaces": tunIfaces,
 		},
 	}
@@ -55,21 +68,36 @@ func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleIptables(w http.ResponseWriter, r *http.Request) {
-	rules, err := iptables.GetRules()
+	rules, err := h.Manager.FirewallRules()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	own, err := h.Manager.FirewallOwnership()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	response := map[string]interface{}{
-		"raw":   rules,
-		"rules": strings.Split(rules, "\n"),
+		"backend":   h.Manager.FirewallName(),
+		"raw":       rules,
+		"rules":     strings.Split(rules, "\n"),
+		"instances": own.Instances, // Parsed rules grouped by the instance they are tagged for
+		"manager":   own.Manager,
+		"untagged":  own.Untagged,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleIptablesCleanup removes the rules tagged for one instance that no
+// longer holds them, e.g. after they were flagged as orphaned
+func (h *Handler) handleIptablesCleanup(w http.ResponseWriter, r *http.Request) {
+	writeInstanceResult(w, h.Manager.CleanupInstanceRules(r.PathValue("id")))
+}
+
 func (h *Handler) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(h.Config)
 }
@@ -80,6 +108,13 @@ func (h *Handler) handleSaveConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := newCfg.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Remember what is running now so only the difference gets applied
+	prev := h.Config.Snapshot()
 
 	// Update config fields safely
 	h.Config.Update(newCfg.General, newCfg.Clients, newCfg.Servers)
@@ -89,14 +124,11 @@ func (h *Handler) handleSaveConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Apply changes (Restart)
-	h.Manager.StopAll()
-	if err := h.Manager.StartAll(); err != nil {
-		http.Error(w, "Saved but failed to start processes: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// Apply changes (Reconcile)
+	result := h.Manager.Reconcile(prev)
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 func (h *Handler) handleRestart(w http.ResponseWriter, r *http.Request) {
@@ -105,7 +137,115 @@ func (h *Handler) handleRestart(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (h *Handler) handleInstanceStart(w http.ResponseWriter, r *http.Request) {
+	writeInstanceResult(w, h.Manager.StartInstance(r.PathValue("id")))
+}
+
+func (h *Handler) handleInstanceStop(w http.ResponseWriter, r *http.Request) {
+	writeInstanceResult(w, h.Manager.StopInstance(r.PathValue("id")))
+}
+
+func (h *Handler) handleInstanceRestart(w http.ResponseWriter, r *http.Request) {
+	writeInstanceResult(w, h.Manager.RestartInstance(r.PathValue("id")))
+}
+
+func (h *Handler) handleInstanceResources(w http.ResponseWriter, r *http.Request) {
+	samples, err := h.Manager.ResourceHistory(r.PathValue("id"))
+	if err != nil {
+		writeInstanceResult(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
+
+func (h *Handler) handleBinaries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Manager.GetBinariesInfo())
+}
+
+// maxUploadBytes bounds a release zip or bare binary upload
+const maxUploadBytes = 128 << 20
+
+// handleUploadBinary installs a phantun release zip or bare binary as a
+// registry version. The upload is either the raw request body or the "file"
+// field of a multipart form. Parameters (query or form): version, name (for a
+// bare binary), sha256 and restart.
+func (h *Handler) handleUploadBinary(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	var body io.Reader = r.Body
+	name := r.URL.Query().Get("name")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "missing file field: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+		if name == "" {
+			name = r.FormValue("name")
+		}
+		if name == "" {
+			name = filepath.Base(header.Filename)
+		}
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restart, _ := strconv.ParseBool(r.FormValue("restart"))
+	result, err := h.Manager.InstallBinaries(process.InstallRequest{
+		Version: r.FormValue("version"),
+		Data:    data,
+		Name:    name,
+		SHA256:  r.FormValue("sha256"),
+		Restart: restart,
+	})
+	if err != nil {
+		if errors.Is(err, process.ErrInvalidBinary) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.RolledBack {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeInstanceResult maps per-instance lifecycle errors to HTTP status codes
+func writeInstanceResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, process.ErrInstanceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, process.ErrInstanceRunning), errors.Is(err, process.ErrInstanceDisabled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (h *Handler) handleLogs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseLogFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -124,6 +264,9 @@ func (h *Handler) handleLogs(w http.ResponseWriter, r *http.Request) {
 			if !ok {
 				return
 			}
+			if !filter.Match(msg) {
+				continue
+			}
 			data, err := json.Marshal(msg)
 			if err != nil {
 				continue
@@ -143,6 +286,76 @@ func (h *Handler) handleLogs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) handleLogHistory(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseLogFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.Manager.LogHistory(filter, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseLogFilter reads the log filter shared by /api/logs and /api/logs/history:
+// process_id, stream (comma separated), level (minimum), since, until, q and regex
+func parseLogFilter(r *http.Request) (process.LogFilter, error) {
+	q := r.URL.Query()
+	var f process.LogFilter
+
+	f.ProcessIDs = splitList(q.Get("process_id"))
+	f.Streams = splitList(q.Get("stream"))
+
+	if level := strings.ToLower(q.Get("level")); level != "" {
+		if !process.ValidLogLevel(level) {
+			return f, fmt.Errorf("invalid level %q", level)
+		}
+		f.MinLevel = level
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = process.ParseLogTime(v); err != nil {
+			return f, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = process.ParseLogTime(v); err != nil {
+			return f, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+
+	f.Text = q.Get("q")
+	if v := q.Get("regex"); v != "" {
+		if f.Regex, err = regexp.Compile(v); err != nil {
+			return f, fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	return f, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func (h *Handler) handleResetConfig(w http.ResponseWriter, r *http.Request) {
 	// 1. Delete config file
 	if err := os.Remove(h.Config.Path); err != nil && !os.IsNotExist(err) {
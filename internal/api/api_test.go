@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLogFilter(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string // fmt of ProcessIDs, Streams, MinLevel, Since, Until, Text, Regex; "error" if rejected
+	}{
+		{"", "[] [] '' 0 0 '' <nil>"},
+		{"process_id=c1,+s1+,&stream=stderr", "[c1 s1] [stderr] '' 0 0 '' <nil>"},
+		{"level=WARN&q=Fail", "[] [] 'warn' 0 0 'Fail' <nil>"},
+		{"since=100&until=2024-01-02T03:04:05Z", "[] [] '' 100 1704164645 '' <nil>"},
+		{"regex=^conn.*ok$", "[] [] '' 0 0 '' ^conn.*ok$"},
+		{"level=verbose", "error"},
+		{"since=yesterday", "error"},
+		{"until=2024-13-01T00:00:00Z", "error"},
+		{"regex=(", "error"},
+	} {
+		f, err := parseLogFilter(httptest.NewRequest("GET", "/api/logs/history?"+tc.query, nil))
+		got := "error"
+		if err == nil {
+			unix := func(t time.Time) int64 {
+				if t.IsZero() {
+					return 0
+				}
+				return t.Unix()
+			}
+			got = fmt.Sprintf("%v %v '%s' %d %d '%s' %v",
+				f.ProcessIDs, f.Streams, f.MinLevel, unix(f.Since), unix(f.Until), f.Text, f.Regex)
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %s, got %s", tc.query, tc.want, got)
+		}
+	}
+}
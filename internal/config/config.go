@@ -1,18 +1,249 @@
 package config
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	_ "time/tzdata" // Schedule time zones must resolve in images without a zoneinfo database
 
 	"github.com/google/uuid"
+
+	"phantun-docker/internal/cron"
 )
 
 // GeneralConfig holds global settings
 type GeneralConfig struct {
 	Enabled  bool   `json:"enabled"`
 	LogLevel string `json:"log_level"` // "info", "debug", "error"
+
+	Supervisor SupervisorConfig `json:"supervisor"`
+	Logs       LogStoreConfig   `json:"logs"`
+	Integrity  IntegrityConfig  `json:"integrity"`
+	Netns      NetnsConfig      `json:"netns"`
+	Firewall   FirewallConfig   `json:"firewall"`
+}
+
+// RestartPolicy controls whether an exited instance is respawned
+type RestartPolicy string
+
+const (
+	RestartAlways    RestartPolicy = "always"
+	RestartOnFailure RestartPolicy = "on-failure" // Default
+	RestartNever     RestartPolicy = "never"
+)
+
+// SupervisorConfig tunes automatic restarts and stopping. Zero values select the built-in defaults.
+type SupervisorConfig struct {
+	BackoffInitialSec  int `json:"backoff_initial_sec,omitempty"`   // First retry delay
+	BackoffMaxSec      int `json:"backoff_max_sec,omitempty"`       // Upper bound for the retry delay
+	CrashLoopMax       int `json:"crash_loop_max,omitempty"`        // Give up after this many exits...
+	CrashLoopWindowSec int `json:"crash_loop_window_sec,omitempty"` // ...within this window
+	StopGraceSec       int `json:"stop_grace_sec,omitempty"`        // SIGTERM grace period before SIGKILL
+	ReadyTimeoutSec    int `json:"ready_timeout_sec,omitempty"`     // Time a new process has to bring up its TUN device and socket
+
+	// Leave phantun running when the manager exits and re-adopt it on the next
+	// start, restarting only instances whose settings changed meanwhile. Only
+	// useful outside the stock Docker image: there the manager is PID 1, and
+	// the container and its processes end with it.
+	Adopt bool `json:"adopt,omitempty"`
+}
+
+// LogStoreConfig controls the per-instance log files under <config dir>/logs.
+// Zero values select the built-in defaults.
+type LogStoreConfig struct {
+	Disabled      bool `json:"disabled,omitempty"`
+	MaxFileMB     int  `json:"max_file_mb,omitempty"`    // Rotate at this size
+	RotateHours   int  `json:"rotate_hours,omitempty"`   // Rotate at this age
+	RetentionDays int  `json:"retention_days,omitempty"` // Delete rotated files older than this
+	MaxTotalMB    int  `json:"max_total_mb,omitempty"`   // Cap for the whole log directory
+	Compress      bool `json:"compress,omitempty"`       // Gzip rotated files
+}
+
+// IntegrityPolicy decides what happens when a binary does not match its pinned checksum
+type IntegrityPolicy string
+
+const (
+	IntegrityWarn   IntegrityPolicy = "warn" // Default: log and start anyway
+	IntegrityRefuse IntegrityPolicy = "refuse"
+)
+
+// IntegrityConfig controls verification against <config dir>/checksums.sha256
+type IntegrityConfig struct {
+	Policy IntegrityPolicy `json:"policy,omitempty"` // "warn" (default) or "refuse"
+}
+
+// ResourceLimits confines one instance. Zero values leave the setting inherited
+// from the manager.
+type ResourceLimits struct {
+	Nice              int    `json:"nice,omitempty"`                 // -20 (highest priority) to 19
+	CPUAffinity       string `json:"cpu_affinity,omitempty"`         // CPU list, e.g. "0,2-3"
+	MaxOpenFiles      uint64 `json:"max_open_files,omitempty"`       // RLIMIT_NOFILE
+	MaxAddressSpaceMB uint64 `json:"max_address_space_mb,omitempty"` // RLIMIT_AS
+	OOMScoreAdj       int    `json:"oom_score_adj,omitempty"`        // -1000 to 1000
+
+	// cgroup v2 sub-group, created only if one of these is set
+	CPUPercent  int    `json:"cpu_percent,omitempty"`   // cpu.max quota, 100 = one full CPU
+	MemoryMaxMB uint64 `json:"memory_max_mb,omitempty"` // memory.max
+}
+
+// NeedsCgroup reports whether the limits require a cgroup
+func (l *ResourceLimits) NeedsCgroup() bool {
+	return l != nil && (l.CPUPercent > 0 || l.MemoryMaxMB > 0)
+}
+
+// Validate checks the ranges of the limits
+func (l *ResourceLimits) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("nice %d out of range -20..19", l.Nice)
+	}
+	if l.OOMScoreAdj < -1000 || l.OOMScoreAdj > 1000 {
+		return fmt.Errorf("oom_score_adj %d out of range -1000..1000", l.OOMScoreAdj)
+	}
+	if l.CPUPercent < 0 {
+		return fmt.Errorf("cpu_percent must not be negative")
+	}
+	if _, err := ParseCPUList(l.CPUAffinity); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseCPUList parses a CPU list such as "0,2-3" into CPU numbers
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		if last >= 1024 {
+			return nil, fmt.Errorf("CPU %d in %q is out of range", last, list)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// NetnsConfig controls the namespaces of instances with "netns" enabled
+type NetnsConfig struct {
+	Pool string `json:"pool,omitempty"` // IPv4 range for the veth pairs, one /30 each. Default 10.231.0.0/16
+}
+
+// FirewallBackend selects the tool that manages the NAT rules
+type FirewallBackend string
+
+const (
+	FirewallAuto     FirewallBackend = "auto" // Default: nftables if iptables is missing or the nf_tables shim
+	FirewallIptables FirewallBackend = "iptables"
+	FirewallNftables FirewallBackend = "nftables" // Native rules in a dedicated "inet phantun" table
+)
+
+// FirewallConfig controls how instance rules are installed. Changes apply on restart.
+type FirewallConfig struct {
+	Backend FirewallBackend `json:"backend,omitempty"`
+}
+
+// HealthCheckType selects how the tunnel of an instance is probed
+type HealthCheckType string
+
+const (
+	HealthConntrack HealthCheckType = "conntrack" // Fake-TCP connection established in conntrack
+	HealthTraffic   HealthCheckType = "traffic"   // TUN receive counter moving
+	HealthUDP       HealthCheckType = "udp"       // Request/response through the client's local port (clients only)
+)
+
+// HealthCheck actively probes whether a tunnel passes traffic.
+// Zero values select the defaults.
+type HealthCheck struct {
+	Type             HealthCheckType `json:"type"`
+	IntervalSec      int             `json:"interval_sec,omitempty"`      // Default 30
+	TimeoutSec       int             `json:"timeout_sec,omitempty"`       // Default 5
+	FailureThreshold int             `json:"failure_threshold,omitempty"` // Consecutive failures before unhealthy, default 3
+	Restart          bool            `json:"restart,omitempty"`           // Restart the instance once it turns unhealthy
+
+	// udp probe
+	PayloadHex string `json:"payload_hex,omitempty"` // Request datagram
+	ExpectHex  string `json:"expect_hex,omitempty"`  // Response must start with these bytes. Empty accepts any response
+}
+
+// Validate checks the probe settings. UDP probes need a client.
+func (h *HealthCheck) Validate(client bool) error {
+	if h == nil {
+		return nil
+	}
+	switch h.Type {
+	case HealthConntrack, HealthTraffic:
+	case HealthUDP:
+		if !client {
+			return fmt.Errorf("udp health checks are only supported for clients")
+		}
+		if h.PayloadHex == "" {
+			return fmt.Errorf("udp health check needs payload_hex")
+		}
+	default:
+		return fmt.Errorf("invalid health check type %q", h.Type)
+	}
+	if h.IntervalSec < 0 || h.TimeoutSec < 0 || h.FailureThreshold < 0 {
+		return fmt.Errorf("health check durations and threshold must not be negative")
+	}
+	if _, err := hex.DecodeString(h.PayloadHex); err != nil {
+		return fmt.Errorf("invalid payload_hex: %w", err)
+	}
+	if _, err := hex.DecodeString(h.ExpectHex); err != nil {
+		return fmt.Errorf("invalid expect_hex: %w", err)
+	}
+	return nil
+}
+
+// Schedule limits an instance to recurring windows: it comes up when Start
+// fires and goes down when Stop fires
+type Schedule struct {
+	Start    string `json:"start"`              // Cron expression, e.g. "0 9 * * MON-FRI"
+	Stop     string `json:"stop"`               // Cron expression, e.g. "0 17 * * MON-FRI"
+	Timezone string `json:"timezone,omitempty"` // IANA name, e.g. "Europe/Berlin". Empty uses the manager's local time
+}
+
+// Validate checks both expressions and the time zone
+func (s *Schedule) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if _, err := cron.Parse(s.Start); err != nil {
+		return fmt.Errorf("invalid schedule start: %w", err)
+	}
+	if _, err := cron.Parse(s.Stop); err != nil {
+		return fmt.Errorf("invalid schedule stop: %w", err)
+	}
+	if strings.TrimSpace(s.Start) == strings.TrimSpace(s.Stop) {
+		return fmt.Errorf("schedule start and stop must differ")
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid schedule timezone %q", s.Timezone)
+	}
+	return nil
 }
 
 // ClientConfig holds Phantun Client settings
@@ -31,6 +262,27 @@ type ClientConfig struct {
 	TunName       string `json:"tun_name,omitempty"`
 	HandshakeFile string `json:"handshake_file,omitempty"`
 	IPv4Only      bool   `json:"ipv4_only,omitempty"`
+
+	// Supervision
+	RestartPolicy RestartPolicy `json:"restart_policy,omitempty"` // "always", "on-failure" (default), "never"
+
+	// Logging
+	LogLevel string `json:"log_level,omitempty"` // RUST_LOG filter, e.g. "info,phantun::server=debug". Empty inherits general.log_level
+
+	// Binary
+	Binary string `json:"binary,omitempty"` // Version name in the binaries directory. Empty uses phantun from PATH
+
+	// Resources
+	Limits *ResourceLimits `json:"limits,omitempty"`
+
+	// Isolation
+	Netns bool `json:"netns,omitempty"` // Run in a dedicated network namespace (IPv4 only)
+
+	// Health
+	Health *HealthCheck `json:"health,omitempty"`
+
+	// Schedule
+	Schedule *Schedule `json:"schedule,omitempty"` // Run only inside these windows. Empty runs whenever enabled
 }
 
 // ServerConfig holds Phantun Server settings
@@ -48,6 +300,67 @@ type ServerConfig struct {
 	TunName       string `json:"tun_name,omitempty"`
 	HandshakeFile string `json:"handshake_file,omitempty"`
 	IPv4Only      bool   `json:"ipv4_only,omitempty"`
+
+	// Supervision
+	RestartPolicy RestartPolicy `json:"restart_policy,omitempty"` // "always", "on-failure" (default), "never"
+
+	// Logging
+	LogLevel string `json:"log_level,omitempty"` // RUST_LOG filter, e.g. "info,phantun::server=debug". Empty inherits general.log_level
+
+	// Binary
+	Binary string `json:"binary,omitempty"` // Version name in the binaries directory. Empty uses phantun from PATH
+
+	// Resources
+	Limits *ResourceLimits `json:"limits,omitempty"`
+
+	// Isolation
+	Netns bool `json:"netns,omitempty"` // Run in a dedicated network namespace (IPv4 only)
+
+	// Health
+	Health *HealthCheck `json:"health,omitempty"`
+
+	// Schedule
+	Schedule *Schedule `json:"schedule,omitempty"` // Run only inside these windows. Empty runs whenever enabled
+}
+
+var logTarget = regexp.MustCompile(`^[A-Za-z_][\w:]*$`)
+
+// ValidateLogFilter checks a RUST_LOG style filter: comma separated
+// directives of the form "level", "target" or "target=level".
+func ValidateLogFilter(filter string) error {
+	if filter == "" {
+		return nil
+	}
+	// env_logger accepts a trailing "/regex" message filter
+	spec, _, _ := strings.Cut(filter, "/")
+	for _, directive := range strings.Split(spec, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		target, level, hasLevel := strings.Cut(directive, "=")
+		if !hasLevel {
+			if isLogLevel(directive) {
+				continue
+			}
+			level = ""
+		}
+		if !logTarget.MatchString(target) {
+			return fmt.Errorf("invalid log target %q in %q", target, filter)
+		}
+		if hasLevel && !isLogLevel(level) {
+			return fmt.Errorf("invalid log level %q in %q", level, filter)
+		}
+	}
+	return nil
+}
+
+func isLogLevel(s string) bool {
+	switch strings.ToLower(s) {
+	case "off", "error", "warn", "info", "debug", "trace":
+		return true
+	}
+	return false
 }
 
 // Config represents the application configuration
@@ -148,6 +461,135 @@ func (c *Config) Save() error {
 	return enc.Encode(c)
 }
 
+// Validate checks settings that would otherwise only fail when an instance starts
+func (c *Config) Validate() error {
+	if c.General.LogLevel != "" && !isLogLevel(c.General.LogLevel) {
+		return fmt.Errorf("invalid general log level %q", c.General.LogLevel)
+	}
+	if pool := c.General.Netns.Pool; pool != "" {
+		if _, ipnet, err := net.ParseCIDR(pool); err != nil || ipnet.IP.To4() == nil {
+			return fmt.Errorf("invalid namespace pool %q", pool)
+		}
+	}
+	switch c.General.Firewall.Backend {
+	case "", FirewallAuto, FirewallIptables, FirewallNftables:
+	default:
+		return fmt.Errorf("invalid firewall backend %q", c.General.Firewall.Backend)
+	}
+	switch c.General.Integrity.Policy {
+	case "", IntegrityWarn, IntegrityRefuse:
+	default:
+		return fmt.Errorf("invalid integrity policy %q", c.General.Integrity.Policy)
+	}
+	for _, cl := range c.Clients {
+		if err := validateInstance(cl.ID, cl.Alias, cl.RestartPolicy, cl.LogLevel, cl.Binary, cl.Limits); err != nil {
+			return err
+		}
+		if err := cl.Health.Validate(true); err != nil {
+			return fmt.Errorf("instance %s: %w", cl.Alias, err)
+		}
+		if err := cl.Schedule.Validate(); err != nil {
+			return fmt.Errorf("instance %s: %w", cl.Alias, err)
+		}
+	}
+	for _, sv := range c.Servers {
+		if err := validateInstance(sv.ID, sv.Alias, sv.RestartPolicy, sv.LogLevel, sv.Binary, sv.Limits); err != nil {
+			return err
+		}
+		if err := sv.Health.Validate(false); err != nil {
+			return fmt.Errorf("instance %s: %w", sv.Alias, err)
+		}
+		if err := sv.Schedule.Validate(); err != nil {
+			return fmt.Errorf("instance %s: %w", sv.Alias, err)
+		}
+	}
+	return c.validateUnique()
+}
+
+// validateUnique rejects IDs shared by two instances, and TUN names shared
+// on the host; instances in their own namespace may reuse a name
+func (c *Config) validateUnique() error {
+	ids := make(map[string]string)
+	tuns := make(map[string]string)
+	check := func(id, alias, tun string, netns bool) error {
+		if id != "" {
+			if other, ok := ids[id]; ok {
+				return fmt.Errorf("instance %s: ID %q already used by %s", alias, id, other)
+			}
+			ids[id] = alias
+		}
+		if tun != "" && !netns {
+			if other, ok := tuns[tun]; ok {
+				return fmt.Errorf("instance %s: TUN name %q already used by %s", alias, tun, other)
+			}
+			tuns[tun] = alias
+		}
+		return nil
+	}
+	for _, cl := range c.Clients {
+		if err := check(cl.ID, cl.Alias, cl.TunName, cl.Netns); err != nil {
+			return err
+		}
+	}
+	for _, sv := range c.Servers {
+		if err := check(sv.ID, sv.Alias, sv.TunName, sv.Netns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateInstance(id, alias string, policy RestartPolicy, logLevel, binary string, limits *ResourceLimits) error {
+	// Missing IDs are generated when the config is loaded
+	if id != "" && !instanceID.MatchString(id) {
+		return fmt.Errorf("instance %s: invalid ID %q", alias, id)
+	}
+	switch policy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("instance %s: invalid restart policy %q", alias, policy)
+	}
+	if err := ValidateLogFilter(logLevel); err != nil {
+		return fmt.Errorf("instance %s: %w", alias, err)
+	}
+	if binary != "" && !ValidBinaryName(binary) {
+		return fmt.Errorf("instance %s: invalid binary version %q", alias, binary)
+	}
+	if err := limits.Validate(); err != nil {
+		return fmt.Errorf("instance %s: %w", alias, err)
+	}
+	return nil
+}
+
+// instanceID keeps IDs usable unquoted in firewall rule comments, and the
+// "phantun:<id>" tag within the 128 bytes nft allows for a comment
+var instanceID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var binaryName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// ValidBinaryName reports whether name can be used as a binaries directory entry
+func ValidBinaryName(name string) bool {
+	return binaryName.MatchString(name)
+}
+
+// Snapshot is a point-in-time copy of the configuration
+type Snapshot struct {
+	General GeneralConfig
+	Clients []ClientConfig
+	Servers []ServerConfig
+}
+
+// Snapshot returns a copy of the configuration fields in a thread-safe manner
+func (c *Config) Snapshot() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Snapshot{
+		General: c.General,
+		Clients: append([]ClientConfig(nil), c.Clients...),
+		Servers: append([]ServerConfig(nil), c.Servers...),
+	}
+}
+
 // Update updates the configuration fields in a thread-safe manner
 func (c *Config) Update(general GeneralConfig, clients []ClientConfig, servers []ServerConfig) {
 	c.mu.Lock()
@@ -0,0 +1,192 @@
+// Package cron parses five-field cron expressions and finds their fire times
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchLimit bounds Next and Prev for expressions that (almost) never fire,
+// such as "0 0 30 2 *"
+const searchLimit = 5 * 366 * 24 * time.Hour
+
+// Expr is a parsed expression: minute hour day-of-month month day-of-week
+type Expr struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+
+	// Standard cron: if both day fields are restricted, either may match
+	domAny, dowAny bool
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// Parse parses an expression such as "0 9 * * MON-FRI", "*/15 * * * *" or "@daily"
+func Parse(expr string) (*Expr, error) {
+	spec := strings.TrimSpace(expr)
+	if m, ok := macros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q: want 5 fields, got %d", expr, len(fields))
+	}
+
+	e := &Expr{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var dow [8]bool // 7 is Sunday as well
+	for i, f := range []struct {
+		set      []bool
+		min, max int
+		names    map[string]int
+	}{
+		{e.minute[:], 0, 59, nil},
+		{e.hour[:], 0, 23, nil},
+		{e.dom[:], 1, 31, nil},
+		{e.month[:], 1, 12, monthNames},
+		{dow[:], 0, 7, dayNames},
+	} {
+		if err := parseField(fields[i], f.set, f.min, f.max, f.names); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+	}
+	copy(e.dow[:], dow[:7])
+	e.dow[0] = e.dow[0] || dow[7]
+	return e, nil
+}
+
+// parseField sets the values of a comma separated list of "*", "n", "a-b",
+// each optionally followed by "/step"
+func parseField(field string, set []bool, min, max int, names map[string]int) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = parseValue(from, min, max, names); err != nil {
+				return err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(to, min, max, names); err != nil {
+					return err
+				}
+			} else if hasStep {
+				hi = max // "5/15" means from 5 on
+			}
+			if hi < lo {
+				return fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func parseValue(s string, min, max int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("value %q out of range %d-%d", s, min, max)
+	}
+	return v, nil
+}
+
+func (e *Expr) dayMatches(t time.Time) bool {
+	dom, dow := e.dom[t.Day()], e.dow[t.Weekday()]
+	switch {
+	case e.domAny && e.dowAny:
+		return true
+	case e.domAny:
+		return dow
+	case e.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Hours and minutes are stepped in absolute time, as the wall clock repeats or
+// skips an hour when daylight saving time changes: a time that happens twice
+// fires twice, one that does not exist is skipped.
+
+// Next returns the first fire time after t, in t's location, or the zero
+// time if there is none within five years
+func (e *Expr) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(searchLimit)
+	for t.Before(limit) {
+		switch {
+		case !e.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !e.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !e.hour[t.Hour()]:
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case !e.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Prev returns the last fire time at or before t, in t's location, or the
+// zero time if there is none within five years
+func (e *Expr) Prev(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute)
+	limit := t.Add(-searchLimit)
+	for t.After(limit) {
+		switch {
+		case !e.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !e.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !e.hour[t.Hour()]:
+			t = t.Add(-time.Duration(t.Minute()+1) * time.Minute)
+		case !e.minute[t.Minute()]:
+			t = t.Add(-time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
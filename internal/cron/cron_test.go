@@ -0,0 +1,146 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"10-5 * * * *",
+		"1,,2 * * * *",
+		"* * * JANUARY *",
+		"@every 5m",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: want an error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Friday 2026-10-16 12:07 UTC
+	from := time.Date(2026, 10, 16, 12, 7, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 16, 12, 8, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2026, 10, 16, 12, 20, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 16, 12, 15, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,2 * *", time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either matches (1st of the month or a Monday)
+		{"0 0 1 * MON", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		if got := e.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%q: Next = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestPrev(t *testing.T) {
+	from := time.Date(2026, 10, 16, 12, 7, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 16, 12, 7, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2026, 10, 16, 12, 5, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		if got := e.Prev(from); !got.Equal(tc.want) {
+			t.Errorf("%q: Prev = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestDaylightSaving(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 3, day, hour, min, 0, 0, berlin) }
+
+	// 2026-03-29 02:00 CET jumps to 03:00 CEST: 02:30 does not exist that day
+	e, _ := Parse("30 2 * * *")
+	if got, want := e.Next(at(29, 1, 0)), at(30, 2, 30); !got.Equal(want) {
+		t.Errorf("spring forward: Next = %s, want %s", got, want)
+	}
+	if got, want := e.Prev(at(29, 12, 0)), at(28, 2, 30); !got.Equal(want) {
+		t.Errorf("spring forward: Prev = %s, want %s", got, want)
+	}
+	e, _ = Parse("0 * * * *")
+	if got, want := e.Next(at(29, 1, 30)), at(29, 3, 0); !got.Equal(want) || got.Sub(at(29, 1, 30)) != 30*time.Minute {
+		t.Errorf("spring forward: hourly Next = %s, want %s", got, want)
+	}
+
+	// 2026-10-25 03:00 CEST falls back to 02:00 CET: 02:30 happens twice
+	cest := time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC) // 02:30 CEST
+	cet := cest.Add(time.Hour)                             // 02:30 CET
+	e, _ = Parse("30 2 * * *")
+	if got := e.Next(cest.Add(-time.Hour).In(berlin)); !got.Equal(cest) {
+		t.Errorf("fall back: Next = %s, want %s", got.In(berlin), cest.In(berlin))
+	}
+	if got := e.Next(cest.In(berlin)); !got.Equal(cet) {
+		t.Errorf("fall back: Next after the first 02:30 = %s, want %s", got, cet.In(berlin))
+	}
+	if got := e.Prev(cet.Add(10 * time.Minute).In(berlin)); !got.Equal(cet) {
+		t.Errorf("fall back: Prev = %s, want %s", got, cet.In(berlin))
+	}
+	if got := e.Prev(cet.Add(-time.Minute).In(berlin)); !got.Equal(cest) {
+		t.Errorf("fall back: Prev before the second 02:30 = %s, want %s", got, cest.In(berlin))
+	}
+	e, _ = Parse("0 5 * * *")
+	if got, want := e.Prev(cet.In(berlin)), time.Date(2026, 10, 24, 5, 0, 0, 0, berlin); !got.Equal(want) {
+		t.Errorf("fall back: Prev from the repeated hour = %s, want %s", got, want)
+	}
+
+	// Next always moves forward and Prev agrees with it across both transitions
+	e, _ = Parse("*/20 * * * *")
+	for _, start := range []time.Time{at(29, 0, 0), time.Date(2026, 10, 25, 0, 0, 0, 0, berlin)} {
+		t0 := start
+		for i := 0; i < 20; i++ {
+			next := e.Next(t0)
+			if !next.After(t0) || next.Sub(t0) > 20*time.Minute {
+				t.Fatalf("Next(%s) = %s", t0, next)
+			}
+			if prev := e.Prev(next); !prev.Equal(next) {
+				t.Fatalf("Prev(%s) = %s", next, prev)
+			}
+			t0 = next
+		}
+	}
+}
@@ -5,232 +5,174 @@ import (
 	"log"
 	"os/exec"
 	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+	"regexp"
 	"strings"
 )
 
-// SetupClient applies iptables rules for Client mode
-func SetupClient(c config.ClientConfig) error {
-	// SAFETY CHECK: Prevent high-jacking SSH
-	if c.LocalPort == "22" {
-		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot use port 22 for LocalPort. This would lock you out of the server!")
-	}
+// Chains owned by the manager. The built-in chains only get a single jump
+// into each; all instance rules live in these.
+const (
+	ChainPre  = "PHANTUN-PRE"  // nat, jumped to from PREROUTING
+	ChainPost = "PHANTUN-POST" // nat, jumped to from POSTROUTING
+	ChainFwd  = "PHANTUN-FWD"  // filter, jumped to from the top of FORWARD
+)
 
-	// iptables -t nat -A POSTROUTING -s {tun_peer}/32 -m comment --comment "phantun" -j MASQUERADE
-	return ensureRule("-t", "nat", "-A", "POSTROUTING",
-		"-s", c.TunPeer+"/32",
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
+// hook ties one of our chains to the built-in chain that jumps into it
+type hook struct {
+	table, builtin, chain string
+	insert                bool // Jump from the top instead of the end
 }
 
-// CleanupClient removes iptables rules for Client mode
-func CleanupClient(c config.ClientConfig) error {
-	return runIptables("-t", "nat", "-D", "POSTROUTING",
-		"-s", c.TunPeer+"/32",
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
+var hooks = []hook{
+	{"nat", "PREROUTING", ChainPre, false},
+	{"nat", "POSTROUTING", ChainPost, false},
+	{"filter", "FORWARD", ChainFwd, true},
 }
 
-// SetupServer applies iptables rules for Server mode
-func SetupServer(s config.ServerConfig) error {
-	// SAFETY CHECK: Prevent high-jacking SSH
-	if s.LocalPort == "22" {
-		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot use port 22 for LocalPort. This would lock you out of the server!")
-	}
-
-	// 1. DNAT: TCP dport {local_port} -> {tun_peer}:{local_port}
-	err := ensureRule("-t", "nat", "-A", "PREROUTING",
-		"-p", "tcp", "--dport", s.LocalPort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "DNAT", "--to-destination", s.TunPeer)
-	if err != nil {
-		return err
-	}
+// Tag is the comment on every rule the manager installs, so cleanup can find
+// them in any table of either family. The jumps into our chains carry it as
+// is; instance rules carry OwnerTag(id).
+const Tag = "phantun"
 
-	// 2. MASQUERADE: TCP dst {tun_peer} dport {remote_port}
-	if err := ensureRule("-t", "nat", "-A", "POSTROUTING",
-		"-p", "tcp", "-d", s.TunPeer, "--dport", s.RemotePort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE"); err != nil {
-		return err
-	}
-
-	// 3. FORWARD: Allow traffic to/from TUN interface (Safe against default DROP)
-	if err := ensureRule("-I", "FORWARD", "-i", s.TunName, "-j", "ACCEPT"); err != nil {
-		log.Printf("Warning: Failed to add FORWARD input rule: %v", err)
-	}
-	if err := ensureRule("-I", "FORWARD", "-o", s.TunName, "-j", "ACCEPT"); err != nil {
-		log.Printf("Warning: Failed to add FORWARD output rule: %v", err)
-	}
-	return nil
+// OwnerTag is the tag of the rules installed for one instance
+func OwnerTag(id string) string {
+	return Tag + ":" + id
 }
 
-// CleanupServer removes iptables rules for Server mode
-func CleanupServer(s config.ServerConfig) error {
-	// Ignore errors during cleanup
-	runIptables("-t", "nat", "-D", "PREROUTING",
-		"-p", "tcp", "--dport", s.LocalPort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "DNAT", "--to-destination", s.TunPeer)
-
-	runIptables("-t", "nat", "-D", "POSTROUTING",
-		"-p", "tcp", "-d", s.TunPeer, "--dport", s.RemotePort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
-
-	runIptables("-D", "FORWARD", "-i", s.TunName, "-j", "ACCEPT")
-	runIptables("-D", "FORWARD", "-o", s.TunName, "-j", "ACCEPT")
+// rule is one rule in one of our chains
+type rule struct {
+	table, chain string
+	args         []string
+}
 
-	return nil
+// render formats the rule for iptables-restore, tagged with its owner
+func (r rule) render(id string) string {
+	return "-A " + r.chain + " " + strings.Join(withTag(r.args, OwnerTag(id)), " ")
 }
 
-func runIptables(args ...string) error {
-	cmd := exec.Command("iptables", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		cmdStr := strings.Join(args, " ")
-		isCleanup := strings.Contains(cmdStr, "-D")
-		isCheck := strings.Contains(cmdStr, "-C")
-
-		// "Bad rule" or "Does a matching rule exist" or "No chain/target/match"
-		isBenignError := (isCleanup || isCheck) && (strings.Contains(string(out), "No chain/target/match") || strings.Contains(string(out), "Bad rule") || strings.Contains(string(out), "Does a matching rule exist"))
-
-		if isBenignError {
-			if isCheck {
-				// For Check (-C), we must return the error so the caller knows the rule is missing!
-				// But we don't log it because it's expected.
-				return fmt.Errorf("check failed (benign): %w", err)
-			}
-			if isCleanup {
-				// For Cleanup (-D), we return nil (success) because missing rule is fine.
-				return nil
-			}
+// withTag inserts the tag comment in front of the -j target
+func withTag(args []string, tag string) []string {
+	i := len(args)
+	for j, a := range args {
+		if a == "-j" {
+			i = j
+			break
 		}
-		// Real error: Log it
-		log.Printf("iptables error: %v, output: %s", err, string(out))
-		return fmt.Errorf("iptables failed: %w", err)
 	}
-	return nil
+	out := append([]string(nil), args[:i]...)
+	out = append(out, "-m", "comment", "--comment", tag)
+	return append(out, args[i:]...)
 }
 
-func runIp6tables(args ...string) error {
-	cmd := exec.Command("ip6tables", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		// Suppress errors for:
-		// 1. Deletion (-D) of non-existent rules
-		// 2. Checking (-C) of non-existent rules
-		cmdStr := strings.Join(args, " ")
-		isCleanup := strings.Contains(cmdStr, "-D")
-		isCheck := strings.Contains(cmdStr, "-C")
-
-		isBenignError := (isCleanup || isCheck) && (strings.Contains(string(out), "No chain/target/match") || strings.Contains(string(out), "Bad rule") || strings.Contains(string(out), "Does a matching rule exist"))
+// chainExists checks for a chain without logging when it is missing
+func chainExists(bin, netns, table, chain string) bool {
+	return command(bin, netns, "-t", table, "-S", chain).Run() == nil
+}
 
-		if isBenignError {
-			return nil
-		}
-		log.Printf("ip6tables error: %v, output: %s", err, string(out))
-		return fmt.Errorf("ip6tables failed: %w", err)
+// command builds a call of an iptables tool inside a network namespace ("" for the host)
+func command(bin, netns string, args ...string) *exec.Cmd {
+	if netns != "" {
+		return exec.Command("ip", append([]string{"netns", "exec", netns, bin}, args...)...)
 	}
-	return nil
+	return exec.Command(bin, args...)
 }
 
-// ensureRuleIPv6 checks if a rule exists via ip6tables before adding it
-func ensureRuleIPv6(args ...string) error {
-	checkArgs := make([]string, len(args))
-	copy(checkArgs, args)
+// SetupClient applies iptables rules for Client mode
+func SetupClient(c config.ClientConfig) error {
+	return setupClient("", c)
+}
 
-	actionIndex := -1
-	for i, arg := range checkArgs {
-		if arg == "-A" || arg == "-I" {
-			checkArgs[i] = "-C"
-			actionIndex = i
-			break
-		}
+// setupClient installs the client rules in the given network namespace ("" for the host)
+func setupClient(netns string, c config.ClientConfig) error {
+	// SAFETY CHECK: Prevent high-jacking SSH
+	if c.LocalPort == "22" {
+		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot use port 22 for LocalPort. This would lock you out of the server!")
+	}
+	if netns != "" {
+		return ipv4.applyIn(netns, map[string][]rule{c.ID: clientRules(c)})
 	}
+	return ipv4.set(c.ID, clientRules(c))
+}
 
-	if actionIndex != -1 {
-		if err := runIp6tables(checkArgs...); err == nil {
-			return nil
-		}
+// CleanupClient removes iptables rules for Client mode
+func CleanupClient(c config.ClientConfig) error {
+	return ipv4.set(c.ID, nil)
+}
+
+// SetupServer applies iptables rules for Server mode
+func SetupServer(s config.ServerConfig) error {
+	return setupServer("", s)
+}
+
+// setupServer installs the server rules in the given network namespace ("" for the host)
+func setupServer(netns string, s config.ServerConfig) error {
+	// SAFETY CHECK: Prevent high-jacking SSH
+	if s.LocalPort == "22" {
+		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot use port 22 for LocalPort. This would lock you out of the server!")
 	}
-	return runIp6tables(args...)
+	if netns != "" {
+		return ipv4.applyIn(netns, map[string][]rule{s.ID: serverRules(s)})
+	}
+	return ipv4.set(s.ID, serverRules(s))
+}
+
+// CleanupServer removes iptables rules for Server mode
+func CleanupServer(s config.ServerConfig) error {
+	return ipv4.set(s.ID, nil)
 }
 
 // SetupClientIPv6 applies ip6tables rules for Client mode (IPv6)
 func SetupClientIPv6(c config.ClientConfig) error {
-	// ip6tables -t nat -A POSTROUTING -s {tun_peer_ipv6}/128 -m comment --comment "phantun" -j MASQUERADE
-	return ensureRuleIPv6("-t", "nat", "-A", "POSTROUTING",
-		"-s", c.TunPeerIPv6+"/128",
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
+	return ipv6.set(c.ID, clientRulesIPv6(c))
 }
 
 // CleanupClientIPv6 removes ip6tables rules for Client mode (IPv6)
 func CleanupClientIPv6(c config.ClientConfig) error {
-	return runIp6tables("-t", "nat", "-D", "POSTROUTING",
-		"-s", c.TunPeerIPv6+"/128",
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
+	return ipv6.set(c.ID, nil)
 }
 
 // SetupServerIPv6 applies ip6tables rules for Server mode (IPv6)
 func SetupServerIPv6(s config.ServerConfig) error {
-	// IPv6 DNAT
-	// ip6tables -t nat -A PREROUTING -p tcp --dport {local_port} ... -j DNAT ...
-	err := ensureRuleIPv6("-t", "nat", "-A", "PREROUTING",
-		"-p", "tcp", "--dport", s.LocalPort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "DNAT", "--to-destination", s.TunPeerIPv6)
-	if err != nil {
-		return err
-	}
-
-	// IPv6 MASQUERADE
-	return ensureRuleIPv6("-t", "nat", "-A", "POSTROUTING",
-		"-p", "tcp", "-d", s.TunPeerIPv6, "--dport", s.RemotePort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
+	return ipv6.set(s.ID, serverRulesIPv6(s))
 }
 
 // CleanupServerIPv6 removes ip6tables rules for Server mode (IPv6)
 func CleanupServerIPv6(s config.ServerConfig) error {
-	runIp6tables("-t", "nat", "-D", "PREROUTING",
-		"-p", "tcp", "--dport", s.LocalPort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "DNAT", "--to-destination", s.TunPeerIPv6)
-
-	runIp6tables("-t", "nat", "-D", "POSTROUTING",
-		"-p", "tcp", "-d", s.TunPeerIPv6, "--dport", s.RemotePort,
-		"-m", "comment", "--comment", "phantun",
-		"-j", "MASQUERADE")
-	return nil
-}
-
-// ensureRule checks if a rule exists before adding it
-func ensureRule(args ...string) error {
-	// Construct check args: replace -A (Append) or -I (Insert) with -C (Check)
-	checkArgs := make([]string, len(args))
-	copy(checkArgs, args)
-
-	actionIndex := -1
-	for i, arg := range checkArgs {
-		if arg == "-A" || arg == "-I" {
-			checkArgs[i] = "-C"
-			actionIndex = i
-			break
-		}
+	return ipv6.set(s.ID, nil)
+}
+
+func clientRules(c config.ClientConfig) []rule {
+	return []rule{
+		// -A PHANTUN-POST -s {tun_peer}/32 -j MASQUERADE
+		{"nat", ChainPost, []string{"-s", c.TunPeer + "/32", "-j", "MASQUERADE"}},
 	}
+}
 
-	if actionIndex != -1 {
-		// Check if rule exists
-		if err := runIptables(checkArgs...); err == nil {
-			// Rule exists, do nothing
-			return nil
-		}
+func clientRulesIPv6(c config.ClientConfig) []rule {
+	return []rule{
+		{"nat", ChainPost, []string{"-s", c.TunPeerIPv6 + "/128", "-j", "MASQUERADE"}},
 	}
+}
 
-	// Rule doesn't exist (or check failed), try to add it
-	return runIptables(args...)
+func serverRules(s config.ServerConfig) []rule {
+	return []rule{
+		// 1. DNAT: TCP dport {local_port} -> {tun_peer}:{local_port}
+		{"nat", ChainPre, []string{"-p", "tcp", "--dport", s.LocalPort, "-j", "DNAT", "--to-destination", s.TunPeer}},
+		// 2. MASQUERADE: TCP dst {tun_peer} dport {remote_port}
+		{"nat", ChainPost, []string{"-p", "tcp", "-d", s.TunPeer, "--dport", s.RemotePort, "-j", "MASQUERADE"}},
+		// 3. FORWARD: Allow traffic to/from TUN interface (Safe against default DROP,
+		// PHANTUN-FWD is jumped to from the top of FORWARD)
+		{"filter", ChainFwd, []string{"-i", s.TunName, "-j", "ACCEPT"}},
+		{"filter", ChainFwd, []string{"-o", s.TunName, "-j", "ACCEPT"}},
+	}
+}
+
+func serverRulesIPv6(s config.ServerConfig) []rule {
+	return []rule{
+		{"nat", ChainPre, []string{"-p", "tcp", "--dport", s.LocalPort, "-j", "DNAT", "--to-destination", s.TunPeerIPv6}},
+		{"nat", ChainPost, []string{"-p", "tcp", "-d", s.TunPeerIPv6, "--dport", s.RemotePort, "-j", "MASQUERADE"}},
+	}
 }
 
 // GetRules returns current iptables-save output
@@ -243,53 +185,215 @@ func GetRules() (string, error) {
 	return string(out), nil
 }
 
-// CleanupAll removes ALL rules created by Phantun (marked with comment "phantun")
-// This implements the "Clean Slate" strategy.
+// CleanupInstance removes exactly the host rules tagged for one instance,
+// wherever they are, without touching those of other instances
+func CleanupInstance(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(ipv4.rules, id)
+	delete(ipv6.rules, id)
+
+	var firstErr error
+	rules := 0
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			continue
+		}
+		n, err := removeMatching(bin, func(chain, tag string) bool { return tag == OwnerTag(id) })
+		rules += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	log.Printf("Firewall cleanup of instance %s removed %d rules", id, rules)
+	return firstErr
+}
+
+// CleanupAll removes ALL rules created by Phantun, in every table of both
+// families: every rule carrying a tag (the jumps into our chains, and rules of
+// versions before the chains), then the chains themselves. Everything removed
+// is logged. This implements the "Clean Slate" strategy.
 func CleanupAll() error {
-	// 1. Get all rules
-	saveCmd := exec.Command("iptables-save")
-	out, err := saveCmd.CombinedOutput()
+	var firstErr error
+	rules, chains := 0, 0
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			continue
+		}
+		n, err := removeMatching(bin, strayTagged)
+		rules += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, h := range hooks {
+			removed, err := removeChain(bin, h)
+			if removed {
+				chains++
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	ipv4.reset()
+	ipv6.reset()
+	log.Printf("Firewall cleanup removed %d tagged rules and %d chains", rules, chains)
+	return firstErr
+}
+
+// removeMatching deletes every rule iptables-save lists, in any table, for
+// which match returns true, and returns how many were removed
+func removeMatching(bin string, match func(chain, tag string) bool) (int, error) {
+	out, err := exec.Command(bin + "-save").Output()
 	if err != nil {
-		return fmt.Errorf("failed to list rules: %w", err)
+		return 0, fmt.Errorf("failed to list %s rules: %w", bin, err)
+	}
+	removed := 0
+	var firstErr error
+	for _, l := range parseSave(string(out)) {
+		if !match(l.chain, l.tag) {
+			continue
+		}
+		args := append([]string{"-t", l.table, "-D"}, splitRule(l.spec)[1:]...)
+		if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+			log.Printf("Failed to delete rule: %s %s: %v, output: %s", bin, strings.Join(args, " "), err, string(out))
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: deleting tagged rule failed: %w", bin, err)
+			}
+			continue
+		}
+		log.Printf("Removed %s rule: -t %s %s", bin, l.table, l.spec)
+		removed++
 	}
+	return removed, firstErr
+}
 
-	lines := strings.Split(string(out), "\n")
-	var commands [][]string
+// savedRule is one -A line of iptables-save output
+type savedRule struct {
+	table, chain, tag, spec string
+}
 
-	// 2. Parse lines to find Phantun rules
-	for _, line := range lines {
-		// Example line: -A POSTROUTING ... -m comment --comment phantun ...
-		// We detect "phantun" keyword in the line, and ensure it's a rule (starts with -A)
-		if strings.Contains(line, "phantun") && strings.HasPrefix(line, "-A") {
-			// We only care about MASQUERADE and DNAT for now
-			if strings.Contains(line, "MASQUERADE") || strings.Contains(line, "DNAT") {
-				parts := strings.Fields(line)
-				if len(parts) < 3 {
-					continue
-				}
-
-				// Replace -A with -D
-				parts[0] = "-D"
-				commands = append(commands, parts)
-			}
+// parseSave extracts the rules from iptables-save output
+func parseSave(out string) []savedRule {
+	var rules []savedRule
+	table := ""
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "*") {
+			table = strings.TrimPrefix(line, "*")
+			continue
 		}
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		chain, _, _ := strings.Cut(strings.TrimPrefix(line, "-A "), " ")
+		rules = append(rules, savedRule{table: table, chain: chain, tag: tagOf(line), spec: line})
 	}
+	return rules
+}
+
+// ownChain reports whether a chain is one of the manager's PHANTUN-* chains
+func ownChain(chain string) bool {
+	return strings.HasPrefix(chain, "PHANTUN-")
+}
 
-	// 3. Execute deletions
-	for _, cmdArgs := range commands {
-		// Prepend "-t nat" assuming all our rules are in nat table
-		fullArgs := append([]string{"-t", "nat"}, cmdArgs...)
+// strayTagged reports whether CleanupAll deletes a rule one by one: it is
+// tagged and outside our chains. Rules inside them go away with the chain.
+func strayTagged(chain, tag string) bool {
+	return tag != "" && !ownChain(chain)
+}
 
-		fmt.Printf("Cleaning rule: iptables %s\n", strings.Join(fullArgs, " "))
+// tagRe matches our tag, with or without an owner, as iptables-save prints
+// it, quoted or not
+var tagRe = regexp.MustCompile(`--comment (?:"(` + Tag + `(?::[^"]*)?)"|(` + Tag + `(?::\S*)?))(?: |$)`)
 
-		cmd := exec.Command("iptables", fullArgs...)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("Failed to delete rule: %v, output: %s", err, string(out))
-			// Continue cleaning others
+// tagOf returns the tag of an iptables-save line, "" if it has none
+func tagOf(line string) string {
+	if m := tagRe.FindStringSubmatch(line); m != nil {
+		return m[1] + m[2]
+	}
+	return ""
+}
+
+// ListRules returns the rules in our chains and every tagged rule elsewhere,
+// from both families
+func ListRules() ([]system.FirewallRule, error) {
+	var rules []system.FirewallRule
+	for _, f := range []struct{ bin, family string }{{"iptables", "ipv4"}, {"ip6tables", "ipv6"}} {
+		if _, err := exec.LookPath(f.bin); err != nil {
+			continue
+		}
+		out, err := exec.Command(f.bin + "-save").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s rules: %w", f.bin, err)
+		}
+		for _, l := range parseSave(string(out)) {
+			if l.tag == "" && !ownChain(l.chain) {
+				continue
+			}
+			owner, ok := strings.CutPrefix(l.tag, Tag+":")
+			if !ok {
+				owner = ""
+			}
+			rules = append(rules, system.FirewallRule{
+				Family: f.family, Table: l.table, Chain: l.chain, Tag: l.tag, Owner: owner, Spec: l.spec,
+			})
 		}
 	}
+	return rules, nil
+}
 
-	return nil
+// splitRule splits an iptables-save line into arguments, removing the
+// quotes iptables-save puts around comments
+func splitRule(line string) []string {
+	var args []string
+	var cur strings.Builder
+	quoted, started := false, false
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == '\\' && quoted && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case ch == '"':
+			quoted = !quoted
+			started = true
+		case ch == ' ' && !quoted:
+			if started {
+				args = append(args, cur.String())
+				cur.Reset()
+				started = false
+			}
+		default:
+			cur.WriteByte(ch)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// removeChain unhooks, flushes and deletes one of our chains. A missing chain
+// is not an error.
+func removeChain(bin string, h hook) (bool, error) {
+	if !chainExists(bin, "", h.table, h.chain) {
+		return false, nil
+	}
+	// Untagged jumps may remain from an earlier version; drop them all
+	for i := 0; i < 10; i++ {
+		if exec.Command(bin, "-t", h.table, "-D", h.builtin, "-j", h.chain).Run() != nil {
+			break
+		}
+	}
+	for _, args := range [][]string{{"-F", h.chain}, {"-X", h.chain}} {
+		if out, err := exec.Command(bin, append([]string{"-t", h.table}, args...)...).CombinedOutput(); err != nil {
+			log.Printf("Failed to remove chain %s: %v, output: %s", h.chain, err, string(out))
+			return false, fmt.Errorf("%s: removing %s failed: %w", bin, h.chain, err)
+		}
+	}
+	log.Printf("Removed %s chain: -t %s %s", bin, h.table, h.chain)
+	return true, nil
 }
 
 // GetStats returns a map of rule counts
@@ -299,14 +403,13 @@ func GetStats() (map[string]int, error) {
 		return nil, err
 	}
 
-	// We count lines that contain our marker tag
-	// Logic: Split by newline -> filter "comment phantun" -> count MASQUERADE/DNAT
+	// Count the rules in our own chains
 	lines := strings.Split(rules, "\n")
 	masq := 0
 	dnat := 0
 
 	for _, line := range lines {
-		if strings.Contains(line, "phantun") {
+		if strings.HasPrefix(line, "-A "+ChainPre+" ") || strings.HasPrefix(line, "-A "+ChainPost+" ") {
 			if strings.Contains(line, "MASQUERADE") {
 				masq++
 			}
@@ -323,3 +426,31 @@ func GetStats() (map[string]int, error) {
 	stats["total"] = stats["masquerade"] + stats["dnat"]
 	return stats, nil
 }
+
+// ForwardPolicy returns the policy of the filter FORWARD chain, e.g. "DROP"
+// on hosts where Docker manages forwarding
+func ForwardPolicy() (string, error) {
+	out, err := exec.Command("iptables", "-t", "filter", "-S", "FORWARD").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if policy, ok := strings.CutPrefix(line, "-P FORWARD "); ok {
+			return strings.TrimSpace(policy), nil
+		}
+	}
+	return "", fmt.Errorf("no FORWARD policy in iptables -S output")
+}
+
+// Variant returns the flavour of the installed iptables, "legacy" or
+// "nf_tables" (the iptables-nft shim), per iptables -V
+func Variant() (string, error) {
+	out, err := exec.Command("iptables", "-V").CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(string(out), "nf_tables") {
+		return "nf_tables", nil
+	}
+	return "legacy", nil
+}
@@ -0,0 +1,177 @@
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+func renderAll(id string, rules []rule) string {
+	var lines []string
+	for _, r := range rules {
+		lines = append(lines, r.table+" "+r.render(id))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestRuleSets(t *testing.T) {
+	client := config.ClientConfig{ID: "c1", TunPeer: "192.168.200.2", TunPeerIPv6: "fcc8::2"}
+	server := config.ServerConfig{
+		ID: "s1", LocalPort: "4567", RemotePort: "51820", TunName: "tun-s1",
+		TunPeer: "192.168.201.2", TunPeerIPv6: "fcc9::2",
+	}
+	ns := system.Netns{Name: "phantun-s1", HostVeth: "vph-s1", HostAddr: "10.200.0.1", NsAddr: "10.200.0.2", PrefixLen: 30}
+
+	for _, tc := range []struct {
+		name  string
+		id    string
+		rules []rule
+		want  string
+	}{
+		{"client", "c1", clientRules(client),
+			`nat -A PHANTUN-POST -s 192.168.200.2/32 -m comment --comment phantun:c1 -j MASQUERADE`},
+		{"client ipv6", "c1", clientRulesIPv6(client),
+			`nat -A PHANTUN-POST -s fcc8::2/128 -m comment --comment phantun:c1 -j MASQUERADE`},
+		{"server", "s1", serverRules(server), strings.Join([]string{
+			`nat -A PHANTUN-PRE -p tcp --dport 4567 -m comment --comment phantun:s1 -j DNAT --to-destination 192.168.201.2`,
+			`nat -A PHANTUN-POST -p tcp -d 192.168.201.2 --dport 51820 -m comment --comment phantun:s1 -j MASQUERADE`,
+			`filter -A PHANTUN-FWD -i tun-s1 -m comment --comment phantun:s1 -j ACCEPT`,
+			`filter -A PHANTUN-FWD -o tun-s1 -m comment --comment phantun:s1 -j ACCEPT`,
+		}, "\n")},
+		{"server ipv6", "s1", serverRulesIPv6(server), strings.Join([]string{
+			`nat -A PHANTUN-PRE -p tcp --dport 4567 -m comment --comment phantun:s1 -j DNAT --to-destination fcc9::2`,
+			`nat -A PHANTUN-POST -p tcp -d fcc9::2 --dport 51820 -m comment --comment phantun:s1 -j MASQUERADE`,
+		}, "\n")},
+		{"netns host side", "s1", netnsHostRules(ns), strings.Join([]string{
+			`nat -A PHANTUN-POST -s 10.200.0.0/30 ! -o vph-s1 -m comment --comment phantun:s1 -j MASQUERADE`,
+			`filter -A PHANTUN-FWD -i vph-s1 -m comment --comment phantun:s1 -j ACCEPT`,
+			`filter -A PHANTUN-FWD -o vph-s1 -m comment --comment phantun:s1 -j ACCEPT`,
+		}, "\n")},
+	} {
+		if got := renderAll(tc.id, tc.rules); got != tc.want {
+			t.Errorf("%s:\nwant %s\ngot  %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestWithTag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-j", "PHANTUN-PRE"}, "-m comment --comment phantun -j PHANTUN-PRE"},
+		{[]string{"-s", "10.0.0.1/32", "-j", "MASQUERADE"}, "-s 10.0.0.1/32 -m comment --comment phantun -j MASQUERADE"},
+		{[]string{"-p", "tcp"}, "-p tcp -m comment --comment phantun"},
+	} {
+		if got := strings.Join(withTag(tc.args, Tag), " "); got != tc.want {
+			t.Errorf("withTag(%v) = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestTagOf(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{`-A PREROUTING -m comment --comment phantun -j PHANTUN-PRE`, "phantun"},
+		{`-A PREROUTING -m comment --comment "phantun" -j PHANTUN-PRE`, "phantun"},
+		{`-A PHANTUN-POST -s 10.0.0.1/32 -m comment --comment phantun:c1 -j MASQUERADE`, "phantun:c1"},
+		{`-A PHANTUN-POST -s 10.0.0.1/32 -m comment --comment "phantun:c1" -j MASQUERADE`, "phantun:c1"},
+		{`-A FORWARD -m comment --comment phantun:s.1-a_b`, "phantun:s.1-a_b"},
+		{`-A FORWARD -m comment --comment phantunx -j ACCEPT`, ""},
+		{`-A FORWARD -m comment --comment "phantunx" -j ACCEPT`, ""},
+		{`-A FORWARD -m comment --comment "my phantun" -j ACCEPT`, ""},
+		{`-A FORWARD -m comment --comment xphantun -j ACCEPT`, ""},
+		{`-A FORWARD -j ACCEPT`, ""},
+	} {
+		if got := tagOf(tc.line); got != tc.want {
+			t.Errorf("tagOf(%s) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestSplitRule(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{`-A FORWARD -i eth0 -j ACCEPT`, []string{"-A", "FORWARD", "-i", "eth0", "-j", "ACCEPT"}},
+		{`-A FORWARD  -j  ACCEPT`, []string{"-A", "FORWARD", "-j", "ACCEPT"}},
+		{`-A FORWARD -m comment --comment "phantun:c1" -j ACCEPT`, []string{"-A", "FORWARD", "-m", "comment", "--comment", "phantun:c1", "-j", "ACCEPT"}},
+		{`-A FORWARD -m comment --comment "two words" -j ACCEPT`, []string{"-A", "FORWARD", "-m", "comment", "--comment", "two words", "-j", "ACCEPT"}},
+		{`-A FORWARD -m comment --comment "say \"hi\"" -j ACCEPT`, []string{"-A", "FORWARD", "-m", "comment", "--comment", `say "hi"`, "-j", "ACCEPT"}},
+		{`-A FORWARD -m comment --comment ""`, []string{"-A", "FORWARD", "-m", "comment", "--comment", ""}},
+	} {
+		if got := splitRule(tc.line); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitRule(%s) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestParseSave(t *testing.T) {
+	out := `# Generated by iptables-save v1.8.9
+*nat
+:PREROUTING ACCEPT [0:0]
+:PHANTUN-POST - [0:0]
+-A POSTROUTING -m comment --comment phantun -j PHANTUN-POST
+-A PHANTUN-POST -s 10.0.0.1/32 -m comment --comment "phantun:c1" -j MASQUERADE
+COMMIT
+*filter
+-A FORWARD -j DOCKER-USER
+COMMIT
+`
+	want := []savedRule{
+		{"nat", "POSTROUTING", "phantun", `-A POSTROUTING -m comment --comment phantun -j PHANTUN-POST`},
+		{"nat", "PHANTUN-POST", "phantun:c1", `-A PHANTUN-POST -s 10.0.0.1/32 -m comment --comment "phantun:c1" -j MASQUERADE`},
+		{"filter", "FORWARD", "", `-A FORWARD -j DOCKER-USER`},
+	}
+	if got := parseSave(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSave:\nwant %+v\ngot  %+v", want, got)
+	}
+}
+
+func TestStrayTagged(t *testing.T) {
+	for _, tc := range []struct {
+		chain, tag string
+		want       bool
+	}{
+		{"PREROUTING", "phantun", true},
+		{"POSTROUTING", "phantun:c1", true},
+		{"FORWARD", "", false},
+		// Rules inside our chains go away with the chain
+		{"PHANTUN-PRE", "phantun:s1", false},
+		{"PHANTUN-POST", "phantun:c1", false},
+		{"PHANTUN-FWD", "phantun:s1", false},
+	} {
+		if got := strayTagged(tc.chain, tc.tag); got != tc.want {
+			t.Errorf("strayTagged(%s, %q) = %v, want %v", tc.chain, tc.tag, got, tc.want)
+		}
+	}
+}
+
+func TestInstanceRules(t *testing.T) {
+	saved := parseSave(`*nat
+-A POSTROUTING -m comment --comment phantun -j PHANTUN-POST
+-A POSTROUTING -s 10.0.0.9/32 -m comment --comment phantun:c9 -j MASQUERADE
+-A PHANTUN-POST -s 10.0.0.1/32 -m comment --comment "phantun:c1" -j MASQUERADE
+-A PHANTUN-POST -s 10.0.0.2/32 -j MASQUERADE
+COMMIT
+*filter
+-A PHANTUN-FWD -i tun-s1 -m comment --comment phantun:s1 -j ACCEPT
+COMMIT
+`)
+	want := map[string][]rule{
+		"c1": {{"nat", ChainPost, []string{"-s", "10.0.0.1/32", "-j", "MASQUERADE"}}},
+		"s1": {{"filter", ChainFwd, []string{"-i", "tun-s1", "-j", "ACCEPT"}}},
+	}
+	if got := instanceRules(saved); !reflect.DeepEqual(got, want) {
+		t.Errorf("instanceRules:\nwant %v\ngot  %v", want, got)
+	}
+	// Loaded rules render back to what was saved
+	if got := want["c1"][0].render("c1"); got != `-A PHANTUN-POST -s 10.0.0.1/32 -m comment --comment phantun:c1 -j MASQUERADE` {
+		t.Errorf("render = %s", got)
+	}
+}
@@ -0,0 +1,48 @@
+package iptables
+
+import (
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+// In namespace mode the usual client/server rules live inside the instance's
+// namespace and vanish with it. The host only NATs the namespace's veth
+// subnet and, for servers, forwards the listening port into the namespace.
+
+// SetupClientNetns installs the client rules inside the namespace plus the host side
+func SetupClientNetns(n system.Netns, c config.ClientConfig) error {
+	if err := setupClient(n.Name, c); err != nil {
+		return err
+	}
+	return ipv4.set(c.ID, netnsHostRules(n))
+}
+
+// CleanupClientNetns removes the host side rules of a client namespace
+func CleanupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return ipv4.set(c.ID, nil)
+}
+
+// SetupServerNetns installs the server rules inside the namespace plus the
+// host side, including the DNAT of the listening port into the namespace
+func SetupServerNetns(n system.Netns, s config.ServerConfig) error {
+	if err := setupServer(n.Name, s); err != nil {
+		return err
+	}
+	// -A PHANTUN-PRE -p tcp --dport {local_port} -j DNAT --to-destination {ns_addr}
+	dnat := rule{"nat", ChainPre, []string{"-p", "tcp", "--dport", s.LocalPort, "-j", "DNAT", "--to-destination", n.NsAddr}}
+	return ipv4.set(s.ID, append(netnsHostRules(n), dnat))
+}
+
+// CleanupServerNetns removes the host side rules of a server namespace
+func CleanupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return ipv4.set(s.ID, nil)
+}
+
+func netnsHostRules(n system.Netns) []rule {
+	return []rule{
+		// -A PHANTUN-POST -s {veth_subnet} ! -o {host_veth} -j MASQUERADE
+		{"nat", ChainPost, []string{"-s", n.Subnet(), "!", "-o", n.HostVeth, "-j", "MASQUERADE"}},
+		{"filter", ChainFwd, []string{"-i", n.HostVeth, "-j", "ACCEPT"}},
+		{"filter", ChainFwd, []string{"-o", n.HostVeth, "-j", "ACCEPT"}},
+	}
+}
@@ -0,0 +1,310 @@
+package iptables
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Every change re-renders the complete content of our chains for one family
+// and applies it with a single "<bin>-restore --noflush" call, so an instance
+// is never left with half of its rules. If the call fails, the previously
+// applied ruleset is restored.
+
+// family is iptables or ip6tables with the rules we want installed
+type family struct {
+	bin    string
+	tables []string
+	rules  map[string][]rule // Desired host rules by instance ID. Guarded by mu.
+
+	// Whether rules includes what our host chains held when the manager
+	// started. Guarded by mu.
+	loaded bool
+
+	// Batch in progress: rules are applied by Commit. before is the ruleset
+	// prior to the first change, nil while nothing changed. Guarded by mu.
+	batching bool
+	before   map[string][]rule
+}
+
+var (
+	mu   sync.Mutex
+	ipv4 = &family{bin: "iptables", tables: []string{"nat", "filter"}, rules: make(map[string][]rule)}
+	ipv6 = &family{bin: "ip6tables", tables: []string{"nat"}, rules: make(map[string][]rule)}
+)
+
+// set replaces the host rules of one instance (nil removes them) and applies
+// the whole ruleset. On failure the previous ruleset stays in place.
+func (f *family) set(id string, rules []rule) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	if f.batching {
+		if f.before == nil {
+			f.before = cloneRules(f.rules)
+		}
+		f.replace(id, rules)
+		return nil
+	}
+	return f.setLocked(id, rules)
+}
+
+// setLocked is set with mu held and the rules loaded
+func (f *family) setLocked(id string, rules []rule) error {
+	prev, existed := f.rules[id]
+	if rules == nil && !existed {
+		return nil
+	}
+	f.replace(id, rules)
+
+	err := f.applyIn("", f.rules)
+	if err == nil {
+		return nil
+	}
+	if existed {
+		f.rules[id] = prev
+	} else {
+		delete(f.rules, id)
+	}
+	if rbErr := f.applyIn("", f.rules); rbErr != nil {
+		log.Printf("[ERROR] %s rollback failed, rules may be incomplete: %v", f.bin, rbErr)
+	} else {
+		log.Printf("[WARNING] %s transaction rolled back to the previous ruleset", f.bin)
+	}
+	return err
+}
+
+// replace updates the desired rules of one instance without applying them
+func (f *family) replace(id string, rules []rule) {
+	if rules == nil {
+		delete(f.rules, id)
+	} else {
+		f.rules[id] = rules
+	}
+}
+
+// load adds the instance rules found in our host chains to the desired ones,
+// once. After a restart in adopt mode they belong to processes that are still
+// running, and the first transaction must not flush them.
+func (f *family) load() error {
+	if f.loaded {
+		return nil
+	}
+	saved, err := f.save("")
+	if err != nil {
+		return err
+	}
+	for id, rules := range instanceRules(saved) {
+		if _, ok := f.rules[id]; !ok {
+			f.rules[id] = rules
+		}
+	}
+	f.loaded = true
+	return nil
+}
+
+// reset forgets the desired rules, after CleanupAll removed our chains
+func (f *family) reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	f.rules = make(map[string][]rule)
+	f.loaded = true
+}
+
+// Begin defers applying host rules until Commit, so that setting up many
+// instances, e.g. at startup, costs one transaction per family
+func Begin() {
+	mu.Lock()
+	defer mu.Unlock()
+	ipv4.batching, ipv6.batching = true, true
+}
+
+// Commit applies the host rules set since Begin. A failed transaction is
+// rolled back entirely: the family returns to its ruleset before Begin, and
+// every instance whose IPv4 rules changed is returned as failed. IPv6
+// failures are only logged, like other IPv6 setup failures.
+func Commit() map[string]error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	failed := make(map[string]error)
+	for _, f := range []*family{ipv4, ipv6} {
+		before := f.before
+		f.batching, f.before = false, nil
+		if before == nil {
+			continue
+		}
+		err := f.applyIn("", f.rules)
+		if err == nil {
+			continue
+		}
+
+		after := f.rules
+		f.rules = before
+		if rbErr := f.applyIn("", f.rules); rbErr != nil {
+			log.Printf("[ERROR] %s rollback failed, rules may be incomplete: %v", f.bin, rbErr)
+		} else {
+			log.Printf("[WARNING] %s transaction rolled back to the previous ruleset", f.bin)
+		}
+		for _, id := range changedIDs(before, after) {
+			if f == ipv4 {
+				failed[id] = err
+			}
+		}
+	}
+	return failed
+}
+
+// changedIDs lists the instances whose rules differ between two rulesets, sorted
+func changedIDs(a, b map[string][]rule) []string {
+	var ids []string
+	for id, rules := range a {
+		if !reflect.DeepEqual(rules, b[id]) {
+			ids = append(ids, id)
+		}
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func cloneRules(rules map[string][]rule) map[string][]rule {
+	out := make(map[string][]rule, len(rules))
+	for id, r := range rules {
+		out[id] = r
+	}
+	return out
+}
+
+// applyIn replaces the content of our chains in a network namespace ("" for
+// the host) with the given rules in one transaction
+func (f *family) applyIn(netns string, rules map[string][]rule) error {
+	saved, err := f.save(netns)
+	if err != nil {
+		return err
+	}
+	payload := f.render(rules, hookedChains(saved))
+	cmd := command(f.bin+"-restore", netns, "--noflush")
+	cmd.Stdin = strings.NewReader(payload)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("[ERROR] %s-restore failed: %v, output: %s\n--- payload ---\n%s--- end of payload ---",
+			f.bin, err, strings.TrimSpace(string(out)), payload)
+		return fmt.Errorf("%s-restore failed: %w", f.bin, err)
+	}
+	return nil
+}
+
+// save lists the current rules in a network namespace ("" for the host)
+func (f *family) save(netns string) ([]savedRule, error) {
+	out, err := command(f.bin+"-save", netns).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s rules: %w", f.bin, err)
+	}
+	return parseSave(string(out)), nil
+}
+
+// render builds the restore payload: per table, (re)declare and flush our
+// chains, hook up the jumps that are not in hooked, then list every rule
+// sorted by instance ID and tagged with it
+func (f *family) render(rules map[string][]rule, hooked map[string]bool) string {
+	ids := make([]string, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	for _, table := range f.tables {
+		fmt.Fprintf(&b, "*%s\n", table)
+		for _, h := range hooks {
+			if h.table == table {
+				fmt.Fprintf(&b, ":%s - [0:0]\n", h.chain)
+			}
+		}
+		for _, h := range hooks {
+			if h.table != table || hooked[h.chain] {
+				continue
+			}
+			jump := strings.Join(withTag([]string{"-j", h.chain}, Tag), " ")
+			if h.insert {
+				fmt.Fprintf(&b, "-I %s 1 %s\n", h.builtin, jump)
+			} else {
+				fmt.Fprintf(&b, "-A %s %s\n", h.builtin, jump)
+			}
+		}
+		for _, h := range hooks {
+			if h.table == table {
+				fmt.Fprintf(&b, "-F %s\n", h.chain)
+			}
+		}
+		for _, id := range ids {
+			for _, r := range rules[id] {
+				if r.table == table {
+					b.WriteString(r.render(id) + "\n")
+				}
+			}
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// hookedChains returns our chains that their built-in chain already jumps to
+func hookedChains(saved []savedRule) map[string]bool {
+	hooked := make(map[string]bool)
+	for _, l := range saved {
+		if l.tag != Tag {
+			continue
+		}
+		args := splitRule(l.spec)
+		for _, h := range hooks {
+			if l.table == h.table && l.chain == h.builtin && argAfter(args, "-j") == h.chain {
+				hooked[h.chain] = true
+			}
+		}
+	}
+	return hooked
+}
+
+// instanceRules returns the rules in our chains by the instance they are tagged for
+func instanceRules(saved []savedRule) map[string][]rule {
+	rules := make(map[string][]rule)
+	for _, l := range saved {
+		id, ok := strings.CutPrefix(l.tag, Tag+":")
+		if !ok || !ownChain(l.chain) {
+			continue
+		}
+		args := splitRule(l.spec)[2:] // Without "-A <chain>"
+		rules[id] = append(rules[id], rule{l.table, l.chain, withoutTag(args)})
+	}
+	return rules
+}
+
+// withoutTag removes the tag comment withTag inserted
+func withoutTag(args []string) []string {
+	for i := 0; i+3 < len(args); i++ {
+		if args[i] == "-m" && args[i+1] == "comment" && args[i+2] == "--comment" && strings.HasPrefix(args[i+3], Tag) {
+			return append(append([]string(nil), args[:i]...), args[i+4:]...)
+		}
+	}
+	return args
+}
+
+// argAfter returns the argument following flag, "" if there is none
+func argAfter(args []string, flag string) string {
+	for i, a := range args {
+		if a == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
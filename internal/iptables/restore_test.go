@@ -0,0 +1,219 @@
+package iptables
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTools puts fake iptables-save and iptables-restore (and the ip6tables
+// ones) first in PATH. The save tools print <dir>/<bin>.save; the restore
+// tools append their payload to <dir>/<bin>.restore and fail if it contains
+// the content of <dir>/fail. The families start out empty.
+func fakeTools(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	save := "#!/bin/sh\ncat \"$FAKE_IPT_DIR/$(basename \"$0\" -save).save\" 2>/dev/null\nexit 0\n"
+	restore := `#!/bin/sh
+payload=$(cat)
+printf '%s\n---\n' "$payload" >> "$FAKE_IPT_DIR/$(basename "$0" -restore).restore"
+if [ -s "$FAKE_IPT_DIR/fail" ] && printf '%s' "$payload" | grep -qF -f "$FAKE_IPT_DIR/fail"; then
+	echo "fake failure" >&2
+	exit 1
+fi
+`
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := os.WriteFile(filepath.Join(dir, bin+"-save"), []byte(save), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, bin+"-restore"), []byte(restore), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("FAKE_IPT_DIR", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	prev4, prev6 := ipv4, ipv6
+	ipv4 = &family{bin: "iptables", tables: []string{"nat", "filter"}, rules: make(map[string][]rule)}
+	ipv6 = &family{bin: "ip6tables", tables: []string{"nat"}, rules: make(map[string][]rule)}
+	t.Cleanup(func() { ipv4, ipv6 = prev4, prev6 })
+	return dir
+}
+
+// restores returns the payloads a fake restore tool received
+func restores(t *testing.T, dir, bin string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, bin+".restore"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	payloads := strings.Split(string(data), "\n---\n")
+	return payloads[:len(payloads)-1]
+}
+
+func masq(addr string) []rule {
+	return []rule{{"nat", ChainPost, []string{"-s", addr + "/32", "-j", "MASQUERADE"}}}
+}
+
+func TestRender(t *testing.T) {
+	rules := map[string][]rule{
+		"s1": {
+			{"nat", ChainPre, []string{"-p", "tcp", "--dport", "4567", "-j", "DNAT", "--to-destination", "192.168.201.2"}},
+			{"filter", ChainFwd, []string{"-i", "tun-s1", "-j", "ACCEPT"}},
+		},
+		"c1": masq("192.168.200.2"),
+	}
+	for _, tc := range []struct {
+		name   string
+		hooked map[string]bool
+		want   string
+	}{
+		{"fresh", nil, `*nat
+:PHANTUN-PRE - [0:0]
+:PHANTUN-POST - [0:0]
+-A PREROUTING -m comment --comment phantun -j PHANTUN-PRE
+-A POSTROUTING -m comment --comment phantun -j PHANTUN-POST
+-F PHANTUN-PRE
+-F PHANTUN-POST
+-A PHANTUN-POST -s 192.168.200.2/32 -m comment --comment phantun:c1 -j MASQUERADE
+-A PHANTUN-PRE -p tcp --dport 4567 -m comment --comment phantun:s1 -j DNAT --to-destination 192.168.201.2
+COMMIT
+*filter
+:PHANTUN-FWD - [0:0]
+-I FORWARD 1 -m comment --comment phantun -j PHANTUN-FWD
+-F PHANTUN-FWD
+-A PHANTUN-FWD -i tun-s1 -m comment --comment phantun:s1 -j ACCEPT
+COMMIT
+`},
+		{"hooked", map[string]bool{ChainPre: true, ChainPost: true, ChainFwd: true}, `*nat
+:PHANTUN-PRE - [0:0]
+:PHANTUN-POST - [0:0]
+-F PHANTUN-PRE
+-F PHANTUN-POST
+-A PHANTUN-POST -s 192.168.200.2/32 -m comment --comment phantun:c1 -j MASQUERADE
+-A PHANTUN-PRE -p tcp --dport 4567 -m comment --comment phantun:s1 -j DNAT --to-destination 192.168.201.2
+COMMIT
+*filter
+:PHANTUN-FWD - [0:0]
+-F PHANTUN-FWD
+-A PHANTUN-FWD -i tun-s1 -m comment --comment phantun:s1 -j ACCEPT
+COMMIT
+`},
+	} {
+		f := &family{bin: "iptables", tables: []string{"nat", "filter"}}
+		if got := f.render(rules, tc.hooked); got != tc.want {
+			t.Errorf("%s:\nwant:\n%s\ngot:\n%s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestHookedChains(t *testing.T) {
+	saved := parseSave(`*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -m comment --comment phantun -j PHANTUN-PRE
+-A POSTROUTING -j PHANTUN-POST
+COMMIT
+*filter
+-A FORWARD -m comment --comment "phantun" -j PHANTUN-FWD
+-A INPUT -m comment --comment phantun -j PHANTUN-FWD
+COMMIT
+`)
+	got := hookedChains(saved)
+	// The untagged POSTROUTING jump is from an old version and gets replaced
+	if !got[ChainPre] || got[ChainPost] || !got[ChainFwd] || len(got) != 2 {
+		t.Errorf("hooked = %v", got)
+	}
+}
+
+func TestLoadKeepsRulesOfOtherInstances(t *testing.T) {
+	dir := fakeTools(t)
+	save := `*nat
+-A POSTROUTING -m comment --comment phantun -j PHANTUN-POST
+-A PHANTUN-POST -s 192.168.200.2/32 -m comment --comment "phantun:c1" -j MASQUERADE
+-A PHANTUN-POST -s 192.168.202.2/32 -m comment --comment "phantun:c2" -j MASQUERADE
+COMMIT
+`
+	os.WriteFile(filepath.Join(dir, "iptables.save"), []byte(save), 0o644)
+
+	// After a restart, setting up c1 must not flush c2, which is not set up yet
+	if err := ipv4.set("c1", masq("192.168.200.2")); err != nil {
+		t.Fatal(err)
+	}
+	payloads := restores(t, dir, "iptables")
+	if len(payloads) != 1 || !strings.Contains(payloads[0], "-s 192.168.202.2/32 -m comment --comment phantun:c2 -j MASQUERADE") {
+		t.Fatalf("rules of c2 dropped: %q", payloads)
+	}
+	if strings.Count(payloads[0], "phantun:c1") != 1 {
+		t.Errorf("c1 must appear once:\n%s", payloads[0])
+	}
+	if strings.Contains(payloads[0], "-A POSTROUTING") {
+		t.Errorf("existing jump added again:\n%s", payloads[0])
+	}
+}
+
+func TestSetRollsBack(t *testing.T) {
+	dir := fakeTools(t)
+	if err := ipv4.set("c1", masq("192.168.200.2")); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "fail"), []byte("192.168.202.2"), 0o644)
+	if err := ipv4.set("c2", masq("192.168.202.2")); err == nil {
+		t.Fatal("want the failing transaction reported")
+	}
+
+	payloads := restores(t, dir, "iptables")
+	if len(payloads) != 3 {
+		t.Fatalf("want apply, failed apply and rollback, got %d payloads", len(payloads))
+	}
+	if last := payloads[2]; !strings.Contains(last, "phantun:c1") || strings.Contains(last, "phantun:c2") {
+		t.Errorf("rollback must restore the previous ruleset:\n%s", last)
+	}
+	if _, ok := ipv4.rules["c2"]; ok {
+		t.Error("failed rules kept in the registry")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := fakeTools(t)
+	ipv4.loaded, ipv6.loaded = true, true
+
+	Begin()
+	for _, addr := range []string{"192.168.200.2", "192.168.202.2", "192.168.204.2"} {
+		if err := ipv4.set("c-"+addr, masq(addr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(restores(t, dir, "iptables")); n != 0 {
+		t.Fatalf("batched rules applied early: %d transactions", n)
+	}
+	if failed := Commit(); len(failed) != 0 {
+		t.Fatalf("failed = %v", failed)
+	}
+	if n := len(restores(t, dir, "iptables")); n != 1 {
+		t.Errorf("want one transaction, got %d", n)
+	}
+	if n := len(restores(t, dir, "ip6tables")); n != 0 {
+		t.Errorf("unchanged family applied: %d transactions", n)
+	}
+
+	// A failing batch is rolled back entirely, and every changed instance fails
+	os.WriteFile(filepath.Join(dir, "fail"), []byte("192.168.208.2"), 0o644)
+	Begin()
+	ipv4.set("good", masq("192.168.206.2"))
+	ipv4.set("bad", masq("192.168.208.2"))
+	failed := Commit()
+	if len(failed) != 2 || failed["good"] == nil || failed["bad"] == nil {
+		t.Errorf("want both changed instances failed, got %v", failed)
+	}
+	if _, ok := ipv4.rules["good"]; ok {
+		t.Error("rules of the failed batch kept")
+	}
+	payloads := restores(t, dir, "iptables")
+	if len(payloads) != 3 {
+		t.Fatalf("want commit, failed commit and rollback, got %d transactions", len(payloads))
+	}
+	if last := payloads[2]; strings.Contains(last, "192.168.206.2") || !strings.Contains(last, "192.168.204.2") {
+		t.Errorf("rollback must restore the ruleset before Begin:\n%s", last)
+	}
+}
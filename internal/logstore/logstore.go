@@ -0,0 +1,422 @@
+package logstore
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options controls rotation and retention. Zero values disable that limit.
+type Options struct {
+	MaxFileBytes   int64         // Rotate the active file once it grows past this size
+	RotateInterval time.Duration // Rotate the active file once it is this old
+	Retention      time.Duration // Delete rotated files older than this
+	MaxTotalBytes  int64         // Delete the oldest rotated files while the directory exceeds this
+	Compress       bool          // Gzip rotated files
+}
+
+// Store keeps one append-only log file per stream name (instance ID or
+// "system") in a directory. Rotated files are named <name>-<timestamp>.log[.gz].
+type Store struct {
+	dir string
+
+	mu    sync.Mutex
+	opts  Options
+	files map[string]*activeFile
+}
+
+type activeFile struct {
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// FileInfo describes a log file on disk
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"-"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Active  bool      `json:"active"` // Currently written to
+}
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Open creates the directory if needed and applies retention to existing files
+func Open(dir string, opts Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	s := &Store{
+		dir:   dir,
+		opts:  opts,
+		files: make(map[string]*activeFile),
+	}
+	s.mu.Lock()
+	s.enforceRetention()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// Dir returns the directory the store writes to
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// SetOptions changes rotation and retention limits at runtime
+func (s *Store) SetOptions(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+	s.enforceRetention()
+}
+
+// Append writes one record (a line, newline added if missing) to the named
+// stream. A rotated file is compressed after the store is unlocked, so other
+// writers are not held up.
+func (s *Store) Append(name string, record []byte) error {
+	rotated, err := s.append(SafeName(name), record)
+	if rotated != "" {
+		s.finishRotation(rotated)
+	}
+	return err
+}
+
+// append writes the record and returns the path of the file it rotated, if any
+func (s *Store) append(name string, record []byte) (rotated string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	af, err := s.active(name)
+	if err != nil {
+		return "", err
+	}
+
+	if s.needsRotation(af, int64(len(record)+1)) {
+		if rotated, err = s.rotate(name, af); err != nil {
+			return "", err
+		}
+		if af, err = s.active(name); err != nil {
+			return rotated, err
+		}
+	}
+
+	if len(record) == 0 || record[len(record)-1] != '\n' {
+		record = append(record, '\n')
+	}
+	n, err := af.f.Write(record)
+	af.size += int64(n)
+	return rotated, err
+}
+
+// Files lists the files of a stream, oldest first, the active file last
+func (s *Store) Files(name string) ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	name = SafeName(name)
+	var files []FileInfo
+	for _, fi := range all {
+		if streamOf(fi.Name) == name {
+			files = append(files, fi)
+		}
+	}
+	return files, nil
+}
+
+// Streams returns the names of all streams that have files on disk
+func (s *Store) Streams() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, fi := range all {
+		if n := streamOf(fi.Name); !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// OpenFile opens a log file for reading, transparently decompressing .gz files
+func OpenFile(fi FileInfo) (io.ReadCloser, error) {
+	f, err := os.Open(fi.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(fi.Name, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// Close closes all active files
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for name, af := range s.files {
+		if err := af.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, name)
+	}
+	return firstErr
+}
+
+// SafeName maps a stream name to something usable as a file name
+func SafeName(name string) string {
+	name = unsafeName.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// active returns the open file of a stream, opening or creating it. Caller must hold s.mu.
+func (s *Store) active(name string) (*activeFile, error) {
+	if af, ok := s.files[name]; ok {
+		return af, nil
+	}
+	path := filepath.Join(s.dir, name+".log")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	af := &activeFile{f: f, size: st.Size(), opened: time.Now()}
+	if st.Size() > 0 {
+		// Best guess for a file left over from a previous run
+		af.opened = st.ModTime()
+	}
+	s.files[name] = af
+	return af, nil
+}
+
+func (s *Store) needsRotation(af *activeFile, incoming int64) bool {
+	if af.size == 0 {
+		return false
+	}
+	if s.opts.MaxFileBytes > 0 && af.size+incoming > s.opts.MaxFileBytes {
+		return true
+	}
+	if s.opts.RotateInterval > 0 && time.Since(af.opened) >= s.opts.RotateInterval {
+		return true
+	}
+	return false
+}
+
+// rotate renames the active file out of the way and returns its new path.
+// Caller must hold s.mu.
+func (s *Store) rotate(name string, af *activeFile) (string, error) {
+	af.f.Close()
+	delete(s.files, name)
+
+	src := filepath.Join(s.dir, name+".log")
+	dst := filepath.Join(s.dir, fmt.Sprintf("%s-%s.log", name, time.Now().UTC().Format(rotatedTimeFormat)))
+	if err := os.Rename(src, dst); err != nil {
+		return "", fmt.Errorf("failed to rotate %s: %w", src, err)
+	}
+	return dst, nil
+}
+
+// finishRotation compresses a rotated file if configured, without holding
+// s.mu, then applies retention
+func (s *Store) finishRotation(path string) {
+	s.mu.Lock()
+	compress := s.opts.Compress
+	s.mu.Unlock()
+	if compress {
+		if err := compressFile(path); err != nil {
+			warnf("Failed to compress rotated log %s: %v", path, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enforceRetention()
+}
+
+// enforceRetention deletes rotated files past the retention age, then the
+// oldest rotated files until the total size fits. Active files are never
+// deleted. Caller must hold s.mu.
+func (s *Store) enforceRetention() {
+	all, err := s.list()
+	if err != nil {
+		warnf("Failed to list log directory: %v", err)
+		return
+	}
+
+	var total int64
+	var rotated []FileInfo
+	for _, fi := range all {
+		if !fi.Active && s.opts.Retention > 0 && time.Since(fi.ModTime) > s.opts.Retention {
+			os.Remove(fi.Path)
+			continue
+		}
+		total += fi.Size
+		if !fi.Active {
+			rotated = append(rotated, fi)
+		}
+	}
+
+	if s.opts.MaxTotalBytes <= 0 {
+		return
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].ModTime.Before(rotated[j].ModTime) })
+	for _, fi := range rotated {
+		if total <= s.opts.MaxTotalBytes {
+			break
+		}
+		if err := os.Remove(fi.Path); err == nil {
+			total -= fi.Size
+		}
+	}
+}
+
+// list returns all log files, grouped by stream and oldest first. Caller must hold s.mu.
+func (s *Store) list() ([]FileInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		present[e.Name()] = true
+	}
+	var files []FileInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz")) {
+			continue
+		}
+		// Compressed, the original is about to be removed
+		if present[name+".gz"] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, FileInfo{
+			Name:    name,
+			Path:    filepath.Join(s.dir, name),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Active:  isActiveName(name),
+		})
+	}
+	// Rotated names sort by timestamp; the active file goes last within its stream
+	sort.Slice(files, func(i, j int) bool {
+		si, sj := streamOf(files[i].Name), streamOf(files[j].Name)
+		if si != sj {
+			return si < sj
+		}
+		if files[i].Active != files[j].Active {
+			return !files[i].Active
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// streamOf extracts the stream name from a file name
+func streamOf(file string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(file, ".gz"), ".log")
+	if i := strings.LastIndex(base, "-"); i >= 0 && isRotatedSuffix(base[i+1:]) {
+		return base[:i]
+	}
+	return base
+}
+
+func isActiveName(file string) bool {
+	return strings.HasSuffix(file, ".log") && streamOf(file)+".log" == file
+}
+
+func isRotatedSuffix(s string) bool {
+	_, err := time.Parse(rotatedTimeFormat, s)
+	return err == nil
+}
+
+// compressFile gzips a rotated file. The archive is written under a temporary
+// name and renamed into place, so readers never see a partial one.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		zw.Close()
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			// Retention deleted the original meanwhile
+			os.Remove(path + ".gz")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// warnf reports problems straight to stderr. The store sits underneath the
+// log package output, so using log here would recurse into it.
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Warning: logstore: "+format+"\n", args...)
+}
@@ -0,0 +1,150 @@
+package logstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T, opts Options) *Store {
+	t.Helper()
+	s, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendN(t *testing.T, s *Store, name string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := s.Append(name, []byte(fmt.Sprintf("record %02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readAll concatenates the content of every file of a stream, oldest first
+func readAll(t *testing.T, s *Store, name string) string {
+	t.Helper()
+	files, err := s.Files(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, fi := range files {
+		rc, err := OpenFile(fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", fi.Name, err)
+		}
+		b.Write(data)
+	}
+	return b.String()
+}
+
+func TestRotationBySize(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			// Each record is 10 bytes, so a 25 byte limit holds two per file
+			s := openStore(t, Options{MaxFileBytes: 25, Compress: compress})
+			appendN(t, s, "c1", 5)
+
+			files, err := s.Files("c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 3 || !files[2].Active || files[0].Active {
+				t.Fatalf("want two rotated files and the active one last, got %+v", files)
+			}
+			for _, fi := range files[:2] {
+				if strings.HasSuffix(fi.Name, ".gz") != compress {
+					t.Errorf("%s: compressed must be %v", fi.Name, compress)
+				}
+			}
+			var want strings.Builder
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(&want, "record %02d\n", i)
+			}
+			if got := readAll(t, s, "c1"); got != want.String() {
+				t.Errorf("records out of order or lost:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestRotationByAge(t *testing.T) {
+	s := openStore(t, Options{RotateInterval: 20 * time.Millisecond})
+	appendN(t, s, "c1", 2)
+	time.Sleep(30 * time.Millisecond)
+	appendN(t, s, "c1", 1)
+
+	files, _ := s.Files("c1")
+	if len(files) != 2 {
+		t.Fatalf("want the old file rotated, got %+v", files)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	s := openStore(t, Options{MaxFileBytes: 15})
+	appendN(t, s, "c1", 4) // Three rotated files of 10 bytes plus the active one
+
+	files, _ := s.Files("c1")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(files[0].Path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// By age: only the old rotated file goes
+	s.SetOptions(Options{MaxFileBytes: 15, Retention: time.Hour})
+	if files, _ = s.Files("c1"); len(files) != 3 {
+		t.Fatalf("want the expired file deleted, got %+v", files)
+	}
+
+	// By total size: the oldest rotated files go first, the active one never
+	s.SetOptions(Options{MaxFileBytes: 15, MaxTotalBytes: 1})
+	files, _ = s.Files("c1")
+	if len(files) != 1 || !files[0].Active {
+		t.Fatalf("want only the active file left, got %+v", files)
+	}
+	if got := readAll(t, s, "c1"); got != "record 03\n" {
+		t.Errorf("want the newest record kept, got %q", got)
+	}
+}
+
+func TestTotalCapKeepsNewest(t *testing.T) {
+	s := openStore(t, Options{MaxFileBytes: 15, MaxTotalBytes: 25})
+	appendN(t, s, "c1", 6)
+
+	// 10 bytes active + one rotated file of 10 bytes fit, a second does not
+	if got := readAll(t, s, "c1"); got != "record 04\nrecord 05\n" {
+		t.Errorf("want the two newest records, got %q", got)
+	}
+}
+
+func TestStreamsAndNames(t *testing.T) {
+	s := openStore(t, Options{MaxFileBytes: 15})
+	appendN(t, s, "a/b", 2)
+	appendN(t, s, "system", 1)
+
+	streams, err := s.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(streams) != "[a_b system]" {
+		t.Errorf("want sanitized stream names, got %v", streams)
+	}
+	for in, want := range map[string]string{"": "_", "..": "_", "c1": "c1", "a b": "a_b"} {
+		if got := SafeName(in); got != want {
+			t.Errorf("SafeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
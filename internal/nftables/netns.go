@@ -0,0 +1,54 @@
+package nftables
+
+import (
+	"strconv"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+// In namespace mode the usual client/server rules live in a phantun table
+// inside the instance's namespace and vanish with it. The host only NATs the
+// namespace's veth subnet and, for servers, forwards the listening port into
+// the namespace.
+
+// SetupClientNetns installs the client rules inside the namespace plus the host side
+func SetupClientNetns(n system.Netns, c config.ClientConfig) error {
+	if err := setupClient(n.Name, c); err != nil {
+		return err
+	}
+	return ensureRules("", c.ID, netnsHostRules(n))
+}
+
+// CleanupClientNetns removes the host side rules of a client namespace
+func CleanupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return deleteRules("", c.ID, netnsHostRules(n))
+}
+
+// SetupServerNetns installs the server rules inside the namespace plus the
+// host side, including the DNAT of the listening port into the namespace
+func SetupServerNetns(n system.Netns, s config.ServerConfig) error {
+	if err := setupServer(n.Name, s); err != nil {
+		return err
+	}
+	return ensureRules("", s.ID, append(netnsHostRules(n), netnsDNAT(n, s)))
+}
+
+// CleanupServerNetns removes the host side rules of a server namespace
+func CleanupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return deleteRules("", s.ID, append(netnsHostRules(n), netnsDNAT(n, s)))
+}
+
+func netnsHostRules(n system.Netns) []rule {
+	veth := strconv.Quote(n.HostVeth)
+	return []rule{
+		{"postrouting", "netns masq " + n.Subnet(), "ip saddr " + n.Subnet() + " oifname != " + veth + " masquerade"},
+		{"forward", "fwd in " + n.HostVeth, "iifname " + veth + " accept"},
+		{"forward", "fwd out " + n.HostVeth, "oifname " + veth + " accept"},
+	}
+}
+
+func netnsDNAT(n system.Netns, s config.ServerConfig) rule {
+	return rule{"prerouting", "dnat tcp/" + s.LocalPort + " " + n.NsAddr,
+		"meta nfproto ipv4 tcp dport " + s.LocalPort + " dnat ip to " + n.NsAddr}
+}
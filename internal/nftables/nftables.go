@@ -0,0 +1,426 @@
+// Package nftables manages the phantun NAT rules natively with nft, in a
+// dedicated "inet phantun" table that the manager owns completely
+package nftables
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	family = "inet"
+	table  = "phantun"
+	marker = "phantun" // Comment prefix of every rule, followed by ":<instance id> <rule key>"
+)
+
+// Base chains of the table. Unlike iptables' FORWARD, an accept here does not
+// override a drop in another table's forward hook (e.g. iptables-nft rules).
+const tableScript = `add table inet phantun
+add chain inet phantun prerouting { type nat hook prerouting priority -100; policy accept; }
+add chain inet phantun postrouting { type nat hook postrouting priority 100; policy accept; }
+add chain inet phantun forward { type filter hook forward priority 0; policy accept; }
+`
+
+// rule is one nft rule, identified by its chain and key so that it can be
+// found again by its comment
+type rule struct {
+	chain string
+	key   string
+	expr  string
+}
+
+// comment tags the rule with the instance that owns it
+func (r rule) comment(id string) string {
+	return fmt.Sprintf("%q", ownerTag(id)+" "+r.key)
+}
+
+// add is the nft command that adds the rule for instance id
+func (r rule) add(id string) string {
+	return fmt.Sprintf("add rule %s %s %s %s comment %s", family, table, r.chain, r.expr, r.comment(id))
+}
+
+func ownerTag(id string) string {
+	return marker + ":" + id
+}
+
+// Available reports whether nft is installed and can read the ruleset
+func Available() bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+	_, err := run("", "list", "tables")
+	return err == nil
+}
+
+// SetupClient applies nftables rules for Client mode
+func SetupClient(c config.ClientConfig) error {
+	return setupClient("", c)
+}
+
+// setupClient installs the client rules in the given network namespace ("" for the host)
+func setupClient(netns string, c config.ClientConfig) error {
+	// SAFETY CHECK: Prevent high-jacking SSH
+	if c.LocalPort == "22" {
+		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot use port 22 for LocalPort. This would lock you out of the server!")
+	}
+	return ensureRules(netns, c.ID, clientRules(c))
+}
+
+// CleanupClient removes nftables rules for Client mode
+func CleanupClient(c config.ClientConfig) error {
+	return deleteRules("", c.ID, clientRules(c))
+}
+
+// SetupClientIPv6 applies nftables rules for Client mode (IPv6)
+func SetupClientIPv6(c config.ClientConfig) error {
+	return ensureRules("", c.ID, clientRulesIPv6(c))
+}
+
+// CleanupClientIPv6 removes nftables rules for Client mode (IPv6)
+func CleanupClientIPv6(c config.ClientConfig) error {
+	return deleteRules("", c.ID, clientRulesIPv6(c))
+}
+
+// SetupServer applies nftables rules for Server mode
+func SetupServer(s config.ServerConfig) error {
+	return setupServer("", s)
+}
+
+// setupServer installs the server rules in the given network namespace ("" for the host)
+func setupServer(netns string, s config.ServerConfig) error {
+	// SAFETY CHECK: Prevent high-jacking SSH
+	if s.LocalPort == "22" {
+		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot use port 22 for LocalPort. This would lock you out of the server!")
+	}
+	return ensureRules(netns, s.ID, serverRules(s))
+}
+
+// CleanupServer removes nftables rules for Server mode
+func CleanupServer(s config.ServerConfig) error {
+	return deleteRules("", s.ID, serverRules(s))
+}
+
+// SetupServerIPv6 applies nftables rules for Server mode (IPv6)
+func SetupServerIPv6(s config.ServerConfig) error {
+	return ensureRules("", s.ID, serverRulesIPv6(s))
+}
+
+// CleanupServerIPv6 removes nftables rules for Server mode (IPv6)
+func CleanupServerIPv6(s config.ServerConfig) error {
+	return deleteRules("", s.ID, serverRulesIPv6(s))
+}
+
+func clientRules(c config.ClientConfig) []rule {
+	return []rule{
+		{"postrouting", "masq " + c.TunPeer, "ip saddr " + c.TunPeer + " masquerade"},
+	}
+}
+
+func clientRulesIPv6(c config.ClientConfig) []rule {
+	return []rule{
+		{"postrouting", "masq " + c.TunPeerIPv6, "ip6 saddr " + c.TunPeerIPv6 + " masquerade"},
+	}
+}
+
+func serverRules(s config.ServerConfig) []rule {
+	return []rule{
+		// DNAT: TCP dport {local_port} -> {tun_peer}
+		{"prerouting", "dnat tcp/" + s.LocalPort + " " + s.TunPeer,
+			"meta nfproto ipv4 tcp dport " + s.LocalPort + " dnat ip to " + s.TunPeer},
+		// MASQUERADE: TCP dst {tun_peer} dport {remote_port}
+		{"postrouting", "masq " + s.TunPeer + " tcp/" + s.RemotePort,
+			"ip daddr " + s.TunPeer + " tcp dport " + s.RemotePort + " masquerade"},
+		// FORWARD: Allow traffic to/from TUN interface
+		{"forward", "fwd in " + s.TunName, "iifname " + strconv.Quote(s.TunName) + " accept"},
+		{"forward", "fwd out " + s.TunName, "oifname " + strconv.Quote(s.TunName) + " accept"},
+	}
+}
+
+func serverRulesIPv6(s config.ServerConfig) []rule {
+	return []rule{
+		{"prerouting", "dnat tcp/" + s.LocalPort + " " + s.TunPeerIPv6,
+			"meta nfproto ipv6 tcp dport " + s.LocalPort + " dnat ip6 to " + s.TunPeerIPv6},
+		{"postrouting", "masq " + s.TunPeerIPv6 + " tcp/" + s.RemotePort,
+			"ip6 daddr " + s.TunPeerIPv6 + " tcp dport " + s.RemotePort + " masquerade"},
+	}
+}
+
+// ensureRules creates the table if needed and adds the rules of instance id
+// that are not there yet, in one nft transaction
+func ensureRules(netns, id string, rules []rule) error {
+	var script strings.Builder
+	script.WriteString(tableScript)
+	for _, r := range rules {
+		handles, err := findRule(netns, id, r)
+		if err != nil {
+			return err
+		}
+		if len(handles) > 0 {
+			continue
+		}
+		script.WriteString(r.add(id) + "\n")
+	}
+	return runScript(netns, script.String())
+}
+
+// deleteRules removes the rules of instance id by handle. Missing rules (or
+// a missing table) are not an error.
+func deleteRules(netns, id string, rules []rule) error {
+	var script strings.Builder
+	for _, r := range rules {
+		handles, err := findRule(netns, id, r)
+		if err != nil {
+			return err
+		}
+		for _, h := range handles {
+			fmt.Fprintf(&script, "delete rule %s %s %s handle %d\n", family, table, r.chain, h)
+		}
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	return runScript(netns, script.String())
+}
+
+var handleRe = regexp.MustCompile(`# handle (\d+)$`)
+
+// findRule returns the handles of the rules in r's chain carrying r's comment
+// for instance id
+func findRule(netns, id string, r rule) ([]int, error) {
+	out, err := run(netns, "-a", "list", "chain", family, table, r.chain)
+	if err != nil {
+		if isMissing(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return handlesOf(out, id, r), nil
+}
+
+// handlesOf returns the handles of the rules in an nft -a listing that carry
+// r's comment for instance id
+func handlesOf(out, id string, r rule) []int {
+	var handles []int
+	want := "comment " + r.comment(id)
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, want) {
+			continue
+		}
+		if m := handleRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			h, _ := strconv.Atoi(m[1])
+			handles = append(handles, h)
+		}
+	}
+	return handles
+}
+
+// GetRules returns the phantun table as listed by nft, empty if it does not exist
+func GetRules() (string, error) {
+	out, err := run("", "list", "table", family, table)
+	if err != nil && isMissing(err) {
+		return "", nil
+	}
+	return out, err
+}
+
+// CleanupAll removes ALL rules created by Phantun by deleting the phantun table,
+// logging how many rules it held
+func CleanupAll() error {
+	rules, err := GetRules()
+	if err != nil {
+		return err
+	}
+	if rules == "" {
+		log.Printf("Firewall cleanup removed 0 tagged rules")
+		return nil
+	}
+	if _, err := run("", "delete", "table", family, table); err != nil && !isMissing(err) {
+		return err
+	}
+	log.Printf("Firewall cleanup removed table %s %s with %d tagged rules", family, table, strings.Count(rules, `comment "`+marker))
+	return nil
+}
+
+// listedRule is one rule of the phantun table as listed by nft -a
+type listedRule struct {
+	chain   string
+	handle  int
+	comment string // Without quotes, "" if the rule has none
+	expr    string
+}
+
+var commentRe = regexp.MustCompile(` comment "([^"]*)"`)
+
+// listRules parses the phantun table, empty if it does not exist
+func listRules(netns string) ([]listedRule, error) {
+	out, err := run(netns, "-a", "list", "table", family, table)
+	if err != nil {
+		if isMissing(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseTable(out), nil
+}
+
+// parseTable parses an nft -a listing of the phantun table
+func parseTable(out string) []listedRule {
+	var rules []listedRule
+	chain := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "chain ") {
+			chain = strings.Fields(line)[1]
+			continue
+		}
+		m := handleRe.FindStringSubmatch(line)
+		if m == nil || chain == "" {
+			continue
+		}
+		h, _ := strconv.Atoi(m[1])
+		r := listedRule{chain: chain, handle: h}
+		r.expr = strings.TrimSpace(strings.TrimSuffix(line, m[0]))
+		if c := commentRe.FindStringSubmatchIndex(r.expr); c != nil {
+			r.comment = r.expr[c[2]:c[3]]
+			r.expr = r.expr[:c[0]]
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// tag returns the ownership tag of the rule, "" if it has none
+func (r listedRule) tag() string {
+	tag, _, _ := strings.Cut(r.comment, " ")
+	if tag != marker && !strings.HasPrefix(tag, marker+":") {
+		return ""
+	}
+	return tag
+}
+
+// ListRules returns every rule of the phantun table
+func ListRules() ([]system.FirewallRule, error) {
+	listed, err := listRules("")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]system.FirewallRule, 0, len(listed))
+	for _, r := range listed {
+		tag := r.tag()
+		owner, ok := strings.CutPrefix(tag, marker+":")
+		if !ok {
+			owner = ""
+		}
+		spec := r.expr
+		if r.comment != "" {
+			spec += " comment " + strconv.Quote(r.comment)
+		}
+		rules = append(rules, system.FirewallRule{
+			Family: family, Table: table, Chain: r.chain, Tag: tag, Owner: owner, Spec: spec,
+		})
+	}
+	return rules, nil
+}
+
+// CleanupInstance removes exactly the host rules tagged for one instance,
+// whatever config they were created with
+func CleanupInstance(id string) error {
+	listed, err := listRules("")
+	if err != nil {
+		return err
+	}
+	var script strings.Builder
+	n := 0
+	for _, r := range listed {
+		if r.tag() == ownerTag(id) {
+			fmt.Fprintf(&script, "delete rule %s %s %s handle %d\n", family, table, r.chain, r.handle)
+			n++
+		}
+	}
+	if n > 0 {
+		if err := runScript("", script.String()); err != nil {
+			return err
+		}
+	}
+	log.Printf("Firewall cleanup of instance %s removed %d rules", id, n)
+	return nil
+}
+
+// GetStats returns a map of rule counts
+func GetStats() (map[string]int, error) {
+	rules, err := GetRules()
+	if err != nil {
+		return nil, err
+	}
+	masq, dnat := 0, 0
+	for _, line := range strings.Split(rules, "\n") {
+		// Only look at the statement, the comment repeats the key
+		expr, _, ok := strings.Cut(line, ` comment "`+marker)
+		if !ok {
+			continue
+		}
+		if strings.Contains(expr, " masquerade") {
+			masq++
+		}
+		if strings.Contains(expr, " dnat ") {
+			dnat++
+		}
+	}
+	return map[string]int{
+		"masquerade": masq,
+		"dnat":       dnat,
+		"total":      masq + dnat,
+	}, nil
+}
+
+// nftError carries the output of a failed nft call
+type nftError struct {
+	args []string
+	out  string
+	err  error
+}
+
+func (e *nftError) Error() string {
+	return fmt.Sprintf("nft %s failed: %v: %s", strings.Join(e.args, " "), e.err, strings.TrimSpace(e.out))
+}
+
+func (e *nftError) Unwrap() error { return e.err }
+
+// isMissing reports whether nft failed because the table or chain does not exist
+func isMissing(err error) bool {
+	e, ok := err.(*nftError)
+	return ok && strings.Contains(e.out, "No such file or directory")
+}
+
+// command builds an nft call inside a network namespace ("" for the host)
+func command(netns string, args ...string) *exec.Cmd {
+	if netns != "" {
+		return exec.Command("ip", append([]string{"netns", "exec", netns, "nft"}, args...)...)
+	}
+	return exec.Command("nft", args...)
+}
+
+func run(netns string, args ...string) (string, error) {
+	out, err := command(netns, args...).CombinedOutput()
+	if err != nil {
+		return string(out), &nftError{args: args, out: string(out), err: err}
+	}
+	return string(out), nil
+}
+
+// runScript applies a batch of commands atomically via nft -f -
+func runScript(netns, script string) error {
+	cmd := command(netns, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return &nftError{args: []string{"-f", "-"}, out: string(out) + "\n" + script, err: err}
+	}
+	return nil
+}
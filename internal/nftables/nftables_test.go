@@ -0,0 +1,198 @@
+package nftables
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+// listing is nft -a list table inet phantun with rules of two instances, one
+// rule added by hand and one tagged like ours but not by us
+const listing = `table inet phantun { # handle 12
+	chain prerouting { # handle 1
+		type nat hook prerouting priority dstnat; policy accept;
+		meta nfproto ipv4 tcp dport 4567 dnat ip to 192.168.201.2 comment "phantun:s1 dnat tcp/4567 192.168.201.2" # handle 5
+	}
+	chain postrouting { # handle 2
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 192.168.200.2 masquerade comment "phantun:c1 masq 192.168.200.2" # handle 6
+		ip saddr 192.168.200.20 masquerade comment "phantun:c10 masq 192.168.200.20" # handle 9
+		ip saddr 10.0.0.0/8 masquerade # handle 7
+		ip saddr 10.1.0.0/16 masquerade comment "phantunx" # handle 10
+	}
+	chain forward { # handle 3
+		type filter hook forward priority filter; policy accept;
+		iifname "tun1" accept comment "phantun:s1 fwd in tun1" # handle 8
+	}
+}
+`
+
+func TestRuleSets(t *testing.T) {
+	client := config.ClientConfig{ID: "c1", TunPeer: "192.168.200.2", TunPeerIPv6: "fcc8::2"}
+	server := config.ServerConfig{
+		ID: "s1", LocalPort: "4567", RemotePort: "51820", TunName: "tun1",
+		TunPeer: "192.168.201.2", TunPeerIPv6: "fcc9::2",
+	}
+	ns := system.Netns{Name: "phantun-s1", HostVeth: "phv0", HostAddr: "10.231.0.1", NsAddr: "10.231.0.2", PrefixLen: 30}
+
+	for _, tc := range []struct {
+		name  string
+		id    string
+		rules []rule
+		want  []string
+	}{
+		{"client", "c1", clientRules(client), []string{
+			`add rule inet phantun postrouting ip saddr 192.168.200.2 masquerade comment "phantun:c1 masq 192.168.200.2"`,
+		}},
+		{"client ipv6", "c1", clientRulesIPv6(client), []string{
+			`add rule inet phantun postrouting ip6 saddr fcc8::2 masquerade comment "phantun:c1 masq fcc8::2"`,
+		}},
+		{"server", "s1", serverRules(server), []string{
+			`add rule inet phantun prerouting meta nfproto ipv4 tcp dport 4567 dnat ip to 192.168.201.2 comment "phantun:s1 dnat tcp/4567 192.168.201.2"`,
+			`add rule inet phantun postrouting ip daddr 192.168.201.2 tcp dport 51820 masquerade comment "phantun:s1 masq 192.168.201.2 tcp/51820"`,
+			`add rule inet phantun forward iifname "tun1" accept comment "phantun:s1 fwd in tun1"`,
+			`add rule inet phantun forward oifname "tun1" accept comment "phantun:s1 fwd out tun1"`,
+		}},
+		{"server ipv6", "s1", serverRulesIPv6(server), []string{
+			`add rule inet phantun prerouting meta nfproto ipv6 tcp dport 4567 dnat ip6 to fcc9::2 comment "phantun:s1 dnat tcp/4567 fcc9::2"`,
+			`add rule inet phantun postrouting ip6 daddr fcc9::2 tcp dport 51820 masquerade comment "phantun:s1 masq fcc9::2 tcp/51820"`,
+		}},
+		{"netns host side", "s1", append(netnsHostRules(ns), netnsDNAT(ns, server)), []string{
+			`add rule inet phantun postrouting ip saddr 10.231.0.0/30 oifname != "phv0" masquerade comment "phantun:s1 netns masq 10.231.0.0/30"`,
+			`add rule inet phantun forward iifname "phv0" accept comment "phantun:s1 fwd in phv0"`,
+			`add rule inet phantun forward oifname "phv0" accept comment "phantun:s1 fwd out phv0"`,
+			`add rule inet phantun prerouting meta nfproto ipv4 tcp dport 4567 dnat ip to 10.231.0.2 comment "phantun:s1 dnat tcp/4567 10.231.0.2"`,
+		}},
+	} {
+		var got []string
+		for _, r := range tc.rules {
+			got = append(got, r.add(tc.id))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\nwant %s\ngot  %s", tc.name, strings.Join(tc.want, "\n     "), strings.Join(got, "\n     "))
+		}
+	}
+}
+
+func TestParseTable(t *testing.T) {
+	want := []listedRule{
+		{"prerouting", 5, "phantun:s1 dnat tcp/4567 192.168.201.2", "meta nfproto ipv4 tcp dport 4567 dnat ip to 192.168.201.2"},
+		{"postrouting", 6, "phantun:c1 masq 192.168.200.2", "ip saddr 192.168.200.2 masquerade"},
+		{"postrouting", 9, "phantun:c10 masq 192.168.200.20", "ip saddr 192.168.200.20 masquerade"},
+		{"postrouting", 7, "", "ip saddr 10.0.0.0/8 masquerade"},
+		{"postrouting", 10, "phantunx", "ip saddr 10.1.0.0/16 masquerade"},
+		{"forward", 8, "phantun:s1 fwd in tun1", `iifname "tun1" accept`},
+	}
+	if got := parseTable(listing); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v\ngot  %+v", want, got)
+	}
+	if got := parseTable(""); got != nil {
+		t.Errorf("empty listing: got %+v", got)
+	}
+}
+
+// ensureRules and deleteRules find rules again by the comment with their key
+func TestHandlesOf(t *testing.T) {
+	server := config.ServerConfig{ID: "s1", LocalPort: "4567", TunName: "tun1", TunPeer: "192.168.201.2"}
+	for _, tc := range []struct {
+		name string
+		id   string
+		r    rule
+		want []int
+	}{
+		{"client", "c1", clientRules(config.ClientConfig{TunPeer: "192.168.200.2"})[0], []int{6}},
+		{"longer ID with the same prefix", "c10", clientRules(config.ClientConfig{TunPeer: "192.168.200.20"})[0], []int{9}},
+		{"other owner", "c2", clientRules(config.ClientConfig{TunPeer: "192.168.200.2"})[0], nil},
+		{"server dnat", "s1", serverRules(server)[0], []int{5}},
+		{"server forward", "s1", serverRules(server)[2], []int{8}},
+		{"missing", "s1", serverRules(server)[3], nil},
+	} {
+		if got := handlesOf(listing, tc.id, tc.r); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+// fakeNft puts a fake nft first in PATH that lists <dir>/table as the
+// phantun table, appends scripts to <dir>/script and accepts anything else
+func fakeNft(t *testing.T, table string) string {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+case "$*" in
+"-a list table inet phantun")
+	if [ ! -f "$FAKE_NFT_DIR/table" ]; then
+		echo "Error: No such file or directory" >&2
+		exit 1
+	fi
+	cat "$FAKE_NFT_DIR/table" ;;
+"-f -") cat >> "$FAKE_NFT_DIR/script" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "nft"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if table != "" {
+		if err := os.WriteFile(filepath.Join(dir, "table"), []byte(table), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("FAKE_NFT_DIR", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestListRulesOwnership(t *testing.T) {
+	fakeNft(t, listing)
+	rules, err := ListRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.Chain+" "+r.Tag+" "+r.Owner)
+	}
+	want := []string{
+		"prerouting phantun:s1 s1",
+		"postrouting phantun:c1 c1",
+		"postrouting phantun:c10 c10",
+		"postrouting  ", // Added by hand
+		"postrouting  ", // phantunx is not our tag
+		"forward phantun:s1 s1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q\ngot  %q", want, got)
+	}
+	if spec := rules[1].Spec; spec != `ip saddr 192.168.200.2 masquerade comment "phantun:c1 masq 192.168.200.2"` {
+		t.Errorf("spec = %s", spec)
+	}
+
+	fakeNft(t, "")
+	if rules, err := ListRules(); err != nil || len(rules) != 0 {
+		t.Errorf("missing table: want no rules, got %v, %v", rules, err)
+	}
+}
+
+func TestCleanupInstance(t *testing.T) {
+	for _, tc := range []struct {
+		id, want string
+	}{
+		{"c1", "delete rule inet phantun postrouting handle 6\n"},
+		{"s1", "delete rule inet phantun prerouting handle 5\ndelete rule inet phantun forward handle 8\n"},
+		{"gone", ""},
+	} {
+		dir := fakeNft(t, listing)
+		if err := CleanupInstance(tc.id); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(filepath.Join(dir, "script"))
+		if string(got) != tc.want {
+			t.Errorf("%s: want script %q, got %q", tc.id, tc.want, got)
+		}
+	}
+}
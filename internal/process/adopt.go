@@ -0,0 +1,457 @@
+package process
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+const adoptPollInterval = 500 * time.Millisecond
+
+// errAdoptedExit is the exit reason of adopted processes, which are not our
+// children, so their exit status cannot be collected
+var errAdoptedExit = errors.New("adopted process exited (exit status unknown)")
+
+// pidFile records a launched process so a later manager can adopt it
+type pidFile struct {
+	ID         string               `json:"id"`
+	PID        int                  `json:"pid"`
+	StartTicks uint64               `json:"start_ticks"` // Tells the process apart from a later PID reuse
+	StartTime  time.Time            `json:"start_time"`
+	Type       string               `json:"type"`
+	Binary     string               `json:"binary"` // Resolved path
+	Args       []string             `json:"args"`
+	Spec       string               `json:"spec"` // Hash of the effective settings, see specHash
+	RustLog    string               `json:"rust_log"`
+	Client     *config.ClientConfig `json:"client,omitempty"` // Config as launched, defaults applied
+	Server     *config.ServerConfig `json:"server,omitempty"`
+	Netns      *system.Netns        `json:"netns,omitempty"`
+	NetnsSlot  int                  `json:"netns_slot,omitempty"`
+}
+
+// processOutput holds the FIFOs an adoptable process writes to. Unlike pipes
+// they survive the manager, and a new manager can reopen them.
+type processOutput struct {
+	readers []*os.File
+	writers []*os.File // Handed to the child, closed once it started
+}
+
+// started closes the parent's copies of the child's ends
+func (o *processOutput) started() {
+	if o == nil {
+		return
+	}
+	for _, w := range o.writers {
+		w.Close()
+	}
+	o.writers = nil
+}
+
+// close stops capturing
+func (o *processOutput) close() {
+	if o == nil {
+		return
+	}
+	o.started()
+	for _, r := range o.readers {
+		r.Close()
+	}
+	o.readers = nil
+}
+
+// SetRunDir sets the directory for the PID files and output FIFOs of
+// adoptable processes
+func (m *Manager) SetRunDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.runDir = dir
+	m.mu.Unlock()
+	return nil
+}
+
+// adopting reports whether processes are left running for the next manager.
+// Caller must hold m.mu.
+func (m *Manager) adopting() bool {
+	return m.runDir != "" && m.conf.General.Supervisor.Adopt
+}
+
+func (m *Manager) runPath(id, ext string) string {
+	return filepath.Join(m.runDir, unsafeNameChars.ReplaceAllString(id, "_")+ext)
+}
+
+// specHash fingerprints the effective settings of an instance
+func specHash(spec interface{}) string {
+	data, _ := json.Marshal(spec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// openOutput creates (or reopens) the stdout and stderr FIFOs of an instance
+// and starts capturing them. Given a cmd to launch, the write ends are opened
+// as well and attached to it.
+func (m *Manager) openOutput(id string, cmd *exec.Cmd) (*processOutput, error) {
+	out := &processOutput{}
+	for _, stream := range []string{"stdout", "stderr"} {
+		path := m.runPath(id, "."+stream)
+		if cmd != nil {
+			if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeNamedPipe == 0 {
+				os.Remove(path)
+			}
+			if err := syscall.Mkfifo(path, 0o600); err != nil && !errors.Is(err, os.ErrExist) {
+				out.close()
+				return nil, fmt.Errorf("failed to create output FIFO: %w", err)
+			}
+		}
+		// Read-write, so opening never blocks and a dead writer is no EOF
+		r, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			out.close()
+			return nil, err
+		}
+		out.readers = append(out.readers, r)
+		if cmd != nil {
+			w, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				out.close()
+				return nil, err
+			}
+			out.writers = append(out.writers, w)
+		}
+	}
+	for i, stream := range []string{"stdout", "stderr"} {
+		go m.captureStream(out.readers[i], id, stream)
+	}
+	if cmd != nil {
+		cmd.Stdout, cmd.Stderr = out.writers[0], out.writers[1]
+		// Own session, so signals to the manager's process group pass it by
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setsid = true
+	}
+	return out, nil
+}
+
+// writePidFile records a freshly started process. Caller must hold m.mu.
+func (m *Manager) writePidFile(p *Process, binary string, args []string, spec, rustLog string) {
+	pid := p.Cmd.Process.Pid
+	ticks, _, err := system.ProcessIdentity(pid)
+	if err != nil {
+		log.Printf("Warning: Process %s cannot be adopted later: %v", p.ConfigID, err)
+		return
+	}
+	pf := pidFile{
+		ID:         p.ConfigID,
+		PID:        pid,
+		StartTicks: ticks,
+		StartTime:  p.StartTime,
+		Type:       p.Type,
+		Binary:     binary,
+		Args:       args,
+		Spec:       spec,
+		RustLog:    rustLog,
+		Netns:      p.Netns,
+	}
+	if p.Type == "client" {
+		pf.Client = &p.ClientCfg
+	} else {
+		pf.Server = &p.ServerCfg
+	}
+	if p.Netns != nil {
+		pf.NetnsSlot = m.netnsSlots[p.ConfigID]
+	}
+	data, _ := json.MarshalIndent(pf, "", "  ")
+	if err := os.WriteFile(m.runPath(p.ConfigID, ".pid"), data, 0o644); err != nil {
+		log.Printf("Warning: Process %s cannot be adopted later: %v", p.ConfigID, err)
+	}
+}
+
+// removePidFile forgets an exited process, unless the file already belongs
+// to a newer one. Caller must hold m.mu.
+func (m *Manager) removePidFile(id string, pid int) {
+	if m.runDir == "" {
+		return
+	}
+	path := m.runPath(id, ".pid")
+	if data, err := os.ReadFile(path); err == nil {
+		var pf pidFile
+		if json.Unmarshal(data, &pf) == nil && pf.PID != pid {
+			return
+		}
+	}
+	os.Remove(path)
+	os.Remove(m.runPath(id, ".stdout"))
+	os.Remove(m.runPath(id, ".stderr"))
+}
+
+// process rebuilds the Process a PID file describes, without a handle
+func (pf *pidFile) process() *Process {
+	p := &Process{ConfigID: pf.ID, Type: pf.Type, StartTime: pf.StartTime, Netns: pf.Netns}
+	if pf.Client != nil {
+		p.ClientCfg = *pf.Client
+	}
+	if pf.Server != nil {
+		p.ServerCfg = *pf.Server
+	}
+	return p
+}
+
+// alive reports whether the recorded process still runs
+func (pf *pidFile) alive() bool {
+	ticks, state, err := system.ProcessIdentity(pf.PID)
+	return err == nil && ticks == pf.StartTicks && state != "Z"
+}
+
+// adoptAll takes over the processes a previous manager left running. Those
+// that no longer match the config are stopped and torn down, so StartAll
+// launches them afresh, and leftover rules of instances that were not adopted
+// are removed. Caller must hold m.mu.
+func (m *Manager) adoptAll() {
+	if m.runDir != "" {
+		m.adoptPidFiles()
+	}
+	if m.conf.General.Supervisor.Adopt {
+		m.cleanupUnadopted()
+	}
+}
+
+// adoptPidFiles adopts or discards the process of every PID file. Caller must
+// hold m.mu.
+func (m *Manager) adoptPidFiles() {
+	files, _ := filepath.Glob(filepath.Join(m.runDir, "*.pid"))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		var pf pidFile
+		if err == nil {
+			err = json.Unmarshal(data, &pf)
+		}
+		if err != nil || pf.ID == "" || (pf.Client == nil && pf.Server == nil) {
+			log.Printf("Warning: Ignoring unreadable PID file %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		if _, running := m.processes[pf.ID]; running {
+			continue
+		}
+		if err := m.adopt(&pf); err != nil {
+			log.Printf("Not adopting %s (PID %d): %v", pf.ID, pf.PID, err)
+			m.discard(&pf)
+		}
+	}
+}
+
+// cleanupUnadopted removes the host rules of instances that no longer hold
+// them. The startup cleanup is skipped in adopt mode, so rules of processes
+// that died with the previous manager are still there. Caller must hold m.mu.
+func (m *Manager) cleanupUnadopted() {
+	rules, err := m.firewall.ListRules()
+	if err != nil {
+		log.Printf("[WARNING] Failed to list firewall rules of unadopted instances: %v", err)
+		return
+	}
+	done := make(map[string]bool)
+	for _, r := range rules {
+		if r.Owner == "" || done[r.Owner] || m.holdsRules(r.Owner) {
+			continue
+		}
+		done[r.Owner] = true
+		if err := m.firewall.CleanupInstance(r.Owner); err != nil {
+			log.Printf("[WARNING] Failed to remove leftover firewall rules of %s: %v", r.Owner, err)
+		}
+	}
+}
+
+// running reports whether the instance has a process, e.g. after adoptAll.
+// Caller must hold m.mu.
+func (m *Manager) running(id string) bool {
+	_, running := m.processes[id]
+	return running
+}
+
+// adopt checks a leftover process against the current config and takes it
+// over. Caller must hold m.mu.
+func (m *Manager) adopt(pf *pidFile) error {
+	if !m.adopting() {
+		return errors.New("adoption is disabled")
+	}
+	if !pf.alive() {
+		return errors.New("process is gone")
+	}
+	cmdline, err := system.ProcessCmdline(pf.PID)
+	if err != nil || !hasSuffix(cmdline, pf.Args) {
+		return errors.New("command line does not match")
+	}
+
+	var spec, logLevel, alias, binary, version string
+	c, s := m.lookupInstance(pf.ID)
+	switch {
+	case !m.conf.General.Enabled:
+		return errors.New("global switch is off")
+	case c != nil && pf.Client != nil && c.Enabled:
+		spec, logLevel, alias, binary, version = specHash(clientSpec(*c)), c.LogLevel, c.Alias, "phantun_client", c.Binary
+	case s != nil && pf.Server != nil && s.Enabled:
+		spec, logLevel, alias, binary, version = specHash(serverSpec(*s)), s.LogLevel, s.Alias, "phantun_server", s.Binary
+	default:
+		return errors.New("instance is no longer configured or enabled")
+	}
+	if spec != pf.Spec {
+		return errors.New("settings changed")
+	}
+	if m.rustLog(logLevel) != pf.RustLog {
+		return errors.New("log level changed")
+	}
+
+	p := pf.process()
+	proc, err := os.FindProcess(pf.PID)
+	if err != nil {
+		return err
+	}
+	p.Cmd = &exec.Cmd{Process: proc}
+	p.done = make(chan struct{})
+	if pf.Client != nil {
+		p.ClientCfg.Alias = alias
+	} else {
+		p.ServerCfg.Alias = alias
+	}
+
+	// Rules may have gone missing while nobody watched; adding is idempotent
+	if p.Netns != nil {
+		m.netnsSlots[p.ConfigID] = pf.NetnsSlot
+		if pf.Client != nil {
+			err = m.firewall.SetupClientNetns(*p.Netns, p.ClientCfg)
+		} else {
+			err = m.firewall.SetupServerNetns(*p.Netns, p.ServerCfg)
+		}
+	} else if pf.Client != nil {
+		err = m.firewall.SetupClient(p.ClientCfg)
+		if err == nil && !p.ClientCfg.IPv4Only {
+			m.firewall.SetupClientIPv6(p.ClientCfg)
+		}
+	} else {
+		err = m.firewall.SetupServer(p.ServerCfg)
+		if err == nil && !p.ServerCfg.IPv4Only {
+			m.firewall.SetupServerIPv6(p.ServerCfg)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("iptables setup failed: %w", err)
+	}
+	if err := m.checkReady(p); err != nil {
+		return err
+	}
+	if p.Verified, err = m.verifyBinary(alias, binary, version, pf.Binary); err != nil {
+		return err
+	}
+	if p.output, err = m.openOutput(p.ConfigID, nil); err != nil {
+		return fmt.Errorf("failed to reopen output: %w", err)
+	}
+
+	m.processes[p.ConfigID] = p
+	m.setState(p.ConfigID, StateStarting, nil)
+	m.states[p.ConfigID].PID = pf.PID
+	go m.monitorAdopted(p, pf.StartTicks)
+	m.setReady(p)
+	log.Printf("Adopted %s %s (PID %d)", p.Type, alias, pf.PID)
+	m.instanceEvent(p.ConfigID, "info", "Adopted running process (PID %d)", pf.PID)
+	return nil
+}
+
+// discard stops a leftover process that is not adopted and removes its rules,
+// TUN device or namespace. Caller must hold m.mu, which is released while
+// waiting for the process to exit.
+func (m *Manager) discard(pf *pidFile) {
+	p := pf.process()
+	if pf.alive() {
+		if proc, err := os.FindProcess(pf.PID); err == nil {
+			// Not our child: poll for the exit instead of waiting
+			p.Cmd = &exec.Cmd{Process: proc}
+			p.done = make(chan struct{})
+			go func() {
+				for pf.alive() {
+					time.Sleep(adoptPollInterval / 5)
+				}
+				close(p.done)
+			}()
+		}
+	}
+	m.finishStop(p, secondsOr(m.conf.General.Supervisor.StopGraceSec, defaultStopGrace))
+	m.removePidFile(pf.ID, pf.PID)
+}
+
+// monitorAdopted polls an adopted process, which cannot be waited for, and
+// handles its exit like monitorProcess
+func (m *Manager) monitorAdopted(p *Process, startTicks uint64) {
+	pid := p.Cmd.Process.Pid
+	ticker := time.NewTicker(adoptPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ticks, state, err := system.ProcessIdentity(pid)
+		if err != nil || ticks != startTicks {
+			break
+		}
+		if state == "Z" {
+			// Reparented to us when the manager runs as PID 1
+			syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+			break
+		}
+	}
+	close(p.done)
+	m.processExited(p, errAdoptedExit)
+}
+
+// Shutdown stops every instance, or in adopt mode leaves them running for the
+// next manager and only stops watching them
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	if !m.adopting() {
+		m.mu.Unlock()
+		m.StopAll()
+		return
+	}
+	defer m.mu.Unlock()
+
+	m.resetSupervisors()
+	for id, p := range m.processes {
+		p.output.close()
+		p.output = nil
+		delete(m.processes, id)
+	}
+	log.Println("Leaving phantun processes running for adoption.")
+}
+
+// hasSuffix reports whether list ends with suffix
+func hasSuffix(list, suffix []string) bool {
+	if len(suffix) > len(list) {
+		return false
+	}
+	tail := list[len(list)-len(suffix):]
+	for i := range suffix {
+		if tail[i] != suffix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// captureStream forwards the lines of one output stream as LogMessages
+func (m *Manager) captureStream(r io.Reader, id, stream string) {
+	readLines(r, func(line string) {
+		// Mirror to Console for Debugging (docker logs)
+		fmt.Printf("[%s] %s: %s\n", id, stream, line)
+		m.BroadcastLog(NewLogMessage(id, stream, line))
+	})
+}
@@ -0,0 +1,233 @@
+package process
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"phantun-docker/internal/config"
+)
+
+// Binaries registry layout: <dir>/<version>/phantun_client and
+// <dir>/<version>/phantun_server. Instances select a version with their
+// "binary" field; instances without one use phantun from PATH.
+
+const versionProbeTimeout = 3 * time.Second
+
+var phantunBinaries = []string{"phantun_client", "phantun_server"}
+
+// BinaryInfo describes one phantun executable
+type BinaryInfo struct {
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256,omitempty"`
+	Version string `json:"version,omitempty"` // Output of --version
+	Error   string `json:"error,omitempty"`   // Why hashing or --version failed
+	Pin     Pin    `json:"pin,omitempty"`     // Against the checksum manifest
+}
+
+// BinaryVersion is one named version in the registry
+type BinaryVersion struct {
+	Name   string      `json:"name"`
+	Client *BinaryInfo `json:"client,omitempty"`
+	Server *BinaryInfo `json:"server,omitempty"`
+}
+
+// versionCacheEntry remembers the digest and --version output until the file changes
+type versionCacheEntry struct {
+	stamp fileStamp
+	info  BinaryInfo
+}
+
+// fileStamp identifies the content of a file without reading it. The inode
+// and change time also catch a file swapped in with its old size and mtime.
+type fileStamp struct {
+	size    int64
+	modTime int64 // Nanoseconds
+	inode   uint64
+	ctime   int64 // Nanoseconds
+}
+
+func stampOf(st os.FileInfo) fileStamp {
+	stamp := fileStamp{size: st.Size(), modTime: st.ModTime().UnixNano()}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		stamp.inode = sys.Ino
+		stamp.ctime = sys.Ctim.Nano()
+	}
+	return stamp
+}
+
+// SetBinariesDir selects the registry directory, creating it if needed
+func (m *Manager) SetBinariesDir(dir string) error {
+	m.binariesMu.Lock()
+	m.binariesDir = dir
+	m.binariesMu.Unlock()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create binaries directory: %w", err)
+	}
+	return nil
+}
+
+// BinariesDir returns the registry directory, empty if none is configured
+func (m *Manager) BinariesDir() string {
+	m.binariesMu.Lock()
+	defer m.binariesMu.Unlock()
+	return m.binariesDir
+}
+
+// resolveBinary returns what to execute for binary ("phantun_client" or
+// "phantun_server") at the given registry version. The empty version leaves
+// the name for a PATH lookup.
+func (m *Manager) resolveBinary(binary, version string) (string, error) {
+	if version == "" {
+		return binary, nil
+	}
+	if !config.ValidBinaryName(version) {
+		return "", fmt.Errorf("invalid binary version %q", version)
+	}
+	dir := m.BinariesDir()
+	if dir == "" {
+		return "", fmt.Errorf("binary version %q requested but no binaries directory is configured", version)
+	}
+	path := filepath.Join(dir, version, binary)
+	st, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("binary version %q has no %s", version, binary)
+		}
+		return "", err
+	}
+	if st.IsDir() || st.Mode().Perm()&0o111 == 0 {
+		return "", fmt.Errorf("%s is not executable", path)
+	}
+	return path, nil
+}
+
+// BinaryVersions lists the versions installed in the registry, sorted by name
+func (m *Manager) BinaryVersions() ([]BinaryVersion, error) {
+	dir := m.BinariesDir()
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pins, _ := m.loadManifest()
+	var versions []BinaryVersion
+	for _, e := range entries {
+		if !e.IsDir() || !config.ValidBinaryName(e.Name()) {
+			continue
+		}
+		v := BinaryVersion{Name: e.Name()}
+		for _, binary := range phantunBinaries {
+			path := filepath.Join(dir, e.Name(), binary)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			info := m.describeBinary(path)
+			if info.SHA256 != "" {
+				info.Pin, _ = checkPin(pins, pinName(binary, e.Name()), info.SHA256)
+			}
+			if binary == "phantun_client" {
+				v.Client = &info
+			} else {
+				v.Server = &info
+			}
+		}
+		if v.Client != nil || v.Server != nil {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Name < versions[j].Name })
+	return versions, nil
+}
+
+// describeBinary hashes a binary and asks it for its version. Results are
+// cached per path until the file changes.
+func (m *Manager) describeBinary(path string) BinaryInfo {
+	st, err := os.Stat(path)
+	if err != nil {
+		return BinaryInfo{Path: path, Error: err.Error()}
+	}
+
+	m.binariesMu.Lock()
+	cached, ok := m.versionCache[path]
+	m.binariesMu.Unlock()
+	stamp := stampOf(st)
+	if ok && cached.stamp == stamp {
+		return cached.info
+	}
+
+	info := BinaryInfo{Path: path}
+	digest, err := fileSHA256(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.SHA256 = digest
+	if version, err := probeVersion(path); err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Version = version
+	}
+
+	m.binariesMu.Lock()
+	m.versionCache[path] = versionCacheEntry{stamp: stamp, info: info}
+	m.binariesMu.Unlock()
+	return info
+}
+
+// forgetBinary drops the cached description of path
+func (m *Manager) forgetBinary(path string) {
+	m.binariesMu.Lock()
+	delete(m.versionCache, path)
+	m.binariesMu.Unlock()
+}
+
+// fileSHA256 returns the hex SHA-256 digest of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// probeVersion runs "<path> --version" and returns the first line of output
+func probeVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionProbeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("--version timed out")
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	line = strings.TrimSpace(line)
+	if err != nil {
+		if line != "" {
+			return "", fmt.Errorf("--version failed: %s", line)
+		}
+		return "", fmt.Errorf("--version failed: %v", err)
+	}
+	if line == "" {
+		return "", fmt.Errorf("--version printed nothing")
+	}
+	return line, nil
+}
@@ -0,0 +1,148 @@
+package process
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Environment variables that turn the manager binary into a fake phantun.
+// FakeEnv selects the mode ("phantun_client" or "phantun_server"); the others
+// script its behaviour.
+const (
+	FakeEnv             = "PHANTUN_FAKE"
+	FakeStartupDelayEnv = "PHANTUN_FAKE_STARTUP_DELAY" // Duration before the "ready" log lines
+	FakeExitAfterEnv    = "PHANTUN_FAKE_EXIT_AFTER"    // Exit on its own after this duration
+	FakeExitCodeEnv     = "PHANTUN_FAKE_EXIT_CODE"     // Exit code for FakeExitAfterEnv (default 1)
+	FakeIgnoreTermEnv   = "PHANTUN_FAKE_IGNORE_SIGTERM"
+	FakeEchoEnv         = "PHANTUN_FAKE_ECHO" // Client echoes datagrams sent to its --local address
+)
+
+// FakeRunner launches the current executable in fake phantun mode instead of
+// the real binaries. It needs no root, TUN device or NET_ADMIN, so lifecycle
+// code can be exercised in CI. Behaviour returns extra PHANTUN_FAKE_* settings
+// per launch; it may be nil.
+type FakeRunner struct {
+	Executable string // Defaults to os.Executable()
+	Behaviour  func(binary string, args []string) []string
+}
+
+func (f FakeRunner) Command(binary string, args ...string) *exec.Cmd {
+	exe := f.Executable
+	if exe == "" {
+		exe, _ = os.Executable()
+	}
+	cmd := exec.Command(exe, args...)
+	// Registry versions arrive as paths; the mode is the binary's name
+	cmd.Env = append(os.Environ(), FakeEnv+"="+filepath.Base(binary))
+	if f.Behaviour != nil {
+		cmd.Env = append(cmd.Env, f.Behaviour(binary, args)...)
+	}
+	return cmd
+}
+
+// RunFakeIfRequested turns the process into a fake phantun when FakeEnv is set
+// and never returns in that case. Call it first thing in main (or TestMain).
+func RunFakeIfRequested() {
+	mode := os.Getenv(FakeEnv)
+	if mode == "" {
+		return
+	}
+	os.Exit(runFake(mode, os.Args[1:]))
+}
+
+// runFake imitates phantun's startup logging, then waits for a signal or the
+// scripted exit
+func runFake(mode string, args []string) int {
+	target := "phantun::client"
+	if mode == "phantun_server" {
+		target = "phantun::server"
+	}
+	logf := func(level, format string, a ...interface{}) {
+		// pretty_env_logger layout, written to stderr like the real binaries
+		fmt.Fprintf(os.Stderr, "%s %-5s %s > %s\n", time.Now().UTC().Format(time.RFC3339Nano), level, target, fmt.Sprintf(format, a...))
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	if os.Getenv(FakeIgnoreTermEnv) != "" {
+		signal.Ignore(syscall.SIGTERM)
+	}
+
+	logf("INFO", "Fake phantun started with args %v", args)
+	if d := envDuration(FakeStartupDelayEnv); d > 0 {
+		time.Sleep(d)
+	}
+	logf("INFO", "Created TUN device %s", argValue(args, "--tun"))
+	if mode == "phantun_server" {
+		logf("INFO", "Listening on %s", argValue(args, "--local"))
+	} else {
+		logf("INFO", "Remote address is: %s", argValue(args, "--remote"))
+		if os.Getenv(FakeEchoEnv) != "" {
+			if err := fakeEcho(argValue(args, "--local")); err != nil {
+				logf("ERROR", "Failed to bind %s: %v", argValue(args, "--local"), err)
+				return 1
+			}
+		}
+	}
+
+	var exit <-chan time.Time
+	if d := envDuration(FakeExitAfterEnv); d > 0 {
+		exit = time.After(d)
+	}
+
+	select {
+	case sig := <-sigs:
+		logf("INFO", "Received %v, shutting down", sig)
+		return 0
+	case <-exit:
+		code := 1
+		if v, err := strconv.Atoi(os.Getenv(FakeExitCodeEnv)); err == nil {
+			code = v
+		}
+		if code != 0 {
+			logf("ERROR", "Simulated crash (exit code %d)", code)
+		}
+		return code
+	}
+}
+
+// fakeEcho answers every datagram on addr with itself, standing in for the
+// service behind a working tunnel
+func fakeEcho(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return nil
+}
+
+func envDuration(key string) time.Duration {
+	d, _ := time.ParseDuration(os.Getenv(key))
+	return d
+}
+
+func argValue(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
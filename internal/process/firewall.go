@@ -0,0 +1,130 @@
+package process
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"phantun-docker/internal/system"
+)
+
+// FirewallName returns the name of the active firewall backend
+func (m *Manager) FirewallName() string {
+	return m.firewall.Name()
+}
+
+// FirewallRules returns the current rules of the active backend
+func (m *Manager) FirewallRules() (string, error) {
+	return m.firewall.Rules()
+}
+
+// FirewallStats returns the rule counts of the active backend
+func (m *Manager) FirewallStats() (map[string]int, error) {
+	return m.firewall.Stats()
+}
+
+// CleanupFirewall removes every rule the active backend created, e.g. the
+// leftovers of a previous run
+func (m *Manager) CleanupFirewall() error {
+	return m.firewall.CleanupAll()
+}
+
+// CleanupOtherFirewall removes every rule the inactive backend created. No
+// instance uses them, so this is safe in adopt mode too.
+func (m *Manager) CleanupOtherFirewall() error {
+	return cleanupOtherFirewall(m.firewall.Name())
+}
+
+// firewallFailed gives up on a prepared instance whose rules were rolled back
+// with the batch they were part of. Caller must hold m.mu.
+func (m *Manager) firewallFailed(l *launch, err error) {
+	log.Printf("[ERROR] Instance %s: firewall transaction rolled back, not starting it: %v", l.id, err)
+	l.undo()
+	m.setState(l.id, StateFailedToStart, fmt.Errorf("iptables setup failed: %w", err))
+}
+
+// InstanceRules are the firewall rules tagged for one instance
+type InstanceRules struct {
+	ID       string                `json:"id"`
+	Alias    string                `json:"alias,omitempty"`
+	Orphaned bool                  `json:"orphaned"` // The instance is not configured or does not hold rules any more
+	Rules    []system.FirewallRule `json:"rules"`
+}
+
+// RuleOwnership is the active backend's rule listing grouped by owner
+type RuleOwnership struct {
+	Instances []InstanceRules       `json:"instances"`
+	Manager   []system.FirewallRule `json:"manager"`  // Tagged without an instance, e.g. the jumps into our chains
+	Untagged  []system.FirewallRule `json:"untagged"` // In our chains or table but without a tag
+}
+
+// FirewallOwnership lists the rules of the active backend grouped by the
+// instance they are tagged for, flagging rules of instances that are gone or
+// stopped and rules without a tag
+func (m *Manager) FirewallOwnership() (RuleOwnership, error) {
+	rules, err := m.firewall.ListRules()
+	if err != nil {
+		return RuleOwnership{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	own := RuleOwnership{
+		Instances: []InstanceRules{},
+		Manager:   []system.FirewallRule{},
+		Untagged:  []system.FirewallRule{},
+	}
+	index := make(map[string]int)
+	for _, r := range rules {
+		switch {
+		case r.Tag == "":
+			own.Untagged = append(own.Untagged, r)
+			continue
+		case r.Owner == "":
+			own.Manager = append(own.Manager, r)
+			continue
+		}
+		i, ok := index[r.Owner]
+		if !ok {
+			i = len(own.Instances)
+			index[r.Owner] = i
+			g := InstanceRules{ID: r.Owner, Orphaned: !m.holdsRules(r.Owner)}
+			if c, s := m.lookupInstance(r.Owner); c != nil {
+				g.Alias = c.Alias
+			} else if s != nil {
+				g.Alias = s.Alias
+			}
+			own.Instances = append(own.Instances, g)
+		}
+		own.Instances[i].Rules = append(own.Instances[i].Rules, r)
+	}
+	sort.Slice(own.Instances, func(i, j int) bool { return own.Instances[i].ID < own.Instances[j].ID })
+	return own, nil
+}
+
+// holdsRules reports whether a configured instance should have rules
+// installed: it is running, or crashed and not torn down yet. Caller must
+// hold m.mu.
+func (m *Manager) holdsRules(id string) bool {
+	if c, s := m.lookupInstance(id); c == nil && s == nil {
+		return false
+	}
+	if m.running(id) {
+		return true
+	}
+	sv := m.supervisors[id]
+	return sv != nil && sv.last != nil
+}
+
+// CleanupInstanceRules removes the firewall rules tagged for one instance,
+// e.g. orphaned ones. Instances that hold their rules are refused.
+func (m *Manager) CleanupInstanceRules(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.holdsRules(id) {
+		return ErrInstanceRunning
+	}
+	return m.firewall.CleanupInstance(id)
+}
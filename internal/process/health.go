@@ -0,0 +1,237 @@
+package process
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+// Health check defaults, used when the matching HealthCheck field is zero
+const (
+	defaultHealthInterval  = 30 * time.Second
+	defaultHealthTimeout   = 5 * time.Second
+	defaultHealthThreshold = 3
+)
+
+// Health states reported in HealthDTO
+const (
+	HealthUnknown   = "unknown" // No probe has finished yet
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy" // FailureThreshold consecutive probes failed
+)
+
+// healthState holds the probe results of one process. Guarded by the manager's mu.
+type healthState struct {
+	check         config.HealthCheck
+	status        string
+	lastCheck     time.Time
+	lastSuccess   time.Time
+	latency       time.Duration
+	failureStreak int
+	lastError     string
+}
+
+// HealthDTO describes the health of an instance for the API
+type HealthDTO struct {
+	Type          config.HealthCheckType `json:"type"`
+	Status        string                 `json:"status"`
+	LastCheck     *time.Time             `json:"last_check,omitempty"`
+	LastSuccess   *time.Time             `json:"last_success,omitempty"`
+	LatencyMs     float64                `json:"latency_ms"` // Of the last successful probe
+	FailureStreak int                    `json:"failure_streak"`
+	LastError     string                 `json:"last_error,omitempty"`
+}
+
+func (h *healthState) dto() *HealthDTO {
+	if h == nil {
+		return nil
+	}
+	d := &HealthDTO{
+		Type:          h.check.Type,
+		Status:        h.status,
+		LatencyMs:     float64(h.latency.Microseconds()) / 1000,
+		FailureStreak: h.failureStreak,
+		LastError:     h.lastError,
+	}
+	if !h.lastCheck.IsZero() {
+		t := h.lastCheck
+		d.LastCheck = &t
+	}
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		d.LastSuccess = &t
+	}
+	return d
+}
+
+// healthCheck returns the health check the instance was started with
+func (p *Process) healthCheck() *config.HealthCheck {
+	if p.Type == "client" {
+		return p.ClientCfg.Health
+	}
+	return p.ServerCfg.Health
+}
+
+// monitorHealth probes a ready process on its interval until it exits or is
+// replaced
+func (m *Manager) monitorHealth(p *Process, hc config.HealthCheck) {
+	interval := secondsOr(hc.IntervalSec, defaultHealthInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastRx uint64
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		var err error
+		switch hc.Type {
+		case config.HealthConntrack:
+			err = probeConntrack(p)
+		case config.HealthTraffic:
+			err = probeTraffic(p, &lastRx)
+		case config.HealthUDP:
+			err = probeUDP(p.ClientCfg, hc)
+		}
+		if !m.recordHealth(p, err, time.Since(start)) {
+			return
+		}
+	}
+}
+
+// recordHealth stores a probe result and restarts the instance if it just
+// turned unhealthy and the check asks for it. It returns false once the
+// process is no longer the current one for its instance.
+func (m *Manager) recordHealth(p *Process, probeErr error, latency time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.processes[p.ConfigID] != p {
+		return false
+	}
+
+	h := p.health
+	h.lastCheck = time.Now()
+	if probeErr == nil {
+		if h.status == HealthUnhealthy {
+			m.instanceEvent(p.ConfigID, "info", "Health check passing again after %d failures", h.failureStreak)
+		}
+		h.status = HealthHealthy
+		h.lastSuccess = h.lastCheck
+		h.latency = latency
+		h.failureStreak = 0
+		h.lastError = ""
+		return true
+	}
+
+	h.failureStreak++
+	h.lastError = probeErr.Error()
+	threshold := h.check.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultHealthThreshold
+	}
+	if h.failureStreak < threshold {
+		return true
+	}
+	if h.status != HealthUnhealthy {
+		h.status = HealthUnhealthy
+		log.Printf("[WARNING] Instance %s is unhealthy after %d failed %s checks: %v", p.ConfigID, h.failureStreak, h.check.Type, probeErr)
+		m.instanceEvent(p.ConfigID, "warn", "Health check failed %d times: %v", h.failureStreak, probeErr)
+	}
+	if !h.check.Restart {
+		return true
+	}
+
+	m.instanceEvent(p.ConfigID, "warn", "Restarting unhealthy instance")
+	if err := m.stopInstance(p.ConfigID); err != nil {
+		log.Printf("[ERROR] Failed to stop unhealthy instance %s: %v", p.ConfigID, err)
+		return false
+	}
+	if err := m.startInstance(p.ConfigID); err != nil {
+		log.Printf("[ERROR] Failed to restart unhealthy instance %s: %v", p.ConfigID, err)
+	}
+	return false
+}
+
+// probeConntrack looks for the established fake-TCP connection: to the
+// server for clients, from any client for servers
+func probeConntrack(p *Process) error {
+	dst, dport := "", p.ServerCfg.LocalPort
+	if p.Type == "client" {
+		dport = p.ClientCfg.RemotePort
+		if ip := net.ParseIP(p.ClientCfg.RemoteAddr); ip != nil {
+			dst = ip.String()
+		}
+	}
+	ok, err := system.ConntrackEstablished(p.Cmd.Process.Pid, dst, dport)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no established connection to port %s", dport)
+	}
+	return nil
+}
+
+// probeTraffic checks that the TUN device received data since the last probe
+func probeTraffic(p *Process, lastRx *uint64) error {
+	name := p.tunName()
+	if name == "" {
+		return errors.New("traffic check needs tun_name")
+	}
+	rx, _, err := system.InterfaceCounters(p.Cmd.Process.Pid, name)
+	if err != nil {
+		return err
+	}
+	prev := *lastRx
+	*lastRx = rx
+	if rx == 0 || rx == prev {
+		return fmt.Errorf("no data received on %s since the last check", name)
+	}
+	return nil
+}
+
+// probeUDP sends the payload to the client's local port and waits for the
+// response that comes back through the tunnel
+func probeUDP(c config.ClientConfig, hc config.HealthCheck) error {
+	payload, _ := hex.DecodeString(hc.PayloadHex)
+	expect, _ := hex.DecodeString(hc.ExpectHex)
+	timeout := secondsOr(hc.TimeoutSec, defaultHealthTimeout)
+
+	host := c.LocalAddr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(host, c.LocalPort), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(payload); err != nil {
+		return err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(buf[:n], expect) {
+		return fmt.Errorf("unexpected response %x", buf[:min(n, 32)])
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package process
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"phantun-docker/internal/config"
+)
+
+const maxBinaryBytes = 64 << 20 // Per extracted binary
+
+// installSettle is how long restarted instances must stay up on a new binary
+// before the install is kept. A variable so tests can shorten it.
+var installSettle = 5 * time.Second
+
+// InstallRequest describes an uploaded phantun release zip or bare binary
+type InstallRequest struct {
+	Version string // Registry version to install into
+	Data    []byte
+	Name    string // "phantun_client" or "phantun_server"; required for a bare binary
+	SHA256  string // Expected digest of Data, optional
+	Restart bool   // Restart running instances that use Version
+}
+
+// InstallResult reports what an install did
+type InstallResult struct {
+	Version    string       `json:"version"`
+	Installed  []BinaryInfo `json:"installed"`
+	Restarted  []string     `json:"restarted,omitempty"`
+	RolledBack bool         `json:"rolled_back"`
+	Error      string       `json:"error,omitempty"` // Why it was rolled back
+}
+
+// ErrInvalidBinary marks uploads that are rejected before touching the registry
+var ErrInvalidBinary = errors.New("invalid binary")
+
+// InstallBinaries validates an upload and stores it as a registry version.
+// Existing files of that version are kept until the restarted instances have
+// stayed up for installSettle; if one fails, the previous files are restored
+// and the instances restarted on them.
+func (m *Manager) InstallBinaries(req InstallRequest) (*InstallResult, error) {
+	if !config.ValidBinaryName(req.Version) {
+		return nil, fmt.Errorf("%w: invalid version name %q", ErrInvalidBinary, req.Version)
+	}
+	if req.SHA256 != "" {
+		sum := sha256.Sum256(req.Data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, req.SHA256) {
+			return nil, fmt.Errorf("%w: SHA-256 %s does not match %s", ErrInvalidBinary, got, req.SHA256)
+		}
+	}
+
+	files, err := unpackUpload(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBinary, err)
+	}
+	for name, data := range files {
+		if err := checkELF(data); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBinary, name, err)
+		}
+	}
+
+	dir := m.BinariesDir()
+	if dir == "" {
+		return nil, fmt.Errorf("no binaries directory configured")
+	}
+
+	m.installMu.Lock()
+	defer m.installMu.Unlock()
+
+	backup, err := m.swapInBinaries(dir, req.Version, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// A checksum-verified upload is trusted, so its binaries get pinned
+	var manifest []byte
+	pinned := false
+	if req.SHA256 != "" {
+		if manifest, err = m.pinBinaries(req.Version, files); err != nil {
+			log.Printf("[WARNING] Failed to pin binary version %s: %v", req.Version, err)
+		} else {
+			pinned = true
+		}
+	}
+
+	result := &InstallResult{Version: req.Version}
+	if req.Restart {
+		result.Restarted = m.instancesOnVersion(req.Version, files)
+		if err := m.restartAndSettle(result.Restarted); err != nil {
+			log.Printf("[ERROR] Binary version %s failed, rolling back: %v", req.Version, err)
+			result.RolledBack = true
+			result.Error = err.Error()
+			if rbErr := restoreBinaries(dir, req.Version, files, backup); rbErr != nil {
+				return nil, fmt.Errorf("%v; rollback failed: %w", err, rbErr)
+			}
+			if pinned {
+				if rbErr := m.writeManifest(manifest); rbErr != nil {
+					log.Printf("[ERROR] Failed to restore checksum manifest: %v", rbErr)
+				}
+			}
+			if rbErr := m.restartAndSettle(result.Restarted); rbErr != nil {
+				log.Printf("[ERROR] Instances still failing after rollback of %s: %v", req.Version, rbErr)
+			}
+		}
+	}
+	if backup != "" {
+		os.RemoveAll(backup)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(dir, req.Version, name)
+		m.forgetBinary(path)
+		result.Installed = append(result.Installed, m.describeBinary(path))
+	}
+	if !result.RolledBack {
+		log.Printf("Installed phantun binary version %s (%s)", req.Version, strings.Join(names, ", "))
+	}
+	return result, nil
+}
+
+// unpackUpload returns the phantun binaries of an upload, keyed by name
+func unpackUpload(req InstallRequest) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if !bytes.HasPrefix(req.Data, []byte("PK\x03\x04")) {
+		if !contains(phantunBinaries, req.Name) {
+			return nil, fmt.Errorf("a bare binary needs a name of phantun_client or phantun_server, got %q", req.Name)
+		}
+		files[req.Name] = req.Data
+		return files, nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(req.Data), int64(len(req.Data)))
+	if err != nil {
+		return nil, fmt.Errorf("bad zip: %v", err)
+	}
+	for _, f := range zr.File {
+		name := filepath.Base(f.Name)
+		if f.FileInfo().IsDir() || !contains(phantunBinaries, name) {
+			continue
+		}
+		if _, dup := files[name]; dup {
+			return nil, fmt.Errorf("zip contains %s more than once", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("bad zip entry %s: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxBinaryBytes+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad zip entry %s: %v", f.Name, err)
+		}
+		if len(data) > maxBinaryBytes {
+			return nil, fmt.Errorf("%s is larger than %d MB", name, maxBinaryBytes>>20)
+		}
+		files[name] = data
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("zip contains neither phantun_client nor phantun_server")
+	}
+	return files, nil
+}
+
+// elfMachines maps GOARCH to the ELF machine the binaries must be built for
+var elfMachines = map[string]elf.Machine{
+	"amd64": elf.EM_X86_64,
+	"arm64": elf.EM_AARCH64,
+	"arm":   elf.EM_ARM,
+	"386":   elf.EM_386,
+}
+
+// checkELF accepts Linux executables for the architecture we run on
+func checkELF(data []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("not an ELF file")
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("ELF type %v is not executable", f.Type)
+	}
+	if f.OSABI != elf.ELFOSABI_NONE && f.OSABI != elf.ELFOSABI_LINUX {
+		return fmt.Errorf("ELF OS ABI %v is not Linux", f.OSABI)
+	}
+	if want, ok := elfMachines[runtime.GOARCH]; ok && f.Machine != want {
+		return fmt.Errorf("built for %v, this host needs %v", f.Machine, want)
+	}
+	return nil
+}
+
+// swapInBinaries writes files into <dir>/<version>, moving files they replace
+// into a backup directory, which is returned ("" if nothing was replaced)
+func (m *Manager) swapInBinaries(dir, version string, files map[string][]byte) (string, error) {
+	target := filepath.Join(dir, version)
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(dir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(staging, name), data, 0o755); err != nil {
+			return "", err
+		}
+	}
+
+	backup := ""
+	swapped := make(map[string][]byte) // Names to undo on failure
+	fail := func(err error) (string, error) {
+		restoreBinaries(dir, version, swapped, backup)
+		if backup != "" {
+			os.RemoveAll(backup)
+		}
+		return "", err
+	}
+	for name, data := range files {
+		dst := filepath.Join(target, name)
+		if _, err := os.Stat(dst); err == nil {
+			if backup == "" {
+				if backup, err = os.MkdirTemp(dir, ".backup-"); err != nil {
+					return fail(err)
+				}
+			}
+			if err := os.Rename(dst, filepath.Join(backup, name)); err != nil {
+				return fail(err)
+			}
+		}
+		swapped[name] = data
+		// Rename keeps the swap atomic; running processes keep the old inode
+		if err := os.Rename(filepath.Join(staging, name), dst); err != nil {
+			return fail(err)
+		}
+	}
+	return backup, nil
+}
+
+// restoreBinaries puts back the files swapInBinaries replaced and removes the
+// ones that had no predecessor
+func restoreBinaries(dir, version string, files map[string][]byte, backup string) error {
+	var firstErr error
+	for name := range files {
+		dst := filepath.Join(dir, version, name)
+		prev := ""
+		if backup != "" {
+			prev = filepath.Join(backup, name)
+		}
+		if prev != "" {
+			if _, err := os.Stat(prev); err == nil {
+				if err := os.Rename(prev, dst); err != nil && firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// instancesOnVersion lists running instances launched from the installed files
+func (m *Manager) instancesOnVersion(version string, files map[string][]byte) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id, p := range m.processes {
+		if p.Type == "client" && p.ClientCfg.Binary == version && files["phantun_client"] != nil ||
+			p.Type == "server" && p.ServerCfg.Binary == version && files["phantun_server"] != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// restartAndSettle restarts the instances and waits until each has stayed
+// running, as the same process, for installSettle
+func (m *Manager) restartAndSettle(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pids := make(map[string]int)
+	for _, id := range ids {
+		if err := m.RestartInstance(id); err != nil {
+			return fmt.Errorf("instance %s: %w", id, err)
+		}
+		m.mu.Lock()
+		if p, ok := m.processes[id]; ok {
+			pids[id] = p.Cmd.Process.Pid
+		}
+		m.mu.Unlock()
+	}
+
+	deadline := time.Now().Add(installSettle)
+	for {
+		m.mu.Lock()
+		var failed error
+		for _, id := range ids {
+			if p, ok := m.processes[id]; !ok || p.Cmd.Process.Pid != pids[id] {
+				failed = fmt.Errorf("instance %s did not stay up", id)
+				if st := m.states[id]; st != nil && st.LastError != "" {
+					failed = fmt.Errorf("instance %s did not stay up: %s", id, st.LastError)
+				}
+				break
+			}
+		}
+		m.mu.Unlock()
+		if failed != nil {
+			return failed
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
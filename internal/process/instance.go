@@ -0,0 +1,285 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+
+	"phantun-docker/internal/config"
+)
+
+const (
+	defaultStopGrace  = 10 * time.Second // SIGTERM -> SIGKILL
+	killTimeout       = 5 * time.Second  // SIGKILL -> give up waiting
+	tunReleaseTimeout = 3 * time.Second  // Process exit -> TUN device gone
+)
+
+var (
+	ErrInstanceNotFound = errors.New("instance not found")
+	ErrInstanceRunning  = errors.New("instance already running")
+	ErrInstanceDisabled = errors.New("instance is disabled")
+)
+
+// lookupInstance finds the configuration of an instance by ID.
+// Exactly one of the results is non-nil when the instance exists.
+func (m *Manager) lookupInstance(id string) (*config.ClientConfig, *config.ServerConfig) {
+	for i := range m.conf.Clients {
+		if m.conf.Clients[i].ID == id {
+			c := m.conf.Clients[i]
+			return &c, nil
+		}
+	}
+	for i := range m.conf.Servers {
+		if m.conf.Servers[i].ID == id {
+			s := m.conf.Servers[i]
+			return nil, &s
+		}
+	}
+	return nil, nil
+}
+
+// StartInstance starts a single enabled instance, leaving all others untouched.
+// Like a restart, it resets the backoff and crash-loop state. Outside its
+// schedule window the instance stays up until the next transition.
+func (m *Manager) StartInstance(id string) error {
+	m.prepareBinaries(id)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running(id) {
+		// Tears down a crashed process and drops its supervisor
+		if err := m.stopInstance(id); err != nil {
+			return err
+		}
+	}
+	if err := m.startInstance(id); err != nil {
+		return err
+	}
+	m.overrideSchedule(id, true)
+	return nil
+}
+
+// StopInstance stops a single instance and removes its firewall rules and TUN device.
+// Inside its schedule window the instance stays down until the next transition.
+func (m *Manager) StopInstance(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.stopInstance(id); err != nil {
+		return err
+	}
+	m.manualStops[id] = true
+	m.overrideSchedule(id, false)
+	return nil
+}
+
+// RestartInstance stops and starts a single instance. A manual restart also
+// resets its backoff and crash-loop state, and outside its schedule window
+// keeps the instance up until the next transition.
+func (m *Manager) RestartInstance(id string) error {
+	m.prepareBinaries(id)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.stopInstance(id); err != nil {
+		return err
+	}
+	if err := m.startInstance(id); err != nil {
+		return err
+	}
+	m.overrideSchedule(id, true)
+	return nil
+}
+
+// startInstance launches the instance from the current config. Caller must hold m.mu.
+func (m *Manager) startInstance(id string) error {
+	if _, running := m.processes[id]; running {
+		return ErrInstanceRunning
+	}
+	if !m.conf.General.Enabled {
+		return fmt.Errorf("global switch disabled")
+	}
+	delete(m.manualStops, id)
+
+	c, s := m.lookupInstance(id)
+	switch {
+	case c != nil:
+		if !c.Enabled {
+			return ErrInstanceDisabled
+		}
+		return m.startClient(*c)
+	case s != nil:
+		if !s.Enabled {
+			return ErrInstanceDisabled
+		}
+		return m.startServer(*s)
+	}
+	return ErrInstanceNotFound
+}
+
+// stopInstance terminates the instance and tears down its network state.
+// Stopping an instance that is already down is not an error. Caller must hold
+// m.mu, which is released while waiting for the process to exit.
+func (m *Manager) stopInstance(id string) error {
+	// Let a stop in progress finish first; a restart in between is stopped too
+	_ = m.awaitStopped(id)
+
+	// Cancel any pending restart first
+	sv := m.supervisors[id]
+	if sv != nil {
+		if sv.timer != nil {
+			sv.timer.Stop()
+		}
+		delete(m.supervisors, id)
+	}
+
+	p, running := m.processes[id]
+	if !running {
+		// A crashed instance still owns its firewall rules
+		if sv != nil && sv.last != nil {
+			m.finishStop(sv.last, 0)
+			m.setState(id, StateExited, nil)
+			return nil
+		}
+		if c, s := m.lookupInstance(id); c == nil && s == nil {
+			return ErrInstanceNotFound
+		}
+		return nil
+	}
+
+	log.Printf("Stopping process %s (%s)", id, p.Type)
+	m.setState(id, StateStopping, nil)
+	delete(m.processes, id)
+	m.finishStop(p, secondsOr(m.conf.General.Supervisor.StopGraceSec, defaultStopGrace))
+	return nil
+}
+
+// finishStop sends SIGTERM to a process already removed from m.processes,
+// waits for it with m.mu released, and tears it down. Caller must hold m.mu.
+func (m *Manager) finishStop(p *Process, grace time.Duration) {
+	m.beginStop(p)
+	m.mu.Unlock()
+	m.awaitExit(p, grace)
+	m.mu.Lock()
+	m.teardown(p)
+	m.endStop(p.ConfigID)
+}
+
+// beginStop marks the instance as stopping and sends SIGTERM to its process,
+// unless it already exited. Caller must hold m.mu.
+func (m *Manager) beginStop(p *Process) {
+	m.stopping[p.ConfigID] = make(chan struct{})
+	if p.Cmd != nil && p.Cmd.Process != nil && p.done != nil && !p.reaped() {
+		p.Cmd.Process.Signal(syscall.SIGTERM)
+	}
+}
+
+// awaitExit waits up to the grace period for a process signalled by beginStop
+// to exit, escalating to SIGKILL, and then for its TUN device to go away, so
+// its name and port are free for a restart. It must be called without m.mu.
+func (m *Manager) awaitExit(p *Process, grace time.Duration) {
+	if p.Netns == nil {
+		defer m.waitTunReleased(p.tunName())
+	}
+	if p.Cmd == nil || p.Cmd.Process == nil || p.done == nil || p.reaped() {
+		return
+	}
+	select {
+	case <-p.done:
+		return
+	case <-time.After(grace):
+	}
+
+	log.Printf("Process %s did not exit within %s, sending SIGKILL", p.ConfigID, grace)
+	p.Cmd.Process.Kill()
+	select {
+	case <-p.done:
+	case <-time.After(killTimeout):
+		log.Printf("[ERROR] Process %s (PID %d) still not reaped after SIGKILL", p.ConfigID, p.Cmd.Process.Pid)
+	}
+}
+
+// endStop lets starts waiting for the instance proceed. Caller must hold m.mu.
+func (m *Manager) endStop(id string) {
+	if done, ok := m.stopping[id]; ok {
+		delete(m.stopping, id)
+		close(done)
+	}
+}
+
+// awaitStopped waits for a stop of the instance in progress to finish,
+// releasing m.mu meanwhile. It returns ErrInstanceRunning if the instance was
+// started again in the meantime. Caller must hold m.mu.
+func (m *Manager) awaitStopped(id string) error {
+	waited := false
+	for {
+		done, ok := m.stopping[id]
+		if !ok {
+			break
+		}
+		waited = true
+		m.mu.Unlock()
+		<-done
+		m.mu.Lock()
+	}
+	if waited && m.running(id) {
+		return ErrInstanceRunning
+	}
+	return nil
+}
+
+// tunName returns the TUN device the instance was started with
+func (p *Process) tunName() string {
+	if p.Type == "client" {
+		return p.ClientCfg.TunName
+	}
+	return p.ServerCfg.TunName
+}
+
+func (p *Process) limits() *config.ResourceLimits {
+	if p.Type == "client" {
+		return p.ClientCfg.Limits
+	}
+	return p.ServerCfg.Limits
+}
+
+// waitTunReleased waits for the kernel to remove the TUN device of an exited
+// process and deletes it explicitly if it lingers
+func (m *Manager) waitTunReleased(name string) {
+	if name == "" {
+		return
+	}
+	if m.tuns.WaitGone(name, tunReleaseTimeout) {
+		return
+	}
+	log.Printf("TUN interface %s still present after process exit, deleting it", name)
+	if err := m.tuns.Delete(name); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// teardown removes the firewall rules of a single instance, whose TUN device
+// awaitExit already waited for. It uses the config the process was started
+// with, so defaults applied at start time are matched exactly. A namespaced
+// instance takes its rules and TUN device with its namespace. Caller must
+// hold m.mu.
+func (m *Manager) teardown(p *Process) {
+	if p.Netns != nil {
+		m.releaseNetns(p)
+		delete(m.netnsSlots, p.ConfigID)
+		releaseLimits(p.ConfigID, p.limits())
+		return
+	}
+	if p.Type == "client" {
+		m.firewall.CleanupClient(p.ClientCfg)
+		if !p.ClientCfg.IPv4Only {
+			m.firewall.CleanupClientIPv6(p.ClientCfg)
+		}
+	} else {
+		m.firewall.CleanupServer(p.ServerCfg)
+		if !p.ServerCfg.IPv4Only {
+			m.firewall.CleanupServerIPv6(p.ServerCfg)
+		}
+	}
+	releaseLimits(p.ConfigID, p.limits())
+}
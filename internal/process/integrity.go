@@ -0,0 +1,272 @@
+package process
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"phantun-docker/internal/config"
+)
+
+// The checksum manifest uses sha256sum format ("<hex digest>  <name>").
+// Names are "phantun_client" / "phantun_server" for the binaries from PATH
+// and "<version>/phantun_client" for registry versions, so it can be created
+// with `cd binaries && sha256sum */phantun_*`.
+
+// Pin is the result of comparing a binary against the manifest
+type Pin string
+
+const (
+	PinVerified Pin = "verified" // Digest matches the manifest
+	PinMismatch Pin = "mismatch" // Digest differs from the manifest
+	PinUnpinned Pin = "unpinned" // Manifest has no entry
+)
+
+// BinaryVerification records what was checked before an instance was launched
+type BinaryVerification struct {
+	Path      string    `json:"path"`
+	SHA256    string    `json:"sha256"`
+	Version   string    `json:"version,omitempty"` // Output of --version
+	Pin       Pin       `json:"pin"`
+	Expected  string    `json:"expected,omitempty"` // Pinned digest on mismatch
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// SetChecksumManifest selects the manifest file. It is re-read on every
+// check, so edits apply without a restart. A missing file pins nothing.
+func (m *Manager) SetChecksumManifest(path string) {
+	m.binariesMu.Lock()
+	m.manifestPath = path
+	m.binariesMu.Unlock()
+}
+
+// loadManifest reads the pinned digests, keyed by manifest name
+func (m *Manager) loadManifest() (map[string]string, error) {
+	m.binariesMu.Lock()
+	file := m.manifestPath
+	m.binariesMu.Unlock()
+	if file == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	pins := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, name, ok := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*") // Binary mode marker
+		if _, err := hex.DecodeString(digest); !ok || err != nil || len(digest) != 64 || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"<sha256>  <name>\"", file, n)
+		}
+		pins[manifestName(name)] = strings.ToLower(digest)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// manifestName normalizes a manifest entry, e.g. "./v1/phantun_client"
+func manifestName(name string) string {
+	return strings.TrimPrefix(path.Clean(name), "./")
+}
+
+// pinName is the manifest name of binary at a registry version ("" for PATH)
+func pinName(binary, version string) string {
+	if version == "" {
+		return binary
+	}
+	return version + "/" + binary
+}
+
+// checkPin compares a digest with the manifest entry for name
+func checkPin(pins map[string]string, name, digest string) (Pin, string) {
+	expected, ok := pins[name]
+	switch {
+	case !ok:
+		return PinUnpinned, ""
+	case expected != digest:
+		return PinMismatch, expected
+	}
+	return PinVerified, ""
+}
+
+// verifyBinary checks the binary an instance is about to launch against the
+// manifest. A mismatch is an error under the refuse policy and a warning
+// otherwise. Returns nil if the binary cannot be found; launching it reports
+// that. The digest comes from the describeBinary cache, which
+// prepareBinaries fills before m.mu is taken.
+func (m *Manager) verifyBinary(alias, binary, version, resolved string) (*BinaryVerification, error) {
+	file, ok := locateBinary(resolved, version)
+	if !ok {
+		return nil, nil
+	}
+
+	info := m.describeBinary(file)
+	if info.SHA256 == "" {
+		return nil, fmt.Errorf("failed to hash %s: %s", file, info.Error)
+	}
+	v := &BinaryVerification{
+		Path:      file,
+		SHA256:    info.SHA256,
+		Version:   info.Version,
+		CheckedAt: time.Now(),
+	}
+
+	pins, err := m.loadManifest()
+	if err != nil {
+		if m.conf.General.Integrity.Policy == config.IntegrityRefuse {
+			return v, fmt.Errorf("checksum manifest unreadable: %w", err)
+		}
+		log.Printf("[WARNING] Checksum manifest unreadable, %s not verified: %v", alias, err)
+		v.Pin = PinUnpinned
+		return v, nil
+	}
+
+	v.Pin, v.Expected = checkPin(pins, pinName(binary, version), v.SHA256)
+	if v.Pin == PinMismatch {
+		err := fmt.Errorf("%s SHA-256 %s does not match pinned %s", file, v.SHA256, v.Expected)
+		if m.conf.General.Integrity.Policy == config.IntegrityRefuse {
+			return v, err
+		}
+		log.Printf("[WARNING] Instance %s: %v", alias, err)
+	}
+	return v, nil
+}
+
+// locateBinary returns the file a resolved binary runs, looking up PATH
+// binaries (version "")
+func locateBinary(resolved, version string) (string, bool) {
+	if version != "" {
+		return resolved, true
+	}
+	file, err := exec.LookPath(resolved)
+	return file, err == nil
+}
+
+// prepareBinaries hashes and probes the binaries of the given instances, or
+// of all configured ones, so that starting them finds the results cached
+// instead of reading whole files with m.mu held. Caller must not hold m.mu.
+func (m *Manager) prepareBinaries(ids ...string) {
+	want := func(id string) bool {
+		if len(ids) == 0 {
+			return true
+		}
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	type binaryRef struct{ binary, version string }
+	var refs []binaryRef
+	m.mu.Lock()
+	for _, c := range m.conf.Clients {
+		if want(c.ID) {
+			refs = append(refs, binaryRef{"phantun_client", c.Binary})
+		}
+	}
+	for _, s := range m.conf.Servers {
+		if want(s.ID) {
+			refs = append(refs, binaryRef{"phantun_server", s.Binary})
+		}
+	}
+	m.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		resolved, err := m.resolveBinary(ref.binary, ref.version)
+		if err != nil {
+			continue
+		}
+		if file, ok := locateBinary(resolved, ref.version); ok && !seen[file] {
+			seen[file] = true
+			m.describeBinary(file)
+		}
+	}
+}
+
+// pinBinaries records the digests of freshly installed registry files in the
+// manifest, replacing their old entries. Returns the previous manifest
+// content for writeManifest.
+func (m *Manager) pinBinaries(version string, files map[string][]byte) ([]byte, error) {
+	m.binariesMu.Lock()
+	file := m.manifestPath
+	m.binariesMu.Unlock()
+	if file == "" {
+		return nil, fmt.Errorf("no checksum manifest configured")
+	}
+
+	prev, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pinned := make(map[string]string)
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		pinned[pinName(name, version)] = hex.EncodeToString(sum[:])
+	}
+
+	var out []string
+	for _, line := range strings.Split(strings.TrimRight(string(prev), "\n"), "\n") {
+		if line == "" && len(out) == 0 {
+			continue
+		}
+		if _, name, ok := strings.Cut(strings.TrimSpace(line), " "); ok {
+			name = manifestName(strings.TrimPrefix(strings.TrimSpace(name), "*"))
+			if _, replaced := pinned[name]; replaced {
+				continue
+			}
+		}
+		out = append(out, line)
+	}
+	names := make([]string, 0, len(pinned))
+	for name := range pinned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, pinned[name]+"  "+name)
+	}
+
+	if err := m.writeManifest([]byte(strings.Join(out, "\n") + "\n")); err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
+
+// writeManifest atomically replaces the manifest content
+func (m *Manager) writeManifest(data []byte) error {
+	m.binariesMu.Lock()
+	file := m.manifestPath
+	m.binariesMu.Unlock()
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,189 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+const cpuPeriodMicros = 100000 // cgroup cpu.max period
+
+// LimitsEnv makes the manager binary a launch shim: it applies the limits in
+// the variable to itself and then execs its arguments, so phantun runs limited
+// from its first instruction
+const LimitsEnv = "PHANTUN_LIMITS"
+
+// launchLimits is the content of LimitsEnv
+type launchLimits struct {
+	Limits   config.ResourceLimits `json:"limits"`
+	StatusFD int                   `json:"status_fd"` // Gets the error if the limits cannot be applied
+}
+
+// prepareLimits creates the instance's cgroup, if its limits need one, and
+// makes cmd start inside it. Per-process limits are applied by running cmd
+// through the launch shim. The returned function must be called once
+// cmd.Start has returned; if the process started, it waits for the shim to
+// exec and returns why the limits could not be applied.
+func prepareLimits(id string, l *config.ResourceLimits, cmd *exec.Cmd) (func(started bool) error, error) {
+	var closers []io.Closer
+	release := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	if l.NeedsCgroup() {
+		cpuMax := ""
+		if l.CPUPercent > 0 {
+			cpuMax = fmt.Sprintf("%d %d", l.CPUPercent*cpuPeriodMicros/100, cpuPeriodMicros)
+		}
+		memoryMax := ""
+		if l.MemoryMaxMB > 0 {
+			memoryMax = strconv.FormatUint(l.MemoryMaxMB<<20, 10)
+		}
+		dir, err := system.CreateCgroup(id, cpuMax, memoryMax)
+		if err != nil {
+			return nil, err
+		}
+
+		// Joining at clone time leaves no window where the process runs unconfined
+		f, err := os.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, f)
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	}
+
+	if !needsShim(l) || cmd.Err != nil {
+		return func(bool) error { release(); return nil }, nil
+	}
+	status, w, err := wrapLimits(l, cmd)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	closers = append(closers, w)
+	return func(started bool) error {
+		release()
+		defer status.Close()
+		if !started {
+			return nil
+		}
+		// The pipe closes on exec; anything written before is the shim's error
+		msg, _ := io.ReadAll(status)
+		if len(msg) > 0 {
+			return errors.New(string(msg))
+		}
+		return nil
+	}, nil
+}
+
+// needsShim reports whether the limits include per-process settings
+func needsShim(l *config.ResourceLimits) bool {
+	return l != nil && (l.Nice != 0 || l.CPUAffinity != "" || l.MaxOpenFiles > 0 ||
+		l.MaxAddressSpaceMB > 0 || l.OOMScoreAdj != 0)
+}
+
+// wrapLimits makes cmd run through the launch shim and returns both ends of
+// its status pipe
+func wrapLimits(l *config.ResourceLimits, cmd *exec.Cmd) (r, w *os.File, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	if r, w, err = os.Pipe(); err != nil {
+		return nil, nil, err
+	}
+	spec, _ := json.Marshal(launchLimits{Limits: *l, StatusFD: 3 + len(cmd.ExtraFiles)})
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(cmd.Environ(), LimitsEnv+"="+string(spec))
+	cmd.Args = append([]string{exe, cmd.Path}, cmd.Args...)
+	cmd.Path = exe
+	return r, w, nil
+}
+
+// RunLimitedIfRequested acts as the launch shim when LimitsEnv is set and
+// never returns in that case. Call it first thing in main (or TestMain).
+func RunLimitedIfRequested() {
+	spec, ok := os.LookupEnv(LimitsEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(LimitsEnv)
+
+	var ll launchLimits
+	if err := json.Unmarshal([]byte(spec), &ll); err != nil || len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, "invalid %s launch: %v\n", LimitsEnv, err)
+		os.Exit(127)
+	}
+	status := os.NewFile(uintptr(ll.StatusFD), "status")
+
+	// Nice and affinity are per thread; exec keeps only this one
+	runtime.LockOSThread()
+	err := applyLimits(os.Getpid(), &ll.Limits)
+	if err == nil {
+		syscall.CloseOnExec(ll.StatusFD)
+		err = syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+	}
+	fmt.Fprint(status, err)
+	os.Exit(127)
+}
+
+// applyLimits applies the per-process limits to a process
+func applyLimits(pid int, l *config.ResourceLimits) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxOpenFiles > 0 {
+		if err := system.SetRlimit(pid, syscall.RLIMIT_NOFILE, l.MaxOpenFiles); err != nil {
+			return fmt.Errorf("failed to set RLIMIT_NOFILE: %w", err)
+		}
+	}
+	if l.MaxAddressSpaceMB > 0 {
+		if err := system.SetRlimit(pid, syscall.RLIMIT_AS, l.MaxAddressSpaceMB<<20); err != nil {
+			return fmt.Errorf("failed to set RLIMIT_AS: %w", err)
+		}
+	}
+	if l.Nice != 0 {
+		if err := system.SetNice(pid, l.Nice); err != nil {
+			return fmt.Errorf("failed to set nice %d: %w", l.Nice, err)
+		}
+	}
+	if l.CPUAffinity != "" {
+		cpus, err := config.ParseCPUList(l.CPUAffinity)
+		if err == nil {
+			err = system.SetCPUAffinity(pid, cpus)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set CPU affinity %q: %w", l.CPUAffinity, err)
+		}
+	}
+	if l.OOMScoreAdj != 0 {
+		if err := system.SetOOMScoreAdj(pid, l.OOMScoreAdj); err != nil {
+			return fmt.Errorf("failed to set oom_score_adj: %w", err)
+		}
+	}
+	return nil
+}
+
+// releaseLimits removes the instance's cgroup once its process is gone
+func releaseLimits(id string, l *config.ResourceLimits) {
+	if l.NeedsCgroup() {
+		system.RemoveCgroup(id)
+	}
+}
@@ -0,0 +1,82 @@
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/logstore"
+)
+
+// Log store defaults, used when the matching LogStoreConfig field is zero
+const (
+	defaultLogFileMB        = 10
+	defaultLogRotateHours   = 24
+	defaultLogRetentionDays = 7
+	defaultLogTotalMB       = 200
+)
+
+// OpenLogStore starts persisting every log message to one file per instance
+// (plus "system") under dir. It must be called before any process is started.
+// Turning the store on or off takes effect on the next manager start.
+func (m *Manager) OpenLogStore(dir string) error {
+	m.mu.Lock()
+	settings := m.conf.General.Logs
+	m.mu.Unlock()
+	if settings.Disabled {
+		return nil
+	}
+	store, err := logstore.Open(dir, logStoreOptions(settings))
+	if err != nil {
+		return err
+	}
+	m.logStore = store
+	return nil
+}
+
+// CloseLogStore flushes and closes the log files
+func (m *Manager) CloseLogStore() {
+	if m.logStore != nil {
+		m.logStore.Close()
+	}
+}
+
+// applyLogStoreSettings pushes rotation and retention changes to the open store
+func (m *Manager) applyLogStoreSettings() {
+	if m.logStore != nil {
+		m.logStore.SetOptions(logStoreOptions(m.conf.General.Logs))
+	}
+}
+
+// persistLog appends a message to its instance's log file
+func (m *Manager) persistLog(msg LogMessage) {
+	if m.logStore == nil {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := m.logStore.Append(msg.ProcessID, data); err != nil {
+		// Not via log: that would feed back into BroadcastLog
+		fmt.Fprintf(os.Stderr, "Warning: Failed to persist log for %s: %v\n", msg.ProcessID, err)
+	}
+}
+
+func logStoreOptions(c config.LogStoreConfig) logstore.Options {
+	or := func(v, def int) int {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+	return logstore.Options{
+		MaxFileBytes:   int64(or(c.MaxFileMB, defaultLogFileMB)) << 20,
+		RotateInterval: time.Duration(or(c.RotateHours, defaultLogRotateHours)) * time.Hour,
+		Retention:      time.Duration(or(c.RetentionDays, defaultLogRetentionDays)) * 24 * time.Hour,
+		MaxTotalBytes:  int64(or(c.MaxTotalMB, defaultLogTotalMB)) << 20,
+		Compress:       c.Compress,
+	}
+}
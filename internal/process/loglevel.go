@@ -0,0 +1,54 @@
+package process
+
+import (
+	"os"
+	"strings"
+)
+
+// Severity order of log levels, most severe first
+var levelRank = map[string]int{
+	"error": 0,
+	"warn":  1,
+	"info":  2,
+	"debug": 3,
+	"trace": 4,
+}
+
+// LogEnabled reports whether a manager message of the given level passes the
+// global log_level. Unknown levels are always shown.
+func (m *Manager) LogEnabled(level string) bool {
+	rank, ok := levelRank[level]
+	if !ok {
+		return true
+	}
+	global := m.logLevel.Load().(string)
+	max, ok := levelRank[strings.ToLower(global)]
+	if !ok {
+		if strings.EqualFold(global, "off") {
+			return false
+		}
+		max = levelRank["info"]
+	}
+	return rank <= max
+}
+
+// rustLog returns the RUST_LOG filter for an instance: its own override,
+// else the global log_level, else whatever the container was started with.
+// Caller must hold m.mu.
+func (m *Manager) rustLog(override string) string {
+	return resolveRustLog(override, m.conf.General.LogLevel)
+}
+
+// resolveRustLog is rustLog against the given global log_level
+func resolveRustLog(override, global string) string {
+	if override != "" {
+		return override
+	}
+	if global != "" {
+		return strings.ToLower(global)
+	}
+	if env := os.Getenv("RUST_LOG"); env != "" {
+		return env
+	}
+	return "info"
+}
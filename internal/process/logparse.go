@@ -0,0 +1,110 @@
+package process
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Longer lines are truncated; phantun never logs anything near this size
+const maxLogLineBytes = 64 * 1024
+
+var (
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+	// env_logger:        [2024-01-02T03:04:05Z INFO  phantun::server] message
+	envLoggerLine = regexp.MustCompile(`^\[(?:(\S+)\s+)?(TRACE|DEBUG|INFO|WARN|ERROR)\s+([^\]\s]+)\s*\]\s?(.*)$`)
+	// pretty_env_logger: 2024-01-02T03:04:05.678Z INFO  phantun::server > message
+	prettyLoggerLine = regexp.MustCompile(`^(?:(\S+)\s+)?(TRACE|DEBUG|INFO|WARN|ERROR)\s+(\S+)\s+>\s?(.*)$`)
+	// tracing fmt:       2024-01-02T03:04:05.678901Z  INFO phantun::server: message
+	tracingLine = regexp.MustCompile(`^(?:(\S+)\s+)?(TRACE|DEBUG|INFO|WARN|ERROR)\s+([\w:]+):\s(.*)$`)
+
+	// Go log package:    2024/01/02 03:04:05 message
+	stdLogLine = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})\s(.*)$`)
+)
+
+// NewLogMessage builds a log entry from a single line of output. Lines in the
+// env_logger, pretty_env_logger or tracing format are split into timestamp,
+// level, target and message; the raw line is always kept in Content.
+func NewLogMessage(processID, stream, line string) LogMessage {
+	line = strings.TrimRight(ansiEscape.ReplaceAllString(line, ""), "\r\n")
+	msg := LogMessage{
+		Timestamp: time.Now(),
+		ProcessID: processID,
+		Stream:    stream,
+		Content:   line,
+		Message:   line,
+	}
+
+	trimmed := strings.TrimLeft(line, " \t") // pretty_env_logger pads the level
+	for _, re := range []*regexp.Regexp{envLoggerLine, prettyLoggerLine, tracingLine} {
+		if m := re.FindStringSubmatch(trimmed); m != nil {
+			msg.LoggedAt = parseLogTime(m[1])
+			msg.Level = strings.ToLower(m[2])
+			msg.Target = m[3]
+			msg.Message = m[4]
+			return msg
+		}
+	}
+
+	// Our own log.Printf output
+	if m := stdLogLine.FindStringSubmatch(line); m != nil {
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local); err == nil {
+			msg.LoggedAt = &t
+		}
+		msg.Message = m[2]
+		msg.Level = guessLevel(m[2])
+	}
+	return msg
+}
+
+// guessLevel classifies manager messages by their conventional prefixes
+func guessLevel(s string) string {
+	switch {
+	case strings.HasPrefix(s, "[ERROR]"), strings.HasPrefix(s, "CRITICAL"):
+		return "error"
+	case strings.HasPrefix(s, "[WARNING]"), strings.HasPrefix(s, "Warning:"):
+		return "warn"
+	case strings.HasPrefix(s, "[DEBUG]"):
+		return "debug"
+	}
+	return "info"
+}
+
+func parseLogTime(s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// readLines calls emit for every complete line read from r, and once more for
+// a trailing line without newline. Blank lines are skipped.
+func readLines(r io.Reader, emit func(line string)) {
+	br := bufio.NewReader(r)
+	var buf []byte
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if len(buf) > 0 {
+				emit(string(buf))
+			}
+			return
+		}
+		if len(buf)+len(chunk) <= maxLogLineBytes {
+			buf = append(buf, chunk...)
+		}
+		if !isPrefix {
+			if strings.TrimSpace(string(buf)) != "" {
+				emit(string(buf))
+			}
+			buf = buf[:0]
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package process
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"phantun-docker/internal/logstore"
+)
+
+const (
+	DefaultLogLimit = 100
+	MaxLogLimit     = 1000
+)
+
+// maxCursorSkip bounds the entries at one timestamp a cursor may skip. Real
+// cursors stay far below it; larger ones would make the scan unbounded.
+const maxCursorSkip = 10 * MaxLogLimit
+
+// logFileSlack allows for records stamped later than the modification time of
+// their file, e.g. after a small clock adjustment
+const logFileSlack = time.Second
+
+// LogFilter selects log messages. Zero fields match everything.
+type LogFilter struct {
+	ProcessIDs []string       // Any of these process IDs ("system" for the manager)
+	Streams    []string       // Any of "stdout", "stderr"
+	MinLevel   string         // At least this severity; lines without a level are excluded
+	Since      time.Time      // Inclusive
+	Until      time.Time      // Exclusive
+	Text       string         // Case-insensitive substring of the raw line
+	Regex      *regexp.Regexp // Matched against the raw line
+}
+
+// Match reports whether msg passes the filter
+func (f LogFilter) Match(msg LogMessage) bool {
+	if len(f.ProcessIDs) > 0 && !contains(f.ProcessIDs, msg.ProcessID) {
+		return false
+	}
+	if len(f.Streams) > 0 && !contains(f.Streams, msg.Stream) {
+		return false
+	}
+	if f.MinLevel != "" {
+		rank, ok := levelRank[msg.Level]
+		if !ok || rank > levelRank[f.MinLevel] {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && msg.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !msg.Timestamp.Before(f.Until) {
+		return false
+	}
+	if f.Text != "" && !strings.Contains(strings.ToLower(msg.Content), strings.ToLower(f.Text)) {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(msg.Content) {
+		return false
+	}
+	return true
+}
+
+// ValidLogLevel reports whether level can be used as LogFilter.MinLevel
+func ValidLogLevel(level string) bool {
+	_, ok := levelRank[level]
+	return ok
+}
+
+// LogPage is one page of log history, newest first
+type LogPage struct {
+	Entries    []LogMessage `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"` // Pass back to get older entries
+	HasMore    bool         `json:"has_more"`
+}
+
+// logCursor points just past the last entry of a page: entries older than
+// Timestamp, or at Timestamp after skipping Skip of them
+type logCursor struct {
+	Timestamp int64 `json:"t"`
+	Skip      int   `json:"s"`
+}
+
+// LogHistory returns matching log messages, newest first. History comes from
+// the log files when the store is enabled, else from the in-memory buffer.
+func (m *Manager) LogHistory(f LogFilter, cursor string, limit int) (LogPage, error) {
+	if limit <= 0 {
+		limit = DefaultLogLimit
+	}
+	if limit > MaxLogLimit {
+		limit = MaxLogLimit
+	}
+
+	var cur *logCursor
+	if cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return LogPage{}, err
+		}
+		cur = &c
+	}
+
+	// Keep only the newest entries we can possibly return
+	need := limit + 1
+	if cur != nil {
+		need += cur.Skip
+	}
+	var found []LogMessage
+	compact := func() {
+		sort.SliceStable(found, func(i, j int) bool { return found[i].Timestamp.After(found[j].Timestamp) })
+		if len(found) > need {
+			found = found[:need]
+		}
+	}
+	collect := func(msg LogMessage) bool {
+		if !f.Match(msg) {
+			return false
+		}
+		if cur != nil && msg.Timestamp.UnixNano() > cur.Timestamp {
+			return false
+		}
+		found = append(found, msg)
+		if len(found) >= 4*need {
+			compact()
+		}
+		return true
+	}
+
+	if m.logStore != nil {
+		if err := m.scanLogFiles(f, need, collect); err != nil {
+			return LogPage{}, err
+		}
+	} else {
+		m.logClientsMu.Lock()
+		for _, msg := range m.logBuffer {
+			collect(msg)
+		}
+		m.logClientsMu.Unlock()
+	}
+	compact()
+
+	// Skip the entries at the cursor timestamp that the previous page returned
+	if cur != nil {
+		skipped := 0
+		kept := found[:0]
+		for _, msg := range found {
+			if msg.Timestamp.UnixNano() == cur.Timestamp && skipped < cur.Skip {
+				skipped++
+				continue
+			}
+			kept = append(kept, msg)
+		}
+		found = kept
+	}
+
+	page := LogPage{Entries: found}
+	if len(found) > limit {
+		page.Entries = found[:limit]
+		page.HasMore = true
+		page.NextCursor = encodeCursor(page.Entries, cur)
+	}
+	if page.Entries == nil {
+		page.Entries = []LogMessage{}
+	}
+	return page, nil
+}
+
+// scanLogFiles feeds the records of the relevant log files to collect, newest
+// file first. A stream's older files are skipped once it yielded need
+// collected entries newer than anything those files can hold.
+func (m *Manager) scanLogFiles(f LogFilter, need int, collect func(LogMessage) bool) error {
+	streams := f.ProcessIDs
+	if len(streams) == 0 {
+		var err error
+		if streams, err = m.logStore.Streams(); err != nil {
+			return err
+		}
+	}
+
+	for _, stream := range streams {
+		files, err := m.logStore.Files(stream)
+		if err != nil {
+			return err
+		}
+		var times []int64 // Of the entries collected from this stream
+		for i := len(files) - 1; i >= 0; i-- {
+			fi := files[i]
+			// A file last written before the window cannot contain matches, nor can older ones
+			if !f.Since.IsZero() && fi.ModTime.Before(f.Since) {
+				break
+			}
+			err := scanLogFile(fi, func(msg LogMessage) {
+				if collect(msg) {
+					times = append(times, msg.Timestamp.UnixNano())
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", fi.Name, err)
+			}
+			if i > 0 && len(times) >= need && pageFull(times, need, files[i-1].ModTime) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// pageFull reports whether the need newest of times are all newer than the
+// last write to an older file, so that file cannot contribute to the page
+func pageFull(times []int64, need int, olderModTime time.Time) bool {
+	sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+	return times[need-1] > olderModTime.Add(logFileSlack).UnixNano()
+}
+
+func scanLogFile(fi logstore.FileInfo, fn func(LogMessage)) error {
+	rc, err := logstore.OpenFile(fi)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 2*maxLogLineBytes)
+	for sc.Scan() {
+		var msg LogMessage
+		if json.Unmarshal(sc.Bytes(), &msg) == nil {
+			fn(msg)
+		}
+	}
+	return sc.Err()
+}
+
+// encodeCursor builds the cursor that continues after the last entry of a page
+func encodeCursor(entries []LogMessage, prev *logCursor) string {
+	last := entries[len(entries)-1].Timestamp.UnixNano()
+	c := logCursor{Timestamp: last}
+	for _, msg := range entries {
+		if msg.Timestamp.UnixNano() == last {
+			c.Skip++
+		}
+	}
+	// Entries at the same timestamp skipped by the previous page are still skipped
+	if prev != nil && prev.Timestamp == last {
+		c.Skip += prev.Skip
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (logCursor, error) {
+	var c logCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Skip < 0 || c.Skip > maxCursorSkip {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// ParseLogTime accepts RFC 3339 timestamps or Unix seconds
+func ParseLogTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package process
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/system"
+)
+
+const defaultNetnsPool = "10.231.0.0/16"
+
+// unsafeNameChars are replaced in names derived from instance IDs
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// netnsName is the namespace name of an instance
+func netnsName(id string) string {
+	return system.NetnsPrefix + unsafeNameChars.ReplaceAllString(id, "_")
+}
+
+// createNetns sets up the namespace of an instance, reusing its slot if it
+// already has one (e.g. when restarting after a crash). Caller must hold m.mu.
+func (m *Manager) createNetns(id string) (*system.Netns, error) {
+	slot, ok := m.netnsSlots[id]
+	if !ok {
+		used := make(map[int]bool)
+		for _, s := range m.netnsSlots {
+			used[s] = true
+		}
+		for used[slot] {
+			slot++
+		}
+	}
+
+	pool := m.conf.General.Netns.Pool
+	if pool == "" {
+		pool = defaultNetnsPool
+	}
+	hostAddr, nsAddr, err := system.NetnsSlot(pool, slot)
+	if err != nil {
+		return nil, err
+	}
+	n := &system.Netns{
+		Name:      netnsName(id),
+		HostVeth:  fmt.Sprintf("phv%d", slot),
+		HostAddr:  hostAddr,
+		NsAddr:    nsAddr,
+		PrefixLen: 30,
+	}
+	if err := m.netns.Create(*n); err != nil {
+		return nil, err
+	}
+	m.netnsSlots[id] = slot
+	return n, nil
+}
+
+// setupClientNetns creates the namespace of a client configured for one and
+// installs its rules. It returns nil when the client runs on the host. The
+// client is switched to IPv4 only, and a loopback listen address becomes the
+// namespace's eth0 address, which the host reaches over the veth pair.
+// Caller must hold m.mu.
+func (m *Manager) setupClientNetns(c *config.ClientConfig) (*system.Netns, error) {
+	if !c.Netns {
+		return nil, nil
+	}
+	ns, err := m.createNetns(c.ID)
+	if err != nil {
+		return nil, fmt.Errorf("network namespace setup failed: %w", err)
+	}
+	c.IPv4Only = true
+	if isLoopback(c.LocalAddr) {
+		c.LocalAddr = ns.NsAddr
+	}
+	if err := m.firewall.SetupClientNetns(*ns, *c); err != nil {
+		m.netns.Delete(ns.Name)
+		delete(m.netnsSlots, c.ID)
+		return nil, fmt.Errorf("iptables setup failed: %w", err)
+	}
+	return ns, nil
+}
+
+// setupServerNetns is the server counterpart of setupClientNetns. A loopback
+// forward target becomes the host end of the veth pair.
+func (m *Manager) setupServerNetns(s *config.ServerConfig) (*system.Netns, error) {
+	if !s.Netns {
+		return nil, nil
+	}
+	ns, err := m.createNetns(s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("network namespace setup failed: %w", err)
+	}
+	s.IPv4Only = true
+	if isLoopback(s.RemoteAddr) {
+		s.RemoteAddr = ns.HostAddr
+	}
+	if err := m.firewall.SetupServerNetns(*ns, *s); err != nil {
+		m.netns.Delete(ns.Name)
+		delete(m.netnsSlots, s.ID)
+		return nil, fmt.Errorf("iptables setup failed: %w", err)
+	}
+	return ns, nil
+}
+
+// releaseNetns removes the host side rules and deletes the namespace of an
+// exited process, taking its TUN device and rules with it
+func (m *Manager) releaseNetns(p *Process) {
+	if p.Type == "client" {
+		m.firewall.CleanupClientNetns(*p.Netns, p.ClientCfg)
+	} else {
+		m.firewall.CleanupServerNetns(*p.Netns, p.ServerCfg)
+	}
+	if err := m.netns.Delete(p.Netns.Name); err != nil {
+		log.Printf("[WARNING] Failed to delete network namespace %s: %v", p.Netns.Name, err)
+	}
+}
+
+// cleanupUnusedNetns deletes namespaces left behind by instances that are no
+// longer running in one. Caller must hold m.mu.
+func (m *Manager) cleanupUnusedNetns() {
+	names, err := m.netns.List()
+	if err != nil {
+		log.Printf("Warning: Failed to list network namespaces: %v", err)
+		return
+	}
+	keep := make(map[string]bool)
+	for id, p := range m.processes {
+		if p.Netns != nil {
+			keep[netnsName(id)] = true
+		}
+	}
+	for _, name := range names {
+		if !keep[name] {
+			log.Printf("Cleaning up stale network namespace: %s", name)
+			m.netns.Delete(name)
+		}
+	}
+	for id := range m.netnsSlots {
+		if _, running := m.processes[id]; !running {
+			delete(m.netnsSlots, id)
+		}
+	}
+}
+
+// isLoopback reports whether addr is a loopback address or "localhost"
+func isLoopback(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
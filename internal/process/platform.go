@@ -0,0 +1,316 @@
+package process
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/iptables"
+	"phantun-docker/internal/nftables"
+	"phantun-docker/internal/system"
+)
+
+// Runner creates the commands that launch phantun binaries
+type Runner interface {
+	Command(binary string, args ...string) *exec.Cmd
+}
+
+// Firewall installs and removes the NAT rules of an instance
+type Firewall interface {
+	SetupClient(c config.ClientConfig) error
+	SetupClientIPv6(c config.ClientConfig) error
+	CleanupClient(c config.ClientConfig) error
+	CleanupClientIPv6(c config.ClientConfig) error
+	SetupServer(s config.ServerConfig) error
+	SetupServerIPv6(s config.ServerConfig) error
+	CleanupServer(s config.ServerConfig) error
+	CleanupServerIPv6(s config.ServerConfig) error
+	CleanupInstance(id string) error // Removes exactly the host rules tagged for the instance
+	CleanupAll() error
+
+	// Namespace mode: rules inside the instance's namespace plus the host side
+	SetupClientNetns(n system.Netns, c config.ClientConfig) error
+	CleanupClientNetns(n system.Netns, c config.ClientConfig) error
+	SetupServerNetns(n system.Netns, s config.ServerConfig) error
+	CleanupServerNetns(n system.Netns, s config.ServerConfig) error
+
+	// Inspection
+	Name() string                   // Backend name, e.g. "iptables"
+	Rules() (string, error)         // Current rules in the backend's own format
+	Stats() (map[string]int, error) // Rule counts: "masquerade", "dnat" and "total"
+
+	// ListRules returns the rules in the manager's chains or table and every
+	// other rule carrying its tag, parsed with their owner
+	ListRules() ([]system.FirewallRule, error)
+}
+
+// firewallBatch is implemented by backends that can defer the host rules of
+// several instances and apply them in one transaction
+type firewallBatch interface {
+	BeginBatch()
+	CommitBatch() map[string]error // Instances whose rules were rolled back
+}
+
+// TunDevices manages the TUN interfaces phantun creates
+type TunDevices interface {
+	CleanupUnused(allowed []string) error
+	Delete(name string) error
+	WaitGone(name string, timeout time.Duration) bool
+}
+
+// Namespaces manages the network namespaces of isolated instances
+type Namespaces interface {
+	Create(n system.Netns) error
+	Delete(name string) error
+	List() ([]string, error)
+	Command(name string, cmd *exec.Cmd) error // Makes cmd run inside the namespace
+}
+
+// Readiness inspects a freshly started instance
+type Readiness interface {
+	TunReady(netns, name string, addrs []string) error // nil once the device is UP with every address
+	UDPBound(pid, port int) error                      // nil once the port is bound in the process's namespace
+}
+
+// Options replaces the parts of the manager that touch the host.
+// Nil fields select the real implementations.
+type Options struct {
+	Runner     Runner
+	Firewall   Firewall
+	Tuns       TunDevices
+	Namespaces Namespaces
+	Readiness  Readiness
+}
+
+// ExecRunner runs the phantun binaries found in PATH
+type ExecRunner struct{}
+
+func (ExecRunner) Command(binary string, args ...string) *exec.Cmd {
+	return exec.Command(binary, args...)
+}
+
+// IptablesFirewall applies rules with iptables and ip6tables
+type IptablesFirewall struct{}
+
+func (IptablesFirewall) SetupClient(c config.ClientConfig) error { return iptables.SetupClient(c) }
+func (IptablesFirewall) SetupClientIPv6(c config.ClientConfig) error {
+	return iptables.SetupClientIPv6(c)
+}
+func (IptablesFirewall) CleanupClient(c config.ClientConfig) error { return iptables.CleanupClient(c) }
+func (IptablesFirewall) CleanupClientIPv6(c config.ClientConfig) error {
+	return iptables.CleanupClientIPv6(c)
+}
+func (IptablesFirewall) SetupServer(s config.ServerConfig) error { return iptables.SetupServer(s) }
+func (IptablesFirewall) SetupServerIPv6(s config.ServerConfig) error {
+	return iptables.SetupServerIPv6(s)
+}
+func (IptablesFirewall) CleanupServer(s config.ServerConfig) error { return iptables.CleanupServer(s) }
+func (IptablesFirewall) CleanupServerIPv6(s config.ServerConfig) error {
+	return iptables.CleanupServerIPv6(s)
+}
+func (IptablesFirewall) CleanupInstance(id string) error { return iptables.CleanupInstance(id) }
+func (IptablesFirewall) CleanupAll() error               { return iptables.CleanupAll() }
+func (IptablesFirewall) SetupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return iptables.SetupClientNetns(n, c)
+}
+func (IptablesFirewall) CleanupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return iptables.CleanupClientNetns(n, c)
+}
+func (IptablesFirewall) SetupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return iptables.SetupServerNetns(n, s)
+}
+func (IptablesFirewall) CleanupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return iptables.CleanupServerNetns(n, s)
+}
+func (IptablesFirewall) Name() string                   { return string(config.FirewallIptables) }
+func (IptablesFirewall) Rules() (string, error)         { return iptables.GetRules() }
+func (IptablesFirewall) Stats() (map[string]int, error) { return iptables.GetStats() }
+func (IptablesFirewall) ListRules() ([]system.FirewallRule, error) {
+	return iptables.ListRules()
+}
+func (IptablesFirewall) BeginBatch()                   { iptables.Begin() }
+func (IptablesFirewall) CommitBatch() map[string]error { return iptables.Commit() }
+
+// NftablesFirewall applies rules natively with nft, in the "inet phantun" table
+type NftablesFirewall struct{}
+
+func (NftablesFirewall) SetupClient(c config.ClientConfig) error { return nftables.SetupClient(c) }
+func (NftablesFirewall) SetupClientIPv6(c config.ClientConfig) error {
+	return nftables.SetupClientIPv6(c)
+}
+func (NftablesFirewall) CleanupClient(c config.ClientConfig) error { return nftables.CleanupClient(c) }
+func (NftablesFirewall) CleanupClientIPv6(c config.ClientConfig) error {
+	return nftables.CleanupClientIPv6(c)
+}
+func (NftablesFirewall) SetupServer(s config.ServerConfig) error { return nftables.SetupServer(s) }
+func (NftablesFirewall) SetupServerIPv6(s config.ServerConfig) error {
+	return nftables.SetupServerIPv6(s)
+}
+func (NftablesFirewall) CleanupServer(s config.ServerConfig) error { return nftables.CleanupServer(s) }
+func (NftablesFirewall) CleanupServerIPv6(s config.ServerConfig) error {
+	return nftables.CleanupServerIPv6(s)
+}
+func (NftablesFirewall) CleanupInstance(id string) error { return nftables.CleanupInstance(id) }
+func (NftablesFirewall) CleanupAll() error               { return nftables.CleanupAll() }
+func (NftablesFirewall) SetupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return nftables.SetupClientNetns(n, c)
+}
+func (NftablesFirewall) CleanupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return nftables.CleanupClientNetns(n, c)
+}
+func (NftablesFirewall) SetupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return nftables.SetupServerNetns(n, s)
+}
+func (NftablesFirewall) CleanupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return nftables.CleanupServerNetns(n, s)
+}
+func (NftablesFirewall) Name() string                   { return string(config.FirewallNftables) }
+func (NftablesFirewall) Rules() (string, error)         { return nftables.GetRules() }
+func (NftablesFirewall) Stats() (map[string]int, error) { return nftables.GetStats() }
+func (NftablesFirewall) ListRules() ([]system.FirewallRule, error) {
+	return nftables.ListRules()
+}
+
+// SelectFirewall returns the configured backend. Auto picks nftables when nft
+// works and iptables is missing or only the nf_tables shim, unless the
+// iptables FORWARD policy drops: the accepts in the phantun table cannot
+// override it, so server forwarding would break.
+func SelectFirewall(backend config.FirewallBackend) Firewall {
+	switch backend {
+	case config.FirewallIptables:
+		return IptablesFirewall{}
+	case config.FirewallNftables:
+		if forwardDrops() {
+			log.Println("[WARNING] The iptables FORWARD policy is DROP, which the nftables backend cannot override; forwarding to server instances may be blocked. Consider the iptables backend.")
+		}
+		return NftablesFirewall{}
+	}
+	if !nftables.Available() {
+		return IptablesFirewall{}
+	}
+	if variant, err := iptables.Variant(); err == nil && variant == "legacy" {
+		return IptablesFirewall{}
+	}
+	if forwardDrops() {
+		log.Println("Firewall backend auto: the iptables FORWARD policy is DROP, using iptables instead of nftables")
+		return IptablesFirewall{}
+	}
+	return NftablesFirewall{}
+}
+
+// forwardDrops reports whether iptables is installed with a dropping FORWARD policy
+func forwardDrops() bool {
+	policy, err := iptables.ForwardPolicy()
+	return err == nil && policy == "DROP"
+}
+
+// cleanupOtherFirewall removes the leftovers of the backend that is not
+// active, e.g. from a run before auto selection switched backends
+func cleanupOtherFirewall(active string) error {
+	switch active {
+	case string(config.FirewallIptables):
+		if nftables.Available() {
+			return nftables.CleanupAll()
+		}
+	case string(config.FirewallNftables):
+		return iptables.CleanupAll()
+	}
+	return nil
+}
+
+// SystemTuns manages TUN interfaces with the ip command
+type SystemTuns struct{}
+
+func (SystemTuns) CleanupUnused(allowed []string) error {
+	return system.CleanupUnusedTunInterfaces(allowed)
+}
+func (SystemTuns) Delete(name string) error { return system.DeleteTunInterface(name) }
+func (SystemTuns) WaitGone(name string, timeout time.Duration) bool {
+	return system.WaitTunGone(name, timeout)
+}
+
+// SystemNamespaces manages namespaces with the ip command
+type SystemNamespaces struct{}
+
+func (SystemNamespaces) Create(n system.Netns) error { return system.CreateNetns(n) }
+func (SystemNamespaces) Delete(name string) error    { return system.DeleteNetns(name) }
+func (SystemNamespaces) List() ([]string, error)     { return system.ListNetns() }
+func (SystemNamespaces) Command(name string, cmd *exec.Cmd) error {
+	return system.NetnsCommand(name, cmd)
+}
+
+// SystemReadiness checks interfaces and sockets on the host
+type SystemReadiness struct{}
+
+func (SystemReadiness) TunReady(netns, name string, addrs []string) error {
+	up, have, err := system.TunState(netns, name)
+	if err != nil {
+		return fmt.Errorf("TUN %s not found: %w", name, err)
+	}
+	return tunReady(name, up, have, addrs)
+}
+func (SystemReadiness) UDPBound(pid, port int) error {
+	bound, err := system.UDPPortBound(pid, port)
+	if err != nil {
+		return err
+	}
+	if !bound {
+		return fmt.Errorf("UDP port %d not bound", port)
+	}
+	return nil
+}
+
+// NoopFirewall accepts every call without touching the host (fake mode)
+type NoopFirewall struct{}
+
+func (NoopFirewall) SetupClient(config.ClientConfig) error       { return nil }
+func (NoopFirewall) SetupClientIPv6(config.ClientConfig) error   { return nil }
+func (NoopFirewall) CleanupClient(config.ClientConfig) error     { return nil }
+func (NoopFirewall) CleanupClientIPv6(config.ClientConfig) error { return nil }
+func (NoopFirewall) SetupServer(config.ServerConfig) error       { return nil }
+func (NoopFirewall) SetupServerIPv6(config.ServerConfig) error   { return nil }
+func (NoopFirewall) CleanupServer(config.ServerConfig) error     { return nil }
+func (NoopFirewall) CleanupServerIPv6(config.ServerConfig) error { return nil }
+func (NoopFirewall) CleanupInstance(string) error                { return nil }
+func (NoopFirewall) CleanupAll() error                           { return nil }
+func (NoopFirewall) SetupClientNetns(system.Netns, config.ClientConfig) error {
+	return nil
+}
+func (NoopFirewall) CleanupClientNetns(system.Netns, config.ClientConfig) error {
+	return nil
+}
+func (NoopFirewall) SetupServerNetns(system.Netns, config.ServerConfig) error {
+	return nil
+}
+func (NoopFirewall) CleanupServerNetns(system.Netns, config.ServerConfig) error {
+	return nil
+}
+func (NoopFirewall) Name() string           { return "none" }
+func (NoopFirewall) Rules() (string, error) { return "", nil }
+func (NoopFirewall) Stats() (map[string]int, error) {
+	return map[string]int{"masquerade": 0, "dnat": 0, "total": 0}, nil
+}
+func (NoopFirewall) ListRules() ([]system.FirewallRule, error) { return nil, nil }
+
+// NoopTuns pretends every TUN device is already gone (fake mode)
+type NoopTuns struct{}
+
+func (NoopTuns) CleanupUnused([]string) error        { return nil }
+func (NoopTuns) Delete(string) error                 { return nil }
+func (NoopTuns) WaitGone(string, time.Duration) bool { return true }
+
+// NoopNamespaces pretends to create namespaces and runs instances on the host (fake mode)
+type NoopNamespaces struct{}
+
+func (NoopNamespaces) Create(system.Netns) error       { return nil }
+func (NoopNamespaces) Delete(string) error             { return nil }
+func (NoopNamespaces) List() ([]string, error)         { return nil, nil }
+func (NoopNamespaces) Command(string, *exec.Cmd) error { return nil }
+
+// NoopReadiness reports every instance as ready at once (fake mode)
+type NoopReadiness struct{}
+
+func (NoopReadiness) TunReady(string, string, []string) error { return nil }
+func (NoopReadiness) UDPBound(int, int) error                 { return nil }
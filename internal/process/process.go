@@ -4,16 +4,13 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
-	"crypto/md5"
-	"encoding/hex"
-	"io"
-	"os"
 	"phantun-docker/internal/config"
-	"phantun-docker/internal/iptables"
+	"phantun-docker/internal/logstore"
 	"phantun-docker/internal/system"
 )
 
@@ -25,6 +22,27 @@ type Process struct {
 	StartTime time.Time
 	ClientCfg config.ClientConfig
 	ServerCfg config.ServerConfig
+	Verified  *BinaryVerification // Binary checked at launch, nil if it could not be found
+	Netns     *system.Netns       // Namespace the process runs in, nil on the host
+
+	// Readiness, guarded by the manager's mu
+	ReadyAt  time.Time    // Zero until the TUN device (and client socket) came up
+	readyErr error        // Set when the process is killed for not becoming ready
+	health   *healthState // Probe results, nil without a health check
+
+	output *processOutput // Output FIFOs in adopt mode, nil with pipes
+
+	done chan struct{} // Closed once the process has been reaped
+}
+
+// reaped reports whether the process has exited and been waited for
+func (p *Process) reaped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // ProcessDTO for API
@@ -38,14 +56,49 @@ type ProcessDTO struct {
 	Remote   string `json:"remote"`
 	TunLocal string `json:"tun_local"`
 	TunPeer  string `json:"tun_peer"`
+
+	// Lifecycle
+	State      State     `json:"state"`
+	StateSince time.Time `json:"state_since"`
+	LastError  string    `json:"last_error,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+
+	// Supervision
+	Restarts int         `json:"restarts"`
+	Backoff  *BackoffDTO `json:"backoff,omitempty"`
+
+	// Latest /proc sample, only while running
+	Resources *ResourceSample `json:"resources,omitempty"`
+
+	// Registry version (empty for phantun from PATH) and the binary verified at launch
+	Binary    string              `json:"binary,omitempty"`
+	Integrity *BinaryVerification `json:"integrity,omitempty"`
+
+	// Network namespace the instance runs in, empty on the host
+	Netns string `json:"netns,omitempty"`
+
+	// When the instance became ready, unset while it is still starting
+	ReadyAt *time.Time `json:"ready_at,omitempty"`
+
+	// Active tunnel probing, only with a health check configured
+	Health *HealthDTO `json:"health,omitempty"`
+
+	// Next scheduled transition, only with a schedule configured
+	Schedule *ScheduleDTO `json:"schedule,omitempty"`
 }
 
 // LogMessage represents a log entry
 type LogMessage struct {
 	Timestamp time.Time `json:"timestamp"`
 	ProcessID string    `json:"process_id"` // Config ID
-	Stream    string    `json:"stream"`     // "stdout" or "stderr"
-	Content   string    `json:"content"`
+	Stream    string    `json:"stream"`     // "stdout", "stderr" or "event" (lifecycle events from the manager)
+	Content   string    `json:"content"`    // Raw line
+
+	// Parsed from the env_logger / tracing prefix, empty if the line has none
+	Level    string     `json:"level,omitempty"`     // "trace", "debug", "info", "warn", "error"
+	Target   string     `json:"target,omitempty"`    // Module path, e.g. "phantun::server"
+	Message  string     `json:"message,omitempty"`   // Content without the prefix
+	LoggedAt *time.Time `json:"logged_at,omitempty"` // Timestamp printed by the process
 }
 
 // Manager handles all running processes
@@ -54,25 +107,123 @@ type Manager struct {
 	mu        sync.Mutex
 	cfg       *config.Config
 
+	// Configuration in effect. API saves update cfg under its own lock; this
+	// copy only changes in Reconcile. Guarded by mu.
+	conf config.Snapshot
+
+	// Global log_level of conf, for LogEnabled, which runs for every log
+	// line and must not take mu
+	logLevel atomic.Value
+
+	// Host integrations, replaceable for tests
+	runner   Runner
+	firewall Firewall
+	tuns     TunDevices
+	netns    Namespaces
+	ready    Readiness
+
+	// Restart bookkeeping, keyed by config ID. Guarded by mu.
+	supervisors map[string]*supervisor
+
+	// Lifecycle state, keyed by config ID. Guarded by mu.
+	states map[string]*instanceState
+
+	// Veth subnet slots of namespaced instances, keyed by config ID. Guarded by mu.
+	netnsSlots map[string]int
+
+	// PID files and output FIFOs of adoptable processes. Guarded by mu.
+	runDir string
+
+	// Stops waiting for their process to exit, keyed by config ID. The channel
+	// is closed once the instance is torn down; starts of the same instance
+	// wait for it. Guarded by mu.
+	stopping map[string]chan struct{}
+
+	// Instances stopped by hand, which saving the config leaves down until
+	// they are started again. Guarded by mu.
+	manualStops map[string]bool
+
+	// Parsed schedules and manual overrides, the latter keyed by config ID. Guarded by mu.
+	schedules    map[config.Schedule]*compiledSchedule
+	overrides    map[string]scheduleOverride
+	scheduleWake chan struct{}
+
 	// Log broadcasting
 	logClients   map[chan LogMessage]bool
 	logClientsMu sync.Mutex
 	logBuffer    []LogMessage
 	logBufferMax int
+
+	// On-disk log files, nil if disabled. Set once before processes start.
+	logStore *logstore.Store
+
+	// /proc samples, keyed by config ID
+	resources   map[string]*resourceHistory
+	resourcesMu sync.Mutex
+
+	// Registry of side-by-side phantun versions
+	binariesDir  string
+	manifestPath string                       // Pinned SHA-256 digests
+	versionCache map[string]versionCacheEntry // Keyed by path
+	binariesMu   sync.Mutex
+
+	// Serializes installs; they move files around in the registry
+	installMu sync.Mutex
 }
 
 func NewManager(cfg *config.Config) *Manager {
-	return &Manager{
+	return NewManagerWithOptions(cfg, Options{})
+}
+
+// NewManagerWithOptions creates a manager with replaced host integrations,
+// e.g. FakeRunner and NoopFirewall for running without root
+func NewManagerWithOptions(cfg *config.Config, opts Options) *Manager {
+	if opts.Runner == nil {
+		opts.Runner = ExecRunner{}
+	}
+	if opts.Firewall == nil {
+		opts.Firewall = SelectFirewall(cfg.General.Firewall.Backend)
+	}
+	if opts.Tuns == nil {
+		opts.Tuns = SystemTuns{}
+	}
+	if opts.Namespaces == nil {
+		opts.Namespaces = SystemNamespaces{}
+	}
+	if opts.Readiness == nil {
+		opts.Readiness = SystemReadiness{}
+	}
+	m := &Manager{
 		processes:    make(map[string]*Process),
 		cfg:          cfg,
+		conf:         cfg.Snapshot(),
+		runner:       opts.Runner,
+		firewall:     opts.Firewall,
+		tuns:         opts.Tuns,
+		netns:        opts.Namespaces,
+		ready:        opts.Readiness,
+		supervisors:  make(map[string]*supervisor),
+		states:       make(map[string]*instanceState),
+		netnsSlots:   make(map[string]int),
+		stopping:     make(map[string]chan struct{}),
+		schedules:    make(map[config.Schedule]*compiledSchedule),
+		manualStops:  make(map[string]bool),
+		overrides:    make(map[string]scheduleOverride),
+		scheduleWake: make(chan struct{}, 1),
+		resources:    make(map[string]*resourceHistory),
+		versionCache: make(map[string]versionCacheEntry),
 		logClients:   make(map[chan LogMessage]bool),
 		logBuffer:    make([]LogMessage, 0, 100),
 		logBufferMax: 100,
 	}
+	m.logLevel.Store(m.conf.General.LogLevel)
+	return m
 }
 
-// BroadcastLog sends a log message to all connected clients
+// BroadcastLog writes a log message to disk and sends it to all connected clients
 func (m *Manager) BroadcastLog(msg LogMessage) {
+	m.persistLog(msg)
+
 	m.logClientsMu.Lock()
 	defer m.logClientsMu.Unlock()
 
@@ -118,54 +269,12 @@ func (m *Manager) UnsubscribeLogs(ch chan LogMessage) {
 	close(ch)
 }
 
-// Helper to capture output
+// Helper to capture output, one LogMessage per line
 func (m *Manager) captureOutput(cmd *exec.Cmd, id string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
-
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stdout.Read(buf)
-			if n > 0 {
-				content := string(buf[:n])
-				// Mirror to Console for Debugging (docker logs)
-				fmt.Printf("[%s] stdout: %s", id, content)
-
-				m.BroadcastLog(LogMessage{
-					Timestamp: time.Now(),
-					ProcessID: id,
-					Stream:    "stdout",
-					Content:   content,
-				})
-			}
-			if err != nil {
-				return
-			}
-		}
-	}()
-
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderr.Read(buf)
-			if n > 0 {
-				content := string(buf[:n])
-				// Mirror to Console for Debugging (docker logs)
-				fmt.Printf("[%s] stderr: %s", id, content)
-
-				m.BroadcastLog(LogMessage{
-					Timestamp: time.Now(),
-					ProcessID: id,
-					Stream:    "stderr",
-					Content:   content,
-				})
-			}
-			if err != nil {
-				return
-			}
-		}
-	}()
+	go m.captureStream(stdout, id, "stdout")
+	go m.captureStream(stderr, id, "stderr")
 }
 
 // StopAll stops all running processes
@@ -173,19 +282,48 @@ func (m *Manager) StopAll() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// Cancel pending restarts first so nothing respawns behind our back
+	m.resetSupervisors()
+
+	grace := secondsOr(m.conf.General.Supervisor.StopGraceSec, defaultStopGrace)
+	var stopping []*Process
 	for id, p := range m.processes {
 		log.Printf("Stopping process %s (%s)", id, p.Type)
-		if p.Cmd.Process != nil {
-			p.Cmd.Process.Signal(syscall.SIGTERM)
-		}
+		m.setState(id, StateStopping, nil)
+		stopping = append(stopping, p)
 		// Note: We don't cleanup individual rules here anymore.
 		// We rely on the global strategy.
 		delete(m.processes, id)
+		m.beginStop(p)
+	}
+
+	// Wait for every process to exit (and its TUN device to go away) so a
+	// following StartAll can reuse the same names and ports. The lock is
+	// released meanwhile so status and logs stay responsive.
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, p := range stopping {
+		wg.Add(1)
+		go func(p *Process) {
+			defer wg.Done()
+			m.awaitExit(p, grace)
+		}(p)
+	}
+	wg.Wait()
+	m.mu.Lock()
+
+	for _, p := range stopping {
+		if p.Netns != nil {
+			m.releaseNetns(p)
+		}
+		releaseLimits(p.ConfigID, p.limits())
+		delete(m.netnsSlots, p.ConfigID)
+		m.endStop(p.ConfigID)
 	}
 
 	// FORCE CLEANUP: Strict Policy
 	// When stopping all, we must sanitize the firewall environment.
-	if err := iptables.CleanupAll(); err != nil {
+	if err := m.firewall.CleanupAll(); err != nil {
 		log.Printf("Error during forced cleanup: %v", err)
 	} else {
 		log.Println("Global firewall cleanup executed.")
@@ -194,11 +332,18 @@ func (m *Manager) StopAll() {
 
 // StartAll starts all enabled instances from config
 func (m *Manager) StartAll() error {
+	m.prepareBinaries()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.syncStates()
+
+	// Take over processes a previous manager left running (adopt mode), and
+	// stop the ones that no longer match the config
+	m.adoptAll()
+
 	// 1. Check Global Switch
-	if !m.cfg.General.Enabled {
+	if !m.conf.General.Enabled {
 		log.Println("Global switch disabled. Skipping start.")
 		// Firewall rules are already cleaned by StopAll or Main Init.
 		return nil
@@ -207,29 +352,30 @@ func (m *Manager) StartAll() error {
 	// 2. CLEANUP ZOMBIE INTERFACES
 	// Before starting anything, we ensure only explicitly configured TUN interfaces exist.
 	allowedTuns := []string{}
-	for _, c := range m.cfg.Clients {
+	for _, c := range m.conf.Clients {
 		if c.TunName != "" {
 			allowedTuns = append(allowedTuns, c.TunName)
 		}
 	}
-	for _, s := range m.cfg.Servers {
+	for _, s := range m.conf.Servers {
 		if s.TunName != "" {
 			allowedTuns = append(allowedTuns, s.TunName)
 		}
 	}
 
-	if err := system.CleanupUnusedTunInterfaces(allowedTuns); err != nil {
+	if err := m.tuns.CleanupUnused(allowedTuns); err != nil {
 		log.Printf("Warning: Failed to cleanup zombie interfaces: %v", err)
 	}
+	m.cleanupUnusedNetns()
 
 	// 3. Count Active Instances
 	activeCount := 0
-	for _, client := range m.cfg.Clients {
+	for _, client := range m.conf.Clients {
 		if client.Enabled {
 			activeCount++
 		}
 	}
-	for _, server := range m.cfg.Servers {
+	for _, server := range m.conf.Servers {
 		if server.Enabled {
 			activeCount++
 		}
@@ -244,28 +390,120 @@ func (m *Manager) StartAll() error {
 	// 4. Proceed with Startup
 	log.Printf("Starting %d active instances...", activeCount)
 
-	for _, client := range m.cfg.Clients {
-		if client.Enabled {
-			if err := m.startClient(client); err != nil {
+	// Instances outside their schedule window wait for the scheduler
+	now := time.Now()
+	held := make(map[string]bool)
+	for _, client := range m.conf.Clients {
+		if client.Enabled && !m.running(client.ID) {
+			held[client.ID] = m.scheduledDown(client.ID, now)
+			m.setState(client.ID, pendingOrScheduled(held[client.ID]), nil)
+		}
+	}
+	for _, server := range m.conf.Servers {
+		if server.Enabled && !m.running(server.ID) {
+			held[server.ID] = m.scheduledDown(server.ID, now)
+			m.setState(server.ID, pendingOrScheduled(held[server.ID]), nil)
+		}
+	}
+
+	// Set up the firewall of every instance first. If the backend supports
+	// it, the host rules of all of them go in with one transaction, which
+	// is committed before any process is launched.
+	batch, batching := m.firewall.(firewallBatch)
+	if batching {
+		batch.BeginBatch()
+	}
+	var launches []*launch
+	for _, client := range m.conf.Clients {
+		if client.Enabled && !m.running(client.ID) && !held[client.ID] {
+			l, err := m.prepareClient(client)
+			if err != nil {
 				log.Printf("Failed to start client %s: %v", client.Alias, err)
+				continue
 			}
+			launches = append(launches, l)
 		}
 	}
-
-	for _, server := range m.cfg.Servers {
-		if server.Enabled {
-			if err := m.startServer(server); err != nil {
+	for _, server := range m.conf.Servers {
+		if server.Enabled && !m.running(server.ID) && !held[server.ID] {
+			l, err := m.prepareServer(server)
+			if err != nil {
 				log.Printf("Failed to start server %s: %v", server.Alias, err)
+				continue
 			}
+			launches = append(launches, l)
+		}
+	}
+	var failed map[string]error
+	if batching {
+		failed = batch.CommitBatch()
+	}
+
+	for _, l := range launches {
+		if err, ok := failed[l.id]; ok {
+			m.firewallFailed(l, err)
+			continue
+		}
+		// Awaiting a stop for a later instance released m.mu
+		if m.running(l.id) {
+			continue
+		}
+		if err := m.spawn(l); err != nil {
+			log.Printf("Failed to start %s %s: %v", l.kind, l.alias, err)
 		}
 	}
 	return nil
 }
 
+// launch is an instance whose firewall rules and namespace are set up, ready
+// to be spawned
+type launch struct {
+	id, kind, alias string // kind is "client" or "server"
+	binary          string
+	args            []string
+	spec            string // Fingerprint of the settings, for adoption
+	logLevel        string
+	limits          *config.ResourceLimits
+	verified        *BinaryVerification
+	ns              *system.Netns
+	client          config.ClientConfig
+	server          config.ServerConfig
+	undo            func() // Removes the firewall rules and namespace again
+}
+
 func (m *Manager) startClient(c config.ClientConfig) error {
+	l, err := m.prepareClient(c)
+	if err != nil {
+		return err
+	}
+	return m.spawn(l)
+}
+
+func (m *Manager) startServer(s config.ServerConfig) error {
+	l, err := m.prepareServer(s)
+	if err != nil {
+		return err
+	}
+	return m.spawn(l)
+}
+
+// prepareClient verifies the binary of a client and sets up its firewall
+// rules, or its namespace in netns mode. Caller must hold m.mu.
+func (m *Manager) prepareClient(c config.ClientConfig) (l *launch, err error) {
+	if err := m.awaitStopped(c.ID); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			m.setState(c.ID, StateFailedToStart, err)
+		}
+	}()
+	// Fingerprint of the configured settings, for adoption by a later manager
+	spec := specHash(clientSpec(c))
+
 	// 0. Apply Defaults
 	if c.LocalPort == "22" {
-		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot bind Phantun Client to Local Port 22! This would hijack the host SSH service and lock you out. Please choose a different port.")
+		return nil, fmt.Errorf("CRITICAL SECURITY ERROR: Cannot bind Phantun Client to Local Port 22! This would hijack the host SSH service and lock you out. Please choose a different port.")
 	}
 	if c.TunLocal == "" {
 		c.TunLocal = "192.168.200.1"
@@ -274,23 +512,39 @@ func (m *Manager) startClient(c config.ClientConfig) error {
 		c.TunPeer = "192.168.200.2"
 	}
 
-	// 1. Setup Iptables (IPv4)
-	if err := iptables.SetupClient(c); err != nil {
-		return fmt.Errorf("iptables setup failed: %w", err)
+	binary, err := m.resolveBinary("phantun_client", c.Binary)
+	if err != nil {
+		return nil, err
+	}
+	verified, err := m.verifyBinary(c.Alias, "phantun_client", c.Binary, binary)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. Setup Iptables (IPv4), inside the instance's namespace in netns mode
+	m.setState(c.ID, StateSettingUpFirewall, nil)
+	ns, err := m.setupClientNetns(&c)
+	if err != nil {
+		return nil, err
 	}
-	// Setup IPv6 if enabled
-	if !c.IPv4Only {
-		// Use defaults if empty, matching Rust defaults
-		if c.TunPeerIPv6 == "" {
-			c.TunPeerIPv6 = "fcc8::2"
+	if ns == nil {
+		if err := m.firewall.SetupClient(c); err != nil {
+			return nil, fmt.Errorf("iptables setup failed: %w", err)
 		}
-		if err := iptables.SetupClientIPv6(c); err != nil {
-			log.Printf("Warning: Failed to setup IPv6 firewall for client %s: %v", c.Alias, err)
-			// Don't fail hard, user might not have IPv6
+		// Setup IPv6 if enabled
+		if !c.IPv4Only {
+			// Use defaults if empty, matching Rust defaults
+			if c.TunPeerIPv6 == "" {
+				c.TunPeerIPv6 = "fcc8::2"
+			}
+			if err := m.firewall.SetupClientIPv6(c); err != nil {
+				log.Printf("Warning: Failed to setup IPv6 firewall for client %s: %v", c.Alias, err)
+				// Don't fail hard, user might not have IPv6
+			}
 		}
 	}
 
-	// 2. Start Binary
+	// 2. Arguments of the binary
 	args := []string{
 		"--local", fmt.Sprintf("%s:%s", c.LocalAddr, c.LocalPort),
 		"--remote", fmt.Sprintf("%s:%s", c.RemoteAddr, c.RemotePort),
@@ -318,43 +572,42 @@ func (m *Manager) startClient(c config.ClientConfig) error {
 		args = append(args, "--handshake-packet", c.HandshakeFile)
 	}
 
-	cmd := exec.Command("phantun_client", args...)
-
-	// Force Environment Variables for Logging
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "RUST_LOG=debug")
-	cmd.Env = append(cmd.Env, "RUST_BACKTRACE=1")
-
-	// Capture output
-	m.captureOutput(cmd, c.ID)
-
-	if err := cmd.Start(); err != nil {
-		// Cleanup iptables on failure
-		iptables.CleanupClient(c)
+	// Firewall rules are removed again if the process cannot be started
+	undo := func() {
+		if ns != nil {
+			m.releaseNetns(&Process{ConfigID: c.ID, Type: "client", ClientCfg: c, Netns: ns})
+			delete(m.netnsSlots, c.ID)
+			return
+		}
+		m.firewall.CleanupClient(c)
 		if !c.IPv4Only {
-			iptables.CleanupClientIPv6(c)
+			m.firewall.CleanupClientIPv6(c)
 		}
-		return err
 	}
 
-	// Monitor for exit
-	go m.monitorProcess(c.ID, cmd)
+	return &launch{
+		id: c.ID, kind: "client", alias: c.Alias,
+		binary: binary, args: args, spec: spec, logLevel: c.LogLevel, limits: c.Limits,
+		verified: verified, ns: ns, client: c, undo: undo,
+	}, nil
+}
 
-	m.processes[c.ID] = &Process{
-		ConfigID:  c.ID,
-		Cmd:       cmd,
-		Type:      "client",
-		StartTime: time.Now(),
-		ClientCfg: c,
+// prepareServer is the server counterpart of prepareClient
+func (m *Manager) prepareServer(s config.ServerConfig) (l *launch, err error) {
+	if err := m.awaitStopped(s.ID); err != nil {
+		return nil, err
 	}
-	log.Printf("Started Client %s (PID %d)", c.Alias, cmd.Process.Pid)
-	return nil
-}
+	defer func() {
+		if err != nil {
+			m.setState(s.ID, StateFailedToStart, err)
+		}
+	}()
+	// Fingerprint of the configured settings, for adoption by a later manager
+	spec := specHash(serverSpec(s))
 
-func (m *Manager) startServer(s config.ServerConfig) error {
 	// 0. Apply Defaults
 	if s.LocalPort == "22" {
-		return fmt.Errorf("CRITICAL SECURITY ERROR: Cannot bind Phantun Server to Local Port 22! This would hijack the host SSH service and lock you out. Please choose a different port.")
+		return nil, fmt.Errorf("CRITICAL SECURITY ERROR: Cannot bind Phantun Server to Local Port 22! This would hijack the host SSH service and lock you out. Please choose a different port.")
 	}
 	if s.TunLocal == "" {
 		s.TunLocal = "192.168.201.1"
@@ -363,17 +616,33 @@ func (m *Manager) startServer(s config.ServerConfig) error {
 		s.TunPeer = "192.168.201.2"
 	}
 
-	// 1. Setup Iptables (IPv4)
-	if err := iptables.SetupServer(s); err != nil {
-		return fmt.Errorf("iptables setup failed: %w", err)
+	binary, err := m.resolveBinary("phantun_server", s.Binary)
+	if err != nil {
+		return nil, err
+	}
+	verified, err := m.verifyBinary(s.Alias, "phantun_server", s.Binary, binary)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. Setup Iptables (IPv4), inside the instance's namespace in netns mode
+	m.setState(s.ID, StateSettingUpFirewall, nil)
+	ns, err := m.setupServerNetns(&s)
+	if err != nil {
+		return nil, err
 	}
-	// Setup IPv6
-	if !s.IPv4Only {
-		if s.TunPeerIPv6 == "" {
-			s.TunPeerIPv6 = "fcc9::2"
+	if ns == nil {
+		if err := m.firewall.SetupServer(s); err != nil {
+			return nil, fmt.Errorf("iptables setup failed: %w", err)
 		}
-		if err := iptables.SetupServerIPv6(s); err != nil {
-			log.Printf("Warning: Failed to setup IPv6 firewall for server %s: %v", s.Alias, err)
+		// Setup IPv6
+		if !s.IPv4Only {
+			if s.TunPeerIPv6 == "" {
+				s.TunPeerIPv6 = "fcc9::2"
+			}
+			if err := m.firewall.SetupServerIPv6(s); err != nil {
+				log.Printf("Warning: Failed to setup IPv6 firewall for server %s: %v", s.Alias, err)
+			}
 		}
 	}
 
@@ -404,102 +673,262 @@ func (m *Manager) startServer(s config.ServerConfig) error {
 		args = append(args, "--handshake-packet", s.HandshakeFile)
 	}
 
-	cmd := exec.Command("phantun_server", args...)
+	// Firewall rules are removed again if the process cannot be started
+	undo := func() {
+		if ns != nil {
+			m.releaseNetns(&Process{ConfigID: s.ID, Type: "server", ServerCfg: s, Netns: ns})
+			delete(m.netnsSlots, s.ID)
+			return
+		}
+		m.firewall.CleanupServer(s)
+		if !s.IPv4Only {
+			m.firewall.CleanupServerIPv6(s)
+		}
+	}
 
-	// Force Environment Variables for Logging
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "RUST_LOG=debug")
-	cmd.Env = append(cmd.Env, "RUST_BACKTRACE=1")
+	return &launch{
+		id: s.ID, kind: "server", alias: s.Alias,
+		binary: binary, args: args, spec: spec, logLevel: s.LogLevel, limits: s.Limits,
+		verified: verified, ns: ns, server: s, undo: undo,
+	}, nil
+}
 
-	// Capture output
-	m.captureOutput(cmd, s.ID)
+// spawn starts the process of a prepared instance. Caller must hold m.mu.
+func (m *Manager) spawn(l *launch) (err error) {
+	defer func() {
+		if err != nil {
+			m.setState(l.id, StateFailedToStart, err)
+		}
+	}()
 
-	if err := cmd.Start(); err != nil {
-		iptables.CleanupServer(s)
-		if !s.IPv4Only {
-			iptables.CleanupServerIPv6(s)
+	cmd := m.runner.Command(l.binary, l.args...)
+	if l.ns != nil {
+		if err := m.netns.Command(l.ns.Name, cmd); err != nil {
+			l.undo()
+			return err
 		}
-		return err
 	}
 
-	// Monitor for exit
-	go m.monitorProcess(s.ID, cmd)
+	// Environment Variables for Logging (later entries override inherited ones)
+	cmd.Env = append(cmd.Environ(), "RUST_LOG="+m.rustLog(l.logLevel))
+	cmd.Env = append(cmd.Env, "RUST_BACKTRACE=1")
 
-	m.processes[s.ID] = &Process{
-		ConfigID:  s.ID,
+	// Capture output, through FIFOs that outlive the manager in adopt mode
+	var output *processOutput
+	if m.adopting() {
+		if output, err = m.openOutput(l.id, cmd); err != nil {
+			l.undo()
+			return err
+		}
+		defer func() {
+			if err != nil {
+				output.close()
+			}
+		}()
+	} else {
+		m.captureOutput(cmd, l.id)
+	}
+
+	release, err := prepareLimits(l.id, l.limits, cmd)
+	if err != nil {
+		l.undo()
+		return fmt.Errorf("resource limits: %w", err)
+	}
+
+	m.setState(l.id, StateStarting, nil)
+	err = cmd.Start()
+	if limitErr := release(err == nil); err == nil && limitErr != nil {
+		cmd.Wait()
+		err = limitErr
+	}
+	output.started()
+	if err != nil {
+		l.undo()
+		releaseLimits(l.id, l.limits)
+		return err
+	}
+
+	p := &Process{
+		ConfigID:  l.id,
 		Cmd:       cmd,
-		Type:      "server",
+		Type:      l.kind,
 		StartTime: time.Now(),
-		ServerCfg: s,
+		ClientCfg: l.client,
+		ServerCfg: l.server,
+		Verified:  l.verified,
+		Netns:     l.ns,
+		done:      make(chan struct{}),
+	}
+	m.processes[l.id] = p
+	if output != nil {
+		p.output = output
+		m.writePidFile(p, l.binary, l.args, l.spec, m.rustLog(l.logLevel))
 	}
-	log.Printf("Started Server %s (PID %d)", s.Alias, cmd.Process.Pid)
+
+	// Monitor for exit
+	go m.monitorProcess(p)
+	m.states[l.id].PID = cmd.Process.Pid
+	// Reported as running once it is ready
+	go m.awaitReady(p, m.readyTimeout())
+	log.Printf("Started %s %s (PID %d)", l.kind, l.alias, cmd.Process.Pid)
 	return nil
 }
 
-// monitorProcess waits for command to exit and removes it from the map
-func (m *Manager) monitorProcess(id string, cmd *exec.Cmd) {
-	err := cmd.Wait()
+// monitorProcess waits for command to exit, removes it from the map
+// and hands it to the supervisor for a possible restart
+func (m *Manager) monitorProcess(proc *Process) {
+	err := proc.Cmd.Wait()
+	// Signal waiters before taking the lock
+	close(proc.done)
+	m.processExited(proc, err)
+}
 
+// processExited records the exit of a process and hands it to the supervisor
+// if it was not stopped on purpose
+func (m *Manager) processExited(proc *Process, err error) {
+	id, cmd := proc.ConfigID, proc.Cmd
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	proc.output.close()
+	proc.output = nil
+	m.removePidFile(id, cmd.Process.Pid)
+
 	// Only remove if it's the exact same command instance (checked by PID)
 	// This prevents race condition if a restart happened quickly and we removed the NEW process.
-	if p, exists := m.processes[id]; exists && p.Cmd.Process.Pid == cmd.Process.Pid {
-		log.Printf("Process %s (Type: %s) exited. Error: %v", id, p.Type, err)
+	// Processes stopped on purpose are already gone from the map, so they are never restarted.
+	pid := cmd.Process.Pid
+	if p, exists := m.processes[id]; exists && p.Cmd.Process.Pid == pid {
+		log.Printf("Process %s (Type: %s) exited with code %d. Error: %v", id, p.Type, exitCode(err), err)
+		if p.readyErr != nil {
+			err = p.readyErr
+		}
 		delete(m.processes, id)
+		if err != nil {
+			m.setExited(id, pid, StateCrashed, err)
+		} else {
+			m.setExited(id, pid, StateExited, nil)
+		}
+		m.handleExit(p, err)
+		return
+	}
+
+	// Stopped on purpose: record the exit code of the process we were waiting for
+	if st, ok := m.states[id]; ok && st.State == StateStopping && st.PID == pid {
+		m.setExited(id, pid, StateExited, nil)
+		code := exitCode(err)
+		st.ExitCode = &code
 	}
 }
 
-// GetStatus returns the list of running processes
+// GetStatus returns every configured instance in config order, whether running,
+// down (failed to start, crashed, waiting for a restart) or disabled, plus live
+// processes whose config entry is gone
 func (m *Manager) GetStatus() []ProcessDTO {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	var list []ProcessDTO
-	for _, p := range m.processes {
-		// Basic check if process is likely running
-		// In a real manager, we should use os.FindProcess or monitor exit channel
-		running := true
-		if p.Cmd.ProcessState != nil && p.Cmd.ProcessState.Exited() {
-			running = false
-		}
-
-		alias := ""
-		local := ""
-		remote := ""
-		tunLocal := ""
-		tunPeer := ""
-
-		if p.Type == "client" {
-			alias = p.ClientCfg.Alias
-			local = fmt.Sprintf("%s:%s", p.ClientCfg.LocalAddr, p.ClientCfg.LocalPort)
-			remote = fmt.Sprintf("%s:%s", p.ClientCfg.RemoteAddr, p.ClientCfg.RemotePort)
-			tunLocal = p.ClientCfg.TunLocal
-			tunPeer = p.ClientCfg.TunPeer
+	listed := make(map[string]bool)
+
+	add := func(id string, fallback *Process) {
+		listed[id] = true
+		var dto ProcessDTO
+		if p, ok := m.processes[id]; ok {
+			// Reaped but not yet removed by monitorProcess counts as stopped.
+			// ProcessState must not be read here: Wait writes it concurrently.
+			running := !p.reaped()
+			dto = describeProcess(p, p.Cmd.Process.Pid, running)
+			dto.Resources = m.latestResources(id, p.Cmd.Process.Pid)
+		} else if sv, ok := m.supervisors[id]; ok && sv.last != nil {
+			dto = describeProcess(sv.last, sv.lastPID, false)
+		} else if fallback != nil {
+			dto = describeProcess(fallback, 0, false)
 		} else {
-			alias = p.ServerCfg.Alias
-			local = fmt.Sprintf("0.0.0.0:%s", p.ServerCfg.LocalPort) // Server listens on all interfaces
-			remote = fmt.Sprintf("%s:%s", p.ServerCfg.RemoteAddr, p.ServerCfg.RemotePort)
-			tunLocal = p.ServerCfg.TunLocal
-			tunPeer = p.ServerCfg.TunPeer
-		}
-
-		list = append(list, ProcessDTO{
-			ID:       p.ConfigID,
-			Alias:    alias,
-			Type:     p.Type,
-			PID:      p.Cmd.Process.Pid,
-			Running:  running,
-			Local:    local,
-			Remote:   remote,
-			TunLocal: tunLocal,
-			TunPeer:  tunPeer,
-		})
+			return
+		}
+
+		if st, ok := m.states[id]; ok {
+			dto.State = st.State
+			dto.StateSince = st.Since
+			dto.LastError = st.LastError
+			dto.ExitCode = st.ExitCode
+			if !dto.Running && dto.PID == 0 {
+				dto.PID = st.PID
+			}
+		}
+		if sv, ok := m.supervisors[id]; ok {
+			dto.Restarts = sv.restarts
+			dto.Backoff = sv.describe()
+		}
+		dto.Schedule = m.describeSchedule(id)
+		list = append(list, dto)
+	}
+
+	for _, c := range m.conf.Clients {
+		add(c.ID, &Process{ConfigID: c.ID, Type: "client", ClientCfg: c})
+	}
+	for _, s := range m.conf.Servers {
+		add(s.ID, &Process{ConfigID: s.ID, Type: "server", ServerCfg: s})
+	}
+	// Processes whose config entry is already gone
+	for id := range m.processes {
+		if !listed[id] {
+			add(id, nil)
+		}
 	}
 	return list
 }
 
+// describeProcess builds the API view of a process from its config
+func describeProcess(p *Process, pid int, running bool) ProcessDTO {
+	alias := ""
+	local := ""
+	remote := ""
+	tunLocal := ""
+	tunPeer := ""
+	binary := ""
+
+	if p.Type == "client" {
+		alias = p.ClientCfg.Alias
+		binary = p.ClientCfg.Binary
+		local = fmt.Sprintf("%s:%s", p.ClientCfg.LocalAddr, p.ClientCfg.LocalPort)
+		remote = fmt.Sprintf("%s:%s", p.ClientCfg.RemoteAddr, p.ClientCfg.RemotePort)
+		tunLocal = p.ClientCfg.TunLocal
+		tunPeer = p.ClientCfg.TunPeer
+	} else {
+		alias = p.ServerCfg.Alias
+		binary = p.ServerCfg.Binary
+		local = fmt.Sprintf("0.0.0.0:%s", p.ServerCfg.LocalPort) // Server listens on all interfaces
+		remote = fmt.Sprintf("%s:%s", p.ServerCfg.RemoteAddr, p.ServerCfg.RemotePort)
+		tunLocal = p.ServerCfg.TunLocal
+		tunPeer = p.ServerCfg.TunPeer
+	}
+
+	dto := ProcessDTO{
+		ID:       p.ConfigID,
+		Alias:    alias,
+		Type:     p.Type,
+		PID:      pid,
+		Running:  running,
+		Local:    local,
+		Remote:   remote,
+		TunLocal: tunLocal,
+		TunPeer:  tunPeer,
+		Binary:   binary,
+	}
+	dto.Integrity = p.Verified
+	if p.Netns != nil {
+		dto.Netns = p.Netns.Name
+	}
+	if !p.ReadyAt.IsZero() {
+		readyAt := p.ReadyAt
+		dto.ReadyAt = &readyAt
+	}
+	dto.Health = p.health.dto()
+	return dto
+}
+
 // CheckBinaries verifies if Phantun executables are present (Deprecated, use GetBinariesInfo)
 func (m *Manager) CheckBinaries() bool {
 	_, err1 := exec.LookPath("phantun_client")
@@ -507,7 +936,8 @@ func (m *Manager) CheckBinaries() bool {
 	return err1 == nil && err2 == nil
 }
 
-// GetBinariesInfo returns detailed binary info
+// GetBinariesInfo returns detailed binary info. "client" and "server" hold the
+// SHA-256 of the default binaries from PATH; "versions" lists the registry.
 func (m *Manager) GetBinariesInfo() map[string]interface{} {
 	info := map[string]interface{}{
 		"client": "missing",
@@ -515,29 +945,48 @@ func (m *Manager) GetBinariesInfo() map[string]interface{} {
 		"ok":     false,
 	}
 
-	if path, err := exec.LookPath("phantun_client"); err == nil {
-		info["client"] = getFileHash(path)
+	pins, err := m.loadManifest()
+	if err != nil {
+		info["manifest_error"] = err.Error()
 	}
-	if path, err := exec.LookPath("phantun_server"); err == nil {
-		info["server"] = getFileHash(path)
+	defaults := BinaryVersion{Name: "default"}
+	for _, binary := range phantunBinaries {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			continue
+		}
+		bi := m.describeBinary(path)
+		if bi.SHA256 == "" {
+			info[binaryKind(binary)] = "readable-error"
+			continue
+		}
+		bi.Pin, _ = checkPin(pins, pinName(binary, ""), bi.SHA256)
+		info[binaryKind(binary)] = bi.SHA256
+		if binary == "phantun_client" {
+			defaults.Client = &bi
+		} else {
+			defaults.Server = &bi
+		}
 	}
+	info["default"] = defaults
 
 	if info["client"] != "missing" && info["server"] != "missing" {
 		info["ok"] = true
 	}
-	return info
-}
 
-func getFileHash(path string) string {
-	f, err := os.Open(path)
+	versions, err := m.BinaryVersions()
 	if err != nil {
-		return "readable-error"
+		info["versions_error"] = err.Error()
 	}
-	defer f.Close()
-
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "hash-error"
+	if versions == nil {
+		versions = []BinaryVersion{}
 	}
-	return hex.EncodeToString(h.Sum(nil))[:8] // Short hash
+	info["versions"] = versions
+	info["dir"] = m.BinariesDir()
+	return info
+}
+
+// binaryKind maps "phantun_client" to "client" and "phantun_server" to "server"
+func binaryKind(binary string) string {
+	return strings.TrimPrefix(binary, "phantun_")
 }
@@ -0,0 +1,1444 @@
+package process
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/cron"
+	"phantun-docker/internal/logstore"
+	"phantun-docker/internal/system"
+)
+
+// The test binary doubles as the fake phantun launched by FakeRunner
+func TestMain(m *testing.M) {
+	RunLimitedIfRequested()
+	RunFakeIfRequested()
+	os.Exit(m.Run())
+}
+
+// recordingFirewall remembers every call and can be told to fail setups
+type recordingFirewall struct {
+	mu        sync.Mutex
+	calls     []string
+	failSetup map[string]bool // Instance IDs whose setup fails
+	listed    []system.FirewallRule
+}
+
+func (f *recordingFirewall) record(call, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call+":"+id)
+	if f.failSetup[id] && (call == "SetupClient" || call == "SetupServer") {
+		return errors.New("simulated iptables failure")
+	}
+	return nil
+}
+
+func (f *recordingFirewall) count(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *recordingFirewall) SetupClient(c config.ClientConfig) error {
+	return f.record("SetupClient", c.ID)
+}
+func (f *recordingFirewall) SetupClientIPv6(c config.ClientConfig) error {
+	return f.record("SetupClientIPv6", c.ID)
+}
+func (f *recordingFirewall) CleanupClient(c config.ClientConfig) error {
+	return f.record("CleanupClient", c.ID)
+}
+func (f *recordingFirewall) CleanupClientIPv6(c config.ClientConfig) error {
+	return f.record("CleanupClientIPv6", c.ID)
+}
+func (f *recordingFirewall) SetupServer(s config.ServerConfig) error {
+	return f.record("SetupServer", s.ID)
+}
+func (f *recordingFirewall) SetupServerIPv6(s config.ServerConfig) error {
+	return f.record("SetupServerIPv6", s.ID)
+}
+func (f *recordingFirewall) CleanupServer(s config.ServerConfig) error {
+	return f.record("CleanupServer", s.ID)
+}
+func (f *recordingFirewall) CleanupServerIPv6(s config.ServerConfig) error {
+	return f.record("CleanupServerIPv6", s.ID)
+}
+func (f *recordingFirewall) SetupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return f.record("SetupClientNetns", c.ID)
+}
+func (f *recordingFirewall) CleanupClientNetns(n system.Netns, c config.ClientConfig) error {
+	return f.record("CleanupClientNetns", c.ID)
+}
+func (f *recordingFirewall) SetupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return f.record("SetupServerNetns", s.ID)
+}
+func (f *recordingFirewall) CleanupServerNetns(n system.Netns, s config.ServerConfig) error {
+	return f.record("CleanupServerNetns", s.ID)
+}
+func (f *recordingFirewall) CleanupInstance(id string) error { return f.record("CleanupInstance", id) }
+func (f *recordingFirewall) CleanupAll() error               { return f.record("CleanupAll", "") }
+func (f *recordingFirewall) Name() string                    { return "recording" }
+func (f *recordingFirewall) Rules() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.calls, "\n"), nil
+}
+func (f *recordingFirewall) Stats() (map[string]int, error) {
+	return map[string]int{"total": f.count("SetupClient:c1") + f.count("SetupServer:s1")}, nil
+}
+func (f *recordingFirewall) ListRules() ([]system.FirewallRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.listed, nil
+}
+
+// batchingFirewall is a recordingFirewall that batches like the iptables
+// backend; the instances in failBatch fail the commit
+type batchingFirewall struct {
+	*recordingFirewall
+	failBatch map[string]bool
+}
+
+func (f *batchingFirewall) BeginBatch() { f.record("BeginBatch", "") }
+func (f *batchingFirewall) CommitBatch() map[string]error {
+	f.record("CommitBatch", "")
+	failed := make(map[string]error)
+	for id := range f.failBatch {
+		failed[id] = errors.New("simulated transaction failure")
+	}
+	return failed
+}
+
+// recordingNamespaces keeps track of the namespaces that would exist
+type recordingNamespaces struct {
+	mu     sync.Mutex
+	live   map[string]system.Netns
+	joined []string // Namespaces commands were moved into
+}
+
+func (r *recordingNamespaces) Create(n system.Netns) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.live[n.Name] = n
+	return nil
+}
+func (r *recordingNamespaces) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.live, name)
+	return nil
+}
+func (r *recordingNamespaces) List() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.live {
+		names = append(names, name)
+	}
+	return names, nil
+}
+func (r *recordingNamespaces) Command(name string, _ *exec.Cmd) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.joined = append(r.joined, name)
+	return nil
+}
+
+func (r *recordingNamespaces) has(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.live[name]
+	return ok
+}
+
+func testConfig() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.General.Enabled = true
+	cfg.Clients = []config.ClientConfig{{
+		ID: "c1", Alias: "client", Enabled: true,
+		LocalAddr: "127.0.0.1", LocalPort: "5000",
+		RemoteAddr: "192.0.2.1", RemotePort: "4567",
+		TunName: "tun0", IPv4Only: true,
+	}}
+	cfg.Servers = []config.ServerConfig{{
+		ID: "s1", Alias: "server", Enabled: true,
+		LocalPort:  "4567",
+		RemoteAddr: "127.0.0.1", RemotePort: "51820",
+		TunName: "tun1", IPv4Only: true,
+	}}
+	return cfg
+}
+
+func newTestManager(t *testing.T, cfg *config.Config, behaviour func(binary string, args []string) []string) (*Manager, *recordingFirewall) {
+	t.Helper()
+	fw := &recordingFirewall{failSetup: map[string]bool{}}
+	m := NewManagerWithOptions(cfg, Options{
+		Runner:     FakeRunner{Behaviour: behaviour},
+		Firewall:   fw,
+		Tuns:       NoopTuns{},
+		Namespaces: NoopNamespaces{},
+		Readiness:  NoopReadiness{},
+	})
+	t.Cleanup(m.StopAll)
+	return m, fw
+}
+
+// forTun scripts the fake for the instance owning the given TUN device
+func forTun(tun string, env ...string) func(string, []string) []string {
+	return func(_ string, args []string) []string {
+		if argValue(args, "--tun") == tun {
+			return env
+		}
+		return nil
+	}
+}
+
+func findStatus(m *Manager, id string) (ProcessDTO, bool) {
+	for _, p := range m.GetStatus() {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return ProcessDTO{}, false
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStartAllAndStopAll(t *testing.T) {
+	m, fw := newTestManager(t, testConfig(), nil)
+
+	if err := m.StartAll(); err != nil {
+		t.Fatalf("StartAll: %v", err)
+	}
+	for _, id := range []string{"c1", "s1"} {
+		waitFor(t, 2*time.Second, id+" to become ready", func() bool {
+			st, _ := findStatus(m, id)
+			return st.State == StateRunning
+		})
+		st, _ := findStatus(m, id)
+		if !st.Running || st.PID == 0 || st.ReadyAt == nil {
+			t.Fatalf("%s: want running, got %+v", id, st)
+		}
+	}
+
+	m.StopAll()
+	if fw.count("CleanupAll:") != 1 {
+		t.Errorf("want one global firewall cleanup, got calls %v", fw.calls)
+	}
+	waitFor(t, 2*time.Second, "instances to be reported as exited", func() bool {
+		for _, id := range []string{"c1", "s1"} {
+			if st, _ := findStatus(m, id); st.Running || st.State != StateExited {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCrashIsRestarted(t *testing.T) {
+	var launches atomic.Int32
+	m, _ := newTestManager(t, testConfig(), func(_ string, args []string) []string {
+		// Only the first launch of the client crashes
+		if argValue(args, "--tun") == "tun0" && launches.Add(1) == 1 {
+			return []string{FakeExitAfterEnv + "=100ms", FakeExitCodeEnv + "=3"}
+		}
+		return nil
+	})
+
+	m.StartAll()
+	first, _ := findStatus(m, "c1")
+
+	waitFor(t, 5*time.Second, "client to be restarted", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.Restarts == 1 && st.Running
+	})
+	st, _ := findStatus(m, "c1")
+	if st.PID == first.PID {
+		t.Errorf("expected a new PID after restart, still %d", st.PID)
+	}
+	if st.Backoff == nil || st.Backoff.Attempt != 1 {
+		t.Errorf("want backoff attempt 1, got %+v", st.Backoff)
+	}
+	if server, _ := findStatus(m, "s1"); server.Restarts != 0 {
+		t.Errorf("server must not be restarted, got %d restarts", server.Restarts)
+	}
+}
+
+func TestCrashLoopBreakerGivesUp(t *testing.T) {
+	cfg := testConfig()
+	cfg.General.Supervisor.CrashLoopMax = 2
+	m, _ := newTestManager(t, cfg, forTun("tun0", FakeExitAfterEnv+"=50ms"))
+
+	m.StartAll()
+	waitFor(t, 5*time.Second, "crash-loop breaker", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.Backoff != nil && st.Backoff.GaveUp
+	})
+
+	st, _ := findStatus(m, "c1")
+	if st.State != StateCrashed || st.Running {
+		t.Errorf("want crashed, got %+v", st)
+	}
+	if st.ExitCode == nil || *st.ExitCode != 1 {
+		t.Errorf("want exit code 1, got %v", st.ExitCode)
+	}
+
+	// A manual start counts crashes afresh
+	if err := m.StartInstance("c1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "crash after the manual start", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.Backoff != nil
+	})
+	if st, _ := findStatus(m, "c1"); st.Backoff.GaveUp {
+		t.Errorf("gave up on the first crash after a manual start: %+v", st.Backoff)
+	}
+}
+
+func TestRestartPolicyNever(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clients[0].RestartPolicy = config.RestartNever
+	m, _ := newTestManager(t, cfg, forTun("tun0", FakeExitAfterEnv+"=50ms"))
+
+	m.StartAll()
+	waitFor(t, 2*time.Second, "client to crash", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.State == StateCrashed
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	st, ok := findStatus(m, "c1")
+	if !ok {
+		t.Fatal("crashed instance must still be listed")
+	}
+	if st.State != StateCrashed || st.Restarts != 0 || st.Backoff != nil {
+		t.Errorf("want crashed without restart, got %+v", st)
+	}
+}
+
+func TestStopEscalatesToSIGKILL(t *testing.T) {
+	cfg := testConfig()
+	cfg.General.Supervisor.StopGraceSec = 1
+	m, _ := newTestManager(t, cfg, forTun("tun0", FakeIgnoreTermEnv+"=1", FakeStartupDelayEnv+"=0s"))
+
+	m.StartAll()
+	// Give the fake time to install its signal handling
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	if err := m.StopInstance("c1"); err != nil {
+		t.Fatalf("StopInstance: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("stop returned after %s, before the grace period", elapsed)
+	}
+	if st, _ := findStatus(m, "c1"); st.Running {
+		t.Errorf("client still running after stop: %+v", st)
+	}
+}
+
+func TestStopDoesNotBlockManager(t *testing.T) {
+	cfg := testConfig()
+	cfg.General.Supervisor.StopGraceSec = 1
+	m, _ := newTestManager(t, cfg, forTun("tun0", FakeIgnoreTermEnv+"=1", FakeStartupDelayEnv+"=0s"))
+
+	m.StartAll()
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.StopInstance("c1") }()
+	waitFor(t, 500*time.Millisecond, "client to be stopping", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.State == StateStopping
+	})
+
+	// A start of the same instance waits for the stop to finish
+	start := time.Now()
+	if err := m.StartInstance("c1"); err != nil {
+		t.Fatalf("StartInstance: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("StopInstance: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("start returned after %s, while the stop was still waiting", elapsed)
+	}
+	if st, _ := findStatus(m, "c1"); !st.Running {
+		t.Errorf("client must run again after the stop finished: %+v", st)
+	}
+}
+
+func TestFailedToStartIsListed(t *testing.T) {
+	m, fw := newTestManager(t, testConfig(), nil)
+	fw.failSetup["s1"] = true
+
+	m.StartAll()
+	st, ok := findStatus(m, "s1")
+	if !ok {
+		t.Fatal("failed instance must be listed")
+	}
+	if st.State != StateFailedToStart || st.Running || st.LastError == "" {
+		t.Errorf("want failed-to-start with error, got %+v", st)
+	}
+	if client, _ := findStatus(m, "c1"); !client.Running {
+		t.Errorf("client must still start, got %+v", client)
+	}
+}
+
+func TestStartAllCommitsFirewallBeforeSpawning(t *testing.T) {
+	rec := &recordingFirewall{failSetup: map[string]bool{}}
+	fw := &batchingFirewall{recordingFirewall: rec, failBatch: map[string]bool{"c1": true}}
+	m := NewManagerWithOptions(testConfig(), Options{
+		Runner: FakeRunner{Behaviour: func(_ string, args []string) []string {
+			rec.record("Spawn", argValue(args, "--tun"))
+			return nil
+		}},
+		Firewall:   fw,
+		Tuns:       NoopTuns{},
+		Namespaces: NoopNamespaces{},
+		Readiness:  NoopReadiness{},
+	})
+	t.Cleanup(m.StopAll)
+	m.StartAll()
+
+	rec.mu.Lock()
+	calls := strings.Join(rec.calls, " ")
+	rec.mu.Unlock()
+	want := "BeginBatch: SetupClient:c1 SetupServer:s1 CommitBatch: CleanupClient:c1 Spawn:tun1"
+	if calls != want {
+		t.Errorf("want %s, got %s", want, calls)
+	}
+	if st, _ := findStatus(m, "c1"); st.Running || st.State != StateFailedToStart {
+		t.Errorf("client of the failed transaction must not start: %+v", st)
+	}
+	if st, _ := findStatus(m, "s1"); !st.Running {
+		t.Errorf("server must start: %+v", st)
+	}
+}
+
+func TestRestartInstanceLeavesOthersRunning(t *testing.T) {
+	m, fw := newTestManager(t, testConfig(), nil)
+	m.StartAll()
+	client, _ := findStatus(m, "c1")
+	server, _ := findStatus(m, "s1")
+
+	if err := m.RestartInstance("c1"); err != nil {
+		t.Fatalf("RestartInstance: %v", err)
+	}
+
+	if st, _ := findStatus(m, "c1"); !st.Running || st.PID == client.PID {
+		t.Errorf("client not restarted: %+v", st)
+	}
+	if st, _ := findStatus(m, "s1"); !st.Running || st.PID != server.PID {
+		t.Errorf("server must be untouched: %+v", st)
+	}
+	if fw.count("CleanupClient:c1") != 1 || fw.count("CleanupServer:s1") != 0 || fw.count("CleanupAll:") != 0 {
+		t.Errorf("unexpected firewall calls: %v", fw.calls)
+	}
+}
+
+func TestUnknownInstance(t *testing.T) {
+	m, _ := newTestManager(t, testConfig(), nil)
+	for name, fn := range map[string]func(string) error{
+		"start":   m.StartInstance,
+		"stop":    m.StopInstance,
+		"restart": m.RestartInstance,
+	} {
+		if err := fn("nope"); !errors.Is(err, ErrInstanceNotFound) {
+			t.Errorf("%s: want ErrInstanceNotFound, got %v", name, err)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	cfg := testConfig()
+	m, _ := newTestManager(t, cfg, nil)
+	m.StartAll()
+	client, _ := findStatus(m, "c1")
+	prev := cfg.Snapshot()
+
+	clients := append([]config.ClientConfig(nil), cfg.Clients...)
+	clients[0].Alias = "renamed"
+	clients = append(clients, config.ClientConfig{
+		ID: "c2", Enabled: true, LocalAddr: "127.0.0.1", LocalPort: "5001",
+		RemoteAddr: "192.0.2.2", RemotePort: "4567", TunName: "tun2", IPv4Only: true,
+	})
+	servers := append([]config.ServerConfig(nil), cfg.Servers...)
+	servers[0].Enabled = false
+	cfg.Update(cfg.General, clients, servers)
+
+	result := m.Reconcile(prev)
+	want := fmt.Sprint([]string{"c2"}, []string{}, []string{"s1"}, []string{"c1"})
+	if got := fmt.Sprint(result.Added, result.Changed, result.Removed, result.Unchanged); got != want {
+		t.Errorf("added/changed/removed/unchanged: want %s, got %s", want, got)
+	}
+	if st, _ := findStatus(m, "c1"); st.PID != client.PID || st.Alias != "renamed" {
+		t.Errorf("client must keep running with the new alias: %+v", st)
+	}
+	if st, ok := findStatus(m, "s1"); !ok || st.Running || st.State != StateDisabled {
+		t.Errorf("disabled server must be listed as disabled: %+v", st)
+	}
+
+	prev = cfg.Snapshot()
+	clients = append([]config.ClientConfig(nil), cfg.Clients...)
+	clients[0].LocalPort = "6000"
+	cfg.Update(cfg.General, clients, servers)
+
+	result = m.Reconcile(prev)
+	if fmt.Sprint(result.Changed) != "[c1]" {
+		t.Errorf("want c1 changed, got %+v", result)
+	}
+	if st, _ := findStatus(m, "c1"); st.PID == client.PID || !st.Running {
+		t.Errorf("changed client must be restarted: %+v", st)
+	}
+
+	// A new global log level reaches instances without their own
+	prev = cfg.Snapshot()
+	clients = append(clients, config.ClientConfig{
+		ID: "c3", Enabled: true, LocalAddr: "127.0.0.1", LocalPort: "5003", LogLevel: "debug",
+		RemoteAddr: "192.0.2.3", RemotePort: "4567", TunName: "tun3", IPv4Only: true,
+	})
+	cfg.Update(cfg.General, clients, servers)
+	m.Reconcile(prev)
+	prev = cfg.Snapshot()
+	general := cfg.General
+	general.LogLevel = "trace"
+	cfg.Update(general, clients, servers)
+	result = m.Reconcile(prev)
+	if fmt.Sprint(result.Changed, result.Unchanged) != "[c1 c2] [c3]" {
+		t.Errorf("want inheriting clients changed, got %+v", result)
+	}
+}
+
+// The API updates the config under its own lock and only then reconciles;
+// the manager must not see the new config before that
+func TestConfigUpdateBeforeReconcile(t *testing.T) {
+	cfg := testConfig()
+	m, _ := newTestManager(t, cfg, nil)
+	m.StartAll()
+	prev := cfg.Snapshot()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			clients := append([]config.ClientConfig(nil), cfg.Clients...)
+			clients[0].Alias = fmt.Sprintf("alias-%d", i)
+			cfg.Update(cfg.General, clients, cfg.Servers)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if st, _ := findStatus(m, "c1"); st.Alias != "client" {
+			t.Fatalf("unreconciled alias visible: %q", st.Alias)
+		}
+	}
+	<-done
+
+	m.Reconcile(prev)
+	if st, _ := findStatus(m, "c1"); st.Alias != "alias-49" {
+		t.Errorf("want the reconciled alias, got %q", st.Alias)
+	}
+}
+
+func TestLogEnabledFollowsReconcile(t *testing.T) {
+	cfg := testConfig()
+	cfg.General.LogLevel = "warn"
+	m, _ := newTestManager(t, cfg, nil)
+	if m.LogEnabled("info") || !m.LogEnabled("warn") {
+		t.Fatal("want info filtered at warn")
+	}
+
+	// Saving alone does not change the level, even while logging
+	prev := cfg.Snapshot()
+	general := cfg.General
+	general.LogLevel = "debug"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg.Update(general, cfg.Clients, cfg.Servers)
+	}()
+	m.LogEnabled("info")
+	<-done
+	if m.LogEnabled("info") {
+		t.Error("unreconciled log level applied")
+	}
+
+	m.Reconcile(prev)
+	if !m.LogEnabled("debug") || m.LogEnabled("trace") {
+		t.Error("want debug passing and trace filtered after reconcile")
+	}
+}
+
+func TestCaptureParsesPhantunLogs(t *testing.T) {
+	m, _ := newTestManager(t, testConfig(), nil)
+	ch := m.SubscribeLogs()
+	defer m.UnsubscribeLogs(ch)
+
+	m.StartAll()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case msg := <-ch:
+			if msg.ProcessID == "c1" && msg.Stream == "stderr" && msg.Level == "info" && msg.Target == "phantun::client" &&
+				msg.Message == "Remote address is: 192.0.2.1:4567" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no parsed client log line received")
+		}
+	}
+}
+
+func TestBinaryVersionSelection(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"phantun_client", "phantun_server"} {
+		os.MkdirAll(filepath.Join(dir, "v0.6.0"), 0o755)
+		if err := os.WriteFile(filepath.Join(dir, "v0.6.0", name), []byte("#!/bin/sh\necho phantun 0.6.0\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.Clients[0].Binary = "v0.6.0"
+	cfg.Servers[0].Binary = "v9.9.9"
+
+	var mu sync.Mutex
+	launched := map[string]string{}
+	m, _ := newTestManager(t, cfg, func(binary string, args []string) []string {
+		mu.Lock()
+		launched[argValue(args, "--tun")] = binary
+		mu.Unlock()
+		return nil
+	})
+	if err := m.SetBinariesDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	m.StartAll()
+	waitFor(t, 2*time.Second, "client to run", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.Running
+	})
+
+	mu.Lock()
+	got := launched["tun0"]
+	mu.Unlock()
+	if want := filepath.Join(dir, "v0.6.0", "phantun_client"); got != want {
+		t.Errorf("client launched %q, want %q", got, want)
+	}
+	if st, _ := findStatus(m, "c1"); st.Binary != "v0.6.0" {
+		t.Errorf("status binary = %q, want v0.6.0", st.Binary)
+	}
+
+	st, _ := findStatus(m, "s1")
+	if st.State != StateFailedToStart || !strings.Contains(st.LastError, "v9.9.9") {
+		t.Errorf("missing version must fail to start, got %+v", st)
+	}
+
+	versions, err := m.BinaryVersions()
+	if err != nil || len(versions) != 1 || versions[0].Name != "v0.6.0" {
+		t.Fatalf("BinaryVersions = %+v, %v", versions, err)
+	}
+	if v := versions[0].Client; v == nil || v.Version != "phantun 0.6.0" {
+		t.Errorf("client version = %+v", v)
+	}
+}
+
+func TestPinnedChecksums(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"good", "bad"} {
+		os.MkdirAll(filepath.Join(dir, v), 0o755)
+		for _, name := range []string{"phantun_client", "phantun_server"} {
+			if err := os.WriteFile(filepath.Join(dir, v, name), []byte("#!/bin/sh\necho "+v+"\n"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	good, _ := fileSHA256(filepath.Join(dir, "good", "phantun_client"))
+	manifest := filepath.Join(dir, "checksums.sha256")
+	pins := good + "  good/phantun_client\n" + strings.Repeat("0", 64) + "  bad/phantun_server\n"
+	if err := os.WriteFile(manifest, []byte(pins), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []config.IntegrityPolicy{config.IntegrityWarn, config.IntegrityRefuse} {
+		t.Run(string(policy), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.General.Integrity.Policy = policy
+			cfg.Clients[0].Binary = "good"
+			cfg.Servers[0].Binary = "bad"
+			m, _ := newTestManager(t, cfg, nil)
+			m.SetBinariesDir(dir)
+			m.SetChecksumManifest(manifest)
+
+			m.StartAll()
+			c1, _ := findStatus(m, "c1")
+			if c1.Integrity == nil || c1.Integrity.Pin != PinVerified || c1.Integrity.SHA256 != good || c1.Integrity.Version != "good" {
+				t.Errorf("client integrity = %+v", c1.Integrity)
+			}
+
+			s1, _ := findStatus(m, "s1")
+			if policy == config.IntegrityRefuse {
+				if s1.State != StateFailedToStart || !strings.Contains(s1.LastError, "does not match") {
+					t.Errorf("mismatch must refuse to start, got %+v", s1)
+				}
+			} else if s1.Integrity == nil || s1.Integrity.Pin != PinMismatch || !s1.Running {
+				t.Errorf("mismatch must warn and start, got %+v", s1)
+			}
+		})
+	}
+}
+
+func TestBinaryCacheNoticesSwap(t *testing.T) {
+	m, _ := newTestManager(t, testConfig(), nil)
+	file := filepath.Join(t.TempDir(), "phantun_client")
+	write := func(content string) {
+		tmp := file + ".new"
+		if err := os.WriteFile(tmp, []byte("#!/bin/sh\necho "+content+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Unix(1700000000, 0)
+		os.Chtimes(tmp, old, old)
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("one")
+	first := m.describeBinary(file)
+	// Same size and mtime, different content and inode
+	write("two")
+	second := m.describeBinary(file)
+	if first.SHA256 == "" || first.SHA256 == second.SHA256 || second.Version != "two" {
+		t.Errorf("swapped binary served from cache: %+v then %+v", first, second)
+	}
+}
+
+func TestInstallBinariesRollsBack(t *testing.T) {
+	defer func(d time.Duration) { installSettle = d }(installSettle)
+	installSettle = time.Second
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := append(append([]byte(nil), good...), "broken"...)
+
+	if _, err := (&Manager{}).InstallBinaries(InstallRequest{Version: "v1", Data: []byte("#!/bin/sh\n"), Name: "phantun_client"}); !errors.Is(err, ErrInvalidBinary) {
+		t.Errorf("script must be rejected as not ELF, got %v", err)
+	}
+	if _, err := (&Manager{}).InstallBinaries(InstallRequest{Version: "v1", Data: good, Name: "phantun_client", SHA256: strings.Repeat("0", 64)}); !errors.Is(err, ErrInvalidBinary) {
+		t.Errorf("checksum mismatch must be rejected, got %v", err)
+	}
+
+	cfg := testConfig()
+	cfg.Clients[0].Binary = "v1"
+	// The broken build is the one with the extra bytes: it crashes right away
+	m, _ := newTestManager(t, cfg, func(binary string, _ []string) []string {
+		if st, err := os.Stat(binary); err == nil && st.Size() == int64(len(bad)) {
+			return []string{FakeExitAfterEnv + "=100ms"}
+		}
+		return nil
+	})
+	dir := t.TempDir()
+	m.SetBinariesDir(dir)
+
+	if _, err := m.InstallBinaries(InstallRequest{Version: "v1", Data: good, Name: "phantun_client"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	m.StartAll()
+	if st, _ := findStatus(m, "c1"); !st.Running {
+		t.Fatalf("client not running on v1: %+v", st)
+	}
+
+	res, err := m.InstallBinaries(InstallRequest{Version: "v1", Data: bad, Name: "phantun_client", Restart: true})
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if !res.RolledBack || len(res.Restarted) != 1 || res.Restarted[0] != "c1" {
+		t.Errorf("want rollback after restarting c1, got %+v", res)
+	}
+	if st, _ := os.Stat(filepath.Join(dir, "v1", "phantun_client")); st == nil || st.Size() != int64(len(good)) {
+		t.Error("previous binary was not restored")
+	}
+	if st, _ := findStatus(m, "c1"); !st.Running {
+		t.Errorf("client not running after rollback: %+v", st)
+	}
+}
+
+func TestResourceHistory(t *testing.T) {
+	cfg := testConfig()
+	m, _ := newTestManager(t, cfg, nil)
+	m.StartAll()
+	client, _ := findStatus(m, "c1")
+
+	// A saved but not yet reconciled removal keeps the history
+	prev := cfg.Snapshot()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg.Update(cfg.General, nil, cfg.Servers)
+	}()
+	m.sampleResources()
+	<-done
+	m.sampleResources()
+	h, err := m.ResourceHistory("c1")
+	if err != nil || len(h) != 2 || h[1].PID != client.PID {
+		t.Fatalf("want two samples of PID %d, got %+v, %v", client.PID, h, err)
+	}
+
+	m.Reconcile(prev)
+	m.sampleResources()
+	if _, err := m.ResourceHistory("c1"); !errors.Is(err, ErrInstanceNotFound) {
+		t.Errorf("removed instance: want ErrInstanceNotFound, got %v", err)
+	}
+	m.resourcesMu.Lock()
+	_, kept := m.resources["c1"]
+	m.resourcesMu.Unlock()
+	if kept {
+		t.Error("history of the removed instance kept")
+	}
+}
+
+func TestResourceLimitsApplied(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clients[0].Limits = &config.ResourceLimits{
+		Nice:         5,
+		CPUAffinity:  "0",
+		MaxOpenFiles: 256,
+		OOMScoreAdj:  500,
+	}
+	m, _ := newTestManager(t, cfg, nil)
+	m.StartAll()
+
+	st, _ := findStatus(m, "c1")
+	if !st.Running {
+		t.Fatalf("client not running: %+v", st)
+	}
+	proc := fmt.Sprintf("/proc/%d/", st.PID)
+	read := func(name string) string {
+		data, err := os.ReadFile(proc + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if got := strings.TrimSpace(read("oom_score_adj")); got != "500" {
+		t.Errorf("oom_score_adj = %s, want 500", got)
+	}
+	if !strings.Contains(read("limits"), "Max open files            256                  256") {
+		t.Errorf("RLIMIT_NOFILE not applied:\n%s", read("limits"))
+	}
+	if !strings.Contains(read("status"), "Cpus_allowed_list:\t0\n") {
+		t.Error("CPU affinity not applied")
+	}
+	stat := read("stat")
+	if fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:]); fields[16] != "5" {
+		t.Errorf("nice = %s, want 5", fields[16])
+	}
+}
+
+func TestResourceLimitsFailStart(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clients[0].Limits = &config.ResourceLimits{CPUAffinity: "1023"} // No such CPU
+	m, _ := newTestManager(t, cfg, nil)
+	m.StartAll()
+
+	st, _ := findStatus(m, "c1")
+	if st.Running || st.State != StateFailedToStart || !strings.Contains(st.LastError, "CPU affinity") {
+		t.Errorf("unappliable limits must fail the start, got %+v", st)
+	}
+}
+
+func TestNetnsIsolation(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clients[0].Netns = true
+	cfg.Servers[0].Netns = true
+	m, fw := newTestManager(t, cfg, nil)
+	ns := &recordingNamespaces{live: map[string]system.Netns{
+		"phantun-stale": {Name: "phantun-stale"},
+	}}
+	m.netns = ns
+
+	if err := m.StartAll(); err != nil {
+		t.Fatal(err)
+	}
+	if ns.has("phantun-stale") {
+		t.Error("stale namespace was not cleaned up")
+	}
+	if !ns.has("phantun-c1") || !ns.has("phantun-s1") {
+		t.Fatalf("namespaces not created: %v", ns.live)
+	}
+	if len(ns.joined) != 2 {
+		t.Errorf("commands moved into %v, want both instances", ns.joined)
+	}
+	if fw.count("SetupClientNetns:c1") != 1 || fw.count("SetupClient:c1") != 0 {
+		t.Errorf("client rules not installed in its namespace: %v", fw.calls)
+	}
+
+	// Loopback addresses are rewritten to the veth pair
+	c, _ := findStatus(m, "c1")
+	if c.Local != "10.231.0.2:5000" || c.Netns != "phantun-c1" {
+		t.Errorf("client status = %+v", c)
+	}
+	s, _ := findStatus(m, "s1")
+	if s.Remote != "10.231.0.5:51820" {
+		t.Errorf("server forwards to %s, want the host end of its veth pair", s.Remote)
+	}
+
+	if err := m.StopInstance("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if ns.has("phantun-c1") {
+		t.Error("namespace of stopped client still exists")
+	}
+	if fw.count("CleanupClientNetns:c1") != 1 {
+		t.Errorf("host rules of client not removed: %v", fw.calls)
+	}
+	m.mu.Lock()
+	_, held := m.netnsSlots["c1"]
+	m.mu.Unlock()
+	if held {
+		t.Error("slot of stopped client not freed")
+	}
+}
+
+// portReadiness reports TUN devices as up at once and binds only the listed UDP ports
+type portReadiness struct {
+	bound map[int]bool
+}
+
+func (portReadiness) TunReady(string, string, []string) error { return nil }
+func (r portReadiness) UDPBound(_, port int) error {
+	if !r.bound[port] {
+		return fmt.Errorf("UDP port %d not bound", port)
+	}
+	return nil
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.General.Supervisor.ReadyTimeoutSec = 1
+	cfg.Clients[0].RestartPolicy = config.RestartNever
+	m, _ := newTestManager(t, cfg, nil)
+	m.ready = portReadiness{}
+	ch := m.SubscribeLogs()
+	defer m.UnsubscribeLogs(ch)
+
+	if err := m.StartAll(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "server to become ready", func() bool {
+		st, _ := findStatus(m, "s1")
+		return st.State == StateRunning
+	})
+	if st, _ := findStatus(m, "c1"); st.State != StateStarting || st.ReadyAt != nil {
+		t.Fatalf("client without bound socket reported as %s", st.State)
+	}
+
+	waitFor(t, 3*time.Second, "client to be stopped", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.State == StateCrashed
+	})
+	st, _ := findStatus(m, "c1")
+	if st.Running || !strings.Contains(st.LastError, "not ready after 1s: UDP port 5000 not bound") {
+		t.Errorf("client status = %+v", st)
+	}
+
+	for {
+		select {
+		case msg := <-ch:
+			if msg.ProcessID == "c1" && msg.Stream == "event" && msg.Level == "error" {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no readiness event for the client")
+		}
+	}
+}
+
+func TestHealthCheckRestartsUnhealthyInstance(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.LocalAddr().(*net.UDPAddr).Port)
+	l.Close()
+
+	cfg := testConfig()
+	cfg.Clients[0].LocalPort = port
+	cfg.Clients[0].Health = &config.HealthCheck{
+		Type: config.HealthUDP, IntervalSec: 1, TimeoutSec: 1, FailureThreshold: 2, Restart: true,
+		PayloadHex: "70696e67", ExpectHex: "70696e67",
+	}
+	// The first launch drops the probes, later ones echo them back
+	var launches atomic.Int32
+	m, _ := newTestManager(t, cfg, func(_ string, args []string) []string {
+		if argValue(args, "--tun") == "tun0" && launches.Add(1) > 1 {
+			return []string{FakeEchoEnv + "=1"}
+		}
+		return nil
+	})
+
+	m.StartAll()
+	first, _ := findStatus(m, "c1")
+	waitFor(t, 10*time.Second, "client to turn unhealthy", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.PID != first.PID || (st.Health != nil && st.Health.Status == HealthUnhealthy)
+	})
+
+	waitFor(t, 10*time.Second, "restarted client to pass its health check", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.PID != first.PID && st.Health != nil && st.Health.Status == HealthHealthy
+	})
+	st, _ := findStatus(m, "c1")
+	if st.Health.FailureStreak != 0 || st.Health.LastSuccess == nil || st.Health.Type != config.HealthUDP {
+		t.Errorf("health = %+v", st.Health)
+	}
+	if server, _ := findStatus(m, "s1"); server.Health != nil {
+		t.Errorf("server without health check reports %+v", server.Health)
+	}
+}
+
+func TestAdoptAcrossManagerRestart(t *testing.T) {
+	runDir := t.TempDir()
+	cfg := testConfig()
+	cfg.General.Supervisor.Adopt = true
+	first, _ := newTestManager(t, cfg, nil)
+	first.SetRunDir(runDir)
+	if err := first.StartAll(); err != nil {
+		t.Fatal(err)
+	}
+	client, _ := findStatus(first, "c1")
+	server, _ := findStatus(first, "s1")
+	first.Shutdown()
+	if client.PID == 0 || syscall.Kill(client.PID, 0) != nil || syscall.Kill(server.PID, 0) != nil {
+		t.Fatal("processes did not survive the manager shutdown")
+	}
+
+	// The new manager sees a changed server, which must be restarted
+	cfg = testConfig()
+	cfg.General.Supervisor.Adopt = true
+	cfg.Servers[0].RemotePort = "51821"
+	second, fw := newTestManager(t, cfg, nil)
+	second.SetRunDir(runDir)
+	// Rules of an instance that died with the first manager are still installed
+	fw.mu.Lock()
+	fw.listed = []system.FirewallRule{
+		{Chain: "PHANTUN-NAT", Tag: "phantun:c1", Owner: "c1"},
+		{Chain: "PHANTUN-NAT", Tag: "phantun:gone", Owner: "gone"},
+	}
+	fw.mu.Unlock()
+	if err := second.StartAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, _ := findStatus(second, "c1")
+	if st.PID != client.PID || st.State != StateRunning {
+		t.Errorf("client not adopted: %+v (was PID %d)", st, client.PID)
+	}
+	if fw.count("SetupClient:c1") != 1 {
+		t.Errorf("rules of the adopted client not checked: %v", fw.calls)
+	}
+	if fw.count("CleanupInstance:gone") != 1 || fw.count("CleanupInstance:c1") != 0 {
+		t.Errorf("want only the leftover rules removed: %v", fw.calls)
+	}
+	st, _ = findStatus(second, "s1")
+	if st.PID == server.PID || st.PID == 0 {
+		t.Errorf("changed server kept PID %d", server.PID)
+	}
+	waitFor(t, 2*time.Second, "old server to be stopped", func() bool {
+		return syscall.Kill(server.PID, 0) != nil
+	})
+
+	// The adopted client is still supervised: its exit is noticed
+	second.StopInstance("c1")
+	if _, err := os.Stat(filepath.Join(runDir, "c1.pid")); !os.IsNotExist(err) {
+		t.Errorf("PID file of stopped client still present: %v", err)
+	}
+}
+
+func TestScheduleWindows(t *testing.T) {
+	expr, err := cron.Parse("*/15 9-17 * * MON-FRI")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	friday := time.Date(2026, 10, 16, 17, 50, 0, 0, time.UTC)
+	if next := expr.Next(friday); !next.Equal(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("want next fire on Monday 09:00, got %s", next)
+	}
+
+	// A one-minute window on New Year's Day keeps the client down for this test
+	cfg := testConfig()
+	cfg.Clients[0].Schedule = &config.Schedule{Start: "0 0 1 1 *", Stop: "1 0 1 1 *", Timezone: "UTC"}
+	m, _ := newTestManager(t, cfg, nil)
+	m.StartAll()
+
+	st, _ := findStatus(m, "c1")
+	if st.Running || st.State != StateScheduledOff || st.Schedule == nil || st.Schedule.NextAction != "start" {
+		t.Fatalf("client outside its window must wait for the schedule: %+v", st)
+	}
+	if st, _ := findStatus(m, "s1"); !st.Running {
+		t.Errorf("unscheduled server must start: %+v", st)
+	}
+
+	opens := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.mu.Lock()
+	m.runSchedules(opens.Add(-time.Minute), opens.Add(30*time.Second))
+	m.mu.Unlock()
+	if st, _ := findStatus(m, "c1"); !st.Running {
+		t.Fatalf("client must start when its window opens: %+v", st)
+	}
+
+	m.mu.Lock()
+	m.runSchedules(opens.Add(30*time.Second), opens.Add(90*time.Second))
+	m.mu.Unlock()
+	if st, _ := findStatus(m, "c1"); st.Running || st.State != StateScheduledOff {
+		t.Fatalf("client must stop when its window closes: %+v", st)
+	}
+
+	// A manual start holds until the next transition
+	if err := m.StartInstance("c1"); err != nil {
+		t.Fatalf("StartInstance: %v", err)
+	}
+	if st, _ := findStatus(m, "c1"); !st.Running || st.Schedule.Override != "running" {
+		t.Fatalf("want manual override reported, got %+v", st.Schedule)
+	}
+	m.mu.Lock()
+	m.runSchedules(time.Now(), time.Now().Add(time.Second))
+	m.mu.Unlock()
+	if st, _ := findStatus(m, "c1"); !st.Running {
+		t.Errorf("manual start must hold until the next transition: %+v", st)
+	}
+
+	// So does a manual restart of a stopped instance
+	m.StopInstance("c1")
+	if err := m.RestartInstance("c1"); err != nil {
+		t.Fatalf("RestartInstance: %v", err)
+	}
+	m.mu.Lock()
+	m.runSchedules(time.Now(), time.Now().Add(time.Second))
+	m.mu.Unlock()
+	if st, _ := findStatus(m, "c1"); !st.Running || st.Schedule.Override != "running" {
+		t.Errorf("manual restart must hold until the next transition: %+v", st)
+	}
+}
+
+func TestFirewallBackendSelection(t *testing.T) {
+	for backend, want := range map[config.FirewallBackend]string{
+		config.FirewallIptables: "iptables",
+		config.FirewallNftables: "nftables",
+	} {
+		if got := SelectFirewall(backend).Name(); got != want {
+			t.Errorf("%s: want %s backend, got %s", backend, want, got)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.General.Firewall.Backend = "pf"
+	if err := cfg.Validate(); err == nil {
+		t.Error("unknown firewall backend must be rejected")
+	}
+
+	// IDs end up unquoted in rule comments
+	for _, id := range []string{"a b", `c"1`, "c1;x", strings.Repeat("x", 65)} {
+		cfg = testConfig()
+		cfg.Clients[0].ID = id
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("ID %q must be rejected", id)
+		}
+	}
+	cfg = testConfig()
+	cfg.Clients[0].ID = "0b6f2c1e-6f4e-4c1a-9d0e-3f1d2a7b8c9d"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("generated ID rejected: %v", err)
+	}
+
+	// Rules, logs and TUN devices are keyed by ID and name
+	cfg = testConfig()
+	cfg.Servers[0].ID = cfg.Clients[0].ID
+	if err := cfg.Validate(); err == nil {
+		t.Error("duplicate ID must be rejected")
+	}
+	cfg = testConfig()
+	cfg.Servers[0].TunName = cfg.Clients[0].TunName
+	if err := cfg.Validate(); err == nil {
+		t.Error("duplicate TUN name on the host must be rejected")
+	}
+	cfg.Servers[0].Netns = true
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("TUN name in its own namespace rejected: %v", err)
+	}
+
+	// Status and rule listing go through whichever backend the manager uses
+	m, _ := newTestManager(t, testConfig(), nil)
+	m.StartAll()
+	if m.FirewallName() != "recording" {
+		t.Errorf("want injected backend, got %s", m.FirewallName())
+	}
+	if stats, _ := m.FirewallStats(); stats["total"] != 2 {
+		t.Errorf("want stats of both instances, got %v", stats)
+	}
+	if rules, _ := m.FirewallRules(); !strings.Contains(rules, "SetupServer:s1") {
+		t.Errorf("want rules from the backend, got %q", rules)
+	}
+}
+
+func TestFirewallRuleOwnership(t *testing.T) {
+	m, fw := newTestManager(t, testConfig(), nil)
+	m.StartAll()
+	if err := m.StopInstance("s1"); err != nil {
+		t.Fatal(err)
+	}
+	fw.mu.Lock()
+	fw.listed = []system.FirewallRule{
+		{Chain: "POSTROUTING", Tag: "phantun", Spec: "jump"},
+		{Chain: "PHANTUN-POST", Tag: "phantun:c1", Owner: "c1", Spec: "c1 masq"},
+		{Chain: "PHANTUN-PRE", Tag: "phantun:s1", Owner: "s1", Spec: "s1 dnat"},
+		{Chain: "PHANTUN-PRE", Tag: "phantun:gone", Owner: "gone", Spec: "gone dnat"},
+		{Chain: "PHANTUN-POST", Spec: "manual"},
+	}
+	fw.mu.Unlock()
+
+	own, err := m.FirewallOwnership()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(own.Manager) != 1 || len(own.Untagged) != 1 || own.Untagged[0].Spec != "manual" {
+		t.Errorf("want one manager and one untagged rule, got %+v", own)
+	}
+	orphaned := map[string]bool{}
+	for _, g := range own.Instances {
+		orphaned[g.ID] = g.Orphaned
+	}
+	if len(own.Instances) != 3 || orphaned["c1"] || !orphaned["s1"] || !orphaned["gone"] {
+		t.Errorf("want c1 owned, stopped s1 and unknown instance orphaned, got %+v", own.Instances)
+	}
+
+	// Only instances without live rules can be cleaned up, one at a time
+	if err := m.CleanupInstanceRules("c1"); !errors.Is(err, ErrInstanceRunning) {
+		t.Errorf("cleanup of a running instance: want ErrInstanceRunning, got %v", err)
+	}
+	if err := m.CleanupInstanceRules("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if fw.count("CleanupInstance:gone") != 1 || fw.count("CleanupInstance:c1") != 0 || fw.count("CleanupAll:") != 0 {
+		t.Errorf("unexpected firewall calls: %v", fw.calls)
+	}
+}
+
+// On an nft-only host the groups come from the comments in the phantun table
+func TestNftablesRuleOwnership(t *testing.T) {
+	dir := t.TempDir()
+	listing := `table inet phantun { # handle 12
+	chain prerouting { # handle 1
+		meta nfproto ipv4 tcp dport 4567 dnat ip to 192.168.201.2 comment "phantun:s1 dnat tcp/4567 192.168.201.2" # handle 5
+	}
+	chain postrouting { # handle 2
+		ip saddr 192.168.200.2 masquerade comment "phantun:c1 masq 192.168.200.2" # handle 6
+		ip saddr 192.168.202.2 masquerade comment "phantun:gone masq 192.168.202.2" # handle 9
+		ip saddr 10.0.0.0/8 masquerade # handle 7
+		ip saddr 10.1.0.0/16 masquerade comment "phantunx" # handle 10
+	}
+}
+`
+	nft := "#!/bin/sh\nif [ \"$*\" = \"-a list table inet phantun\" ]; then cat \"$FAKE_NFT_DIR/table\"; fi\n"
+	os.WriteFile(filepath.Join(dir, "nft"), []byte(nft), 0o755)
+	os.WriteFile(filepath.Join(dir, "table"), []byte(listing), 0o644)
+	t.Setenv("FAKE_NFT_DIR", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	m := NewManagerWithOptions(testConfig(), Options{
+		Runner:     FakeRunner{},
+		Firewall:   NftablesFirewall{},
+		Tuns:       NoopTuns{},
+		Namespaces: NoopNamespaces{},
+		Readiness:  NoopReadiness{},
+	})
+	t.Cleanup(m.StopAll)
+	m.StartAll()
+	if err := m.StopInstance("s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	own, err := m.FirewallOwnership()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(own.Manager) != 0 || len(own.Untagged) != 2 {
+		t.Errorf("want the hand-made and phantunx rules untagged, got %+v", own)
+	}
+	var groups []string
+	for _, g := range own.Instances {
+		groups = append(groups, fmt.Sprintf("%s:%d:%v", g.ID, len(g.Rules), g.Orphaned))
+	}
+	if got := strings.Join(groups, " "); got != "c1:1:false gone:1:true s1:1:true" {
+		t.Errorf("want c1 owned, unknown and stopped instances orphaned, got %s", got)
+	}
+}
+
+func TestBackoffDelayStaysWithinMax(t *testing.T) {
+	initial, max := time.Second, 30*time.Second
+	for attempt := 0; attempt < 10; attempt++ {
+		for i := 0; i < 200; i++ {
+			d := backoffDelay(attempt, initial, max)
+			if d > max || d < initial*4/5 {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, d, initial*4/5, max)
+			}
+		}
+	}
+}
+
+func TestReconcileRestartsGivenUpInstance(t *testing.T) {
+	cfg := testConfig()
+	cfg.General.Supervisor.CrashLoopMax = 2
+	var fixed atomic.Bool
+	m, _ := newTestManager(t, cfg, func(_ string, args []string) []string {
+		if argValue(args, "--tun") == "tun0" && !fixed.Load() {
+			return []string{FakeExitAfterEnv + "=50ms"}
+		}
+		return nil
+	})
+
+	m.StartAll()
+	waitFor(t, 5*time.Second, "crash-loop breaker", func() bool {
+		st, _ := findStatus(m, "c1")
+		return st.Backoff != nil && st.Backoff.GaveUp
+	})
+
+	// The fix (here: the crash) is not part of the instance's settings
+	fixed.Store(true)
+	result := m.Reconcile(cfg.Snapshot())
+	if fmt.Sprint(result.Added, result.Restarted, result.Unchanged) != "[] [c1] [s1]" {
+		t.Errorf("want the given up client started again, got %+v", result)
+	}
+	st, _ := findStatus(m, "c1")
+	if !st.Running || st.Backoff != nil {
+		t.Errorf("want running with a fresh supervisor, got %+v", st)
+	}
+
+	// Saving an unrelated change leaves a stopped instance alone
+	if err := m.StopInstance("s1"); err != nil {
+		t.Fatal(err)
+	}
+	prev := cfg.Snapshot()
+	clients := append([]config.ClientConfig(nil), cfg.Clients...)
+	clients[0].Alias = "renamed"
+	cfg.Update(cfg.General, clients, cfg.Servers)
+	result = m.Reconcile(prev)
+	if fmt.Sprint(result.Restarted, result.Unchanged) != "[] [c1 s1]" {
+		t.Errorf("want both unchanged, got %+v", result)
+	}
+	if st, _ := findStatus(m, "s1"); st.Running {
+		t.Errorf("manually stopped server started by a save: %+v", st)
+	}
+}
+
+func TestLogHistoryPagesAcrossRotation(t *testing.T) {
+	m, _ := newTestManager(t, testConfig(), nil)
+	dir := t.TempDir()
+	store, err := logstore.Open(dir, logstore.Options{MaxFileBytes: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	m.logStore = store
+
+	// Groups of three share a timestamp, so pages split inside a group
+	base := time.Now()
+	for i := 0; i < 30; i++ {
+		msg := NewLogMessage("c1", "stderr", fmt.Sprintf("line %02d", i))
+		msg.Timestamp = base.Add(time.Duration(i/3) * time.Microsecond)
+		m.persistLog(msg)
+	}
+	if files, _ := store.Files("c1"); len(files) < 4 {
+		t.Fatalf("want several rotated files, got %d", len(files))
+	}
+
+	seen := map[string]bool{}
+	var last time.Time
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("cursor does not advance")
+		}
+		page, err := m.LogHistory(LogFilter{}, cursor, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range page.Entries {
+			if seen[msg.Content] {
+				t.Errorf("%s returned twice", msg.Content)
+			}
+			if !last.IsZero() && msg.Timestamp.After(last) {
+				t.Errorf("%s is newer than the entry before it", msg.Content)
+			}
+			seen[msg.Content] = true
+			last = msg.Timestamp
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 30 {
+		t.Errorf("want all 30 lines once, got %d", len(seen))
+	}
+
+	// Forged cursors are rejected instead of sizing the scan
+	for _, c := range []string{`{"t":1,"s":-50}`, `{"t":1,"s":1000000000}`, `[1]`} {
+		cursor := base64.RawURLEncoding.EncodeToString([]byte(c))
+		if _, err := m.LogHistory(LogFilter{}, cursor, 10); err == nil || err.Error() != "invalid cursor" {
+			t.Errorf("cursor %s: want invalid cursor, got %v", c, err)
+		}
+	}
+
+	// A full first page does not need the oldest files: an unreadable one is not touched
+	bad := filepath.Join(dir, "c1-20000101T000000.000000000.log.gz")
+	if err := os.WriteFile(bad, []byte("not gzip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := base.Add(-time.Hour)
+	os.Chtimes(bad, old, old)
+	if page, err := m.LogHistory(LogFilter{}, "", 4); err != nil || len(page.Entries) != 4 {
+		t.Errorf("first page must not read old files: %v", err)
+	}
+	if _, err := m.LogHistory(LogFilter{Text: "no such line"}, "", 4); err == nil {
+		t.Error("a page that cannot be filled must scan every file")
+	}
+}
@@ -0,0 +1,158 @@
+package process
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReadyTimeout = 10 * time.Second
+	readyPollInterval   = 100 * time.Millisecond
+)
+
+// tunReady checks an interface's state against the addresses phantun assigns
+func tunReady(name string, up bool, have, want []string) error {
+	if !up {
+		return fmt.Errorf("TUN %s is not up", name)
+	}
+	var missing []string
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, w)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("TUN %s lacks address %s", name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkReady returns nil once the TUN device is up with its addresses and,
+// for clients, the UDP listen port is bound
+func (m *Manager) checkReady(p *Process) error {
+	netns := ""
+	if p.Netns != nil {
+		netns = p.Netns.Name
+	}
+
+	var addrs []string
+	if p.Type == "client" {
+		addrs = append(addrs, p.ClientCfg.TunLocal)
+		if !p.ClientCfg.IPv4Only && p.ClientCfg.TunLocalIPv6 != "" {
+			addrs = append(addrs, p.ClientCfg.TunLocalIPv6)
+		}
+	} else {
+		addrs = append(addrs, p.ServerCfg.TunLocal)
+		if !p.ServerCfg.IPv4Only && p.ServerCfg.TunLocalIPv6 != "" {
+			addrs = append(addrs, p.ServerCfg.TunLocalIPv6)
+		}
+	}
+	// Without a TUN name phantun picks one itself, so only the socket can be checked
+	if tun := p.tunName(); tun != "" {
+		if err := m.ready.TunReady(netns, tun, addrs); err != nil {
+			return err
+		}
+	}
+
+	if p.Type == "client" {
+		port, err := strconv.Atoi(p.ClientCfg.LocalPort)
+		if err != nil {
+			return fmt.Errorf("invalid local port %q", p.ClientCfg.LocalPort)
+		}
+		if err := m.ready.UDPBound(p.Cmd.Process.Pid, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitReady polls a freshly started process until it is ready, then reports
+// it as running. A process that is not ready within the timeout is killed and
+// handed to the supervisor like a crash.
+func (m *Manager) awaitReady(p *Process, timeout time.Duration) {
+	start := time.Now()
+	deadline := time.After(timeout)
+	tick := time.NewTicker(readyPollInterval)
+	defer tick.Stop()
+
+	for {
+		err := m.checkReady(p)
+		if err == nil {
+			m.markReady(p, time.Since(start))
+			return
+		}
+		select {
+		case <-p.done:
+			return // monitorProcess reports the exit
+		case <-deadline:
+			m.markNotReady(p, fmt.Errorf("not ready after %s: %w", timeout, err))
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (m *Manager) markReady(p *Process, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.processes[p.ConfigID] != p {
+		return // Stopped or replaced meanwhile
+	}
+	m.setReady(p)
+	m.instanceEvent(p.ConfigID, "info", "Instance ready after %s", took.Round(time.Millisecond))
+}
+
+// setReady reports a process as running and starts its health checks.
+// Caller must hold m.mu.
+func (m *Manager) setReady(p *Process) {
+	p.ReadyAt = time.Now()
+	m.setState(p.ConfigID, StateRunning, nil)
+	if hc := p.healthCheck(); hc != nil {
+		p.health = &healthState{check: *hc, status: HealthUnknown}
+		go m.monitorHealth(p, *hc)
+	}
+}
+
+func (m *Manager) markNotReady(p *Process, err error) {
+	m.mu.Lock()
+	if m.processes[p.ConfigID] != p {
+		m.mu.Unlock()
+		return
+	}
+	p.readyErr = err
+	log.Printf("[ERROR] Instance %s: %v", p.ConfigID, err)
+	m.instanceEvent(p.ConfigID, "error", "Instance %v, stopping it", err)
+	m.mu.Unlock()
+
+	// monitorProcess records readyErr as the exit reason
+	p.Cmd.Process.Kill()
+}
+
+// readyTimeout returns the configured readiness timeout. Caller must hold m.mu.
+func (m *Manager) readyTimeout() time.Duration {
+	return secondsOr(m.conf.General.Supervisor.ReadyTimeoutSec, defaultReadyTimeout)
+}
+
+// instanceEvent adds a lifecycle event to the log of an instance
+func (m *Manager) instanceEvent(id, level, format string, a ...interface{}) {
+	text := fmt.Sprintf(format, a...)
+	m.BroadcastLog(LogMessage{
+		Timestamp: time.Now(),
+		ProcessID: id,
+		Stream:    "event",
+		Content:   text,
+		Level:     level,
+		Target:    "phantun_docker",
+		Message:   text,
+	})
+}
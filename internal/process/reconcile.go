@@ -0,0 +1,211 @@
+package process
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"phantun-docker/internal/config"
+)
+
+// ReconcileResult reports what Reconcile did, by instance ID
+type ReconcileResult struct {
+	Added     []string          `json:"added"`
+	Changed   []string          `json:"changed"`
+	Restarted []string          `json:"restarted"` // Unchanged, but crashed, given up or failed to start
+	Removed   []string          `json:"removed"`
+	Unchanged []string          `json:"unchanged"`
+	Errors    map[string]string `json:"errors,omitempty"` // Instances that failed to (re)start
+}
+
+// Reconcile applies the difference between a previous configuration and the
+// current one. Only instances whose effective settings changed are restarted;
+// new ones, and unchanged ones that crashed, gave up or failed to start, are
+// started, removed or disabled ones are stopped, and everything else keeps
+// running or, if stopped by hand, stays down.
+func (m *Manager) Reconcile(prev config.Snapshot) ReconcileResult {
+	m.prepareBinaries()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	oldSpecs := effectiveSpecs(prev)
+	cur := m.cfg.Snapshot()
+	m.conf = cur
+	m.logLevel.Store(cur.General.LogLevel)
+	newSpecs := effectiveSpecs(cur)
+
+	result := ReconcileResult{
+		Added:     []string{},
+		Changed:   []string{},
+		Restarted: []string{},
+		Removed:   []string{},
+		Unchanged: []string{},
+	}
+	fail := func(id string, err error) {
+		if result.Errors == nil {
+			result.Errors = make(map[string]string)
+		}
+		result.Errors[id] = err.Error()
+		log.Printf("Reconcile: instance %s: %v", id, err)
+	}
+
+	for id := range oldSpecs {
+		if _, ok := newSpecs[id]; !ok {
+			if err := m.stopInstance(id); err != nil && err != ErrInstanceNotFound {
+				fail(id, err)
+			}
+			result.Removed = append(result.Removed, id)
+		}
+	}
+
+	for id, spec := range newSpecs {
+		old, existed := oldSpecs[id]
+		switch {
+		case !existed:
+			if err := m.startScheduled(id, now); err != nil {
+				fail(id, err)
+			}
+			result.Added = append(result.Added, id)
+		case !reflect.DeepEqual(old, spec):
+			if err := m.stopInstance(id); err != nil {
+				fail(id, err)
+			}
+			if err := m.startScheduled(id, now); err != nil {
+				fail(id, err)
+			}
+			result.Changed = append(result.Changed, id)
+		case m.failed(id):
+			// Saving retries it like a new instance, with a fresh supervisor
+			if err := m.stopInstance(id); err != nil {
+				fail(id, err)
+			}
+			if !reflect.DeepEqual(scheduleOf(prev, id), scheduleOf(cur, id)) {
+				delete(m.overrides, id)
+			}
+			if err := m.startScheduled(id, now); err != nil {
+				fail(id, err)
+			}
+			result.Restarted = append(result.Restarted, id)
+		default:
+			m.refreshCosmetics(id)
+			// A new schedule applies right away, without restarting a running instance
+			if !reflect.DeepEqual(scheduleOf(prev, id), scheduleOf(cur, id)) {
+				delete(m.overrides, id)
+				m.applySchedule(id, !m.scheduledDown(id, now))
+			}
+			result.Unchanged = append(result.Unchanged, id)
+		}
+	}
+
+	m.syncStates()
+	m.applyLogStoreSettings()
+	m.wakeScheduler()
+
+	for _, ids := range [][]string{result.Added, result.Changed, result.Restarted, result.Removed, result.Unchanged} {
+		sort.Strings(ids)
+	}
+	log.Printf("Reconcile: %d added, %d changed, %d restarted, %d removed, %d unchanged",
+		len(result.Added), len(result.Changed), len(result.Restarted), len(result.Removed), len(result.Unchanged))
+	return result
+}
+
+// failed reports whether an instance is down because it crashed, gave up or
+// failed to start, rather than stopped by hand. Caller must hold m.mu.
+func (m *Manager) failed(id string) bool {
+	if m.running(id) || m.manualStops[id] {
+		return false
+	}
+	st, ok := m.states[id]
+	return ok && (st.State == StateCrashed || st.State == StateFailedToStart)
+}
+
+// instanceSpec is what Reconcile compares per instance: its settings and the
+// RUST_LOG filter it gets, which may come from the global log_level
+type instanceSpec struct {
+	Settings interface{}
+	RustLog  string
+}
+
+// effectiveSpecs returns the settings that matter to a running instance, keyed
+// by ID. Disabled instances (or all of them, if the global switch is off) are
+// omitted, so enabling or disabling shows up as an add or remove.
+func effectiveSpecs(snap config.Snapshot) map[string]instanceSpec {
+	specs := make(map[string]instanceSpec)
+	if !snap.General.Enabled {
+		return specs
+	}
+	for _, c := range snap.Clients {
+		if c.Enabled {
+			specs[c.ID] = instanceSpec{clientSpec(c), resolveRustLog(c.LogLevel, snap.General.LogLevel)}
+		}
+	}
+	for _, s := range snap.Servers {
+		if s.Enabled {
+			specs[s.ID] = instanceSpec{serverSpec(s), resolveRustLog(s.LogLevel, snap.General.LogLevel)}
+		}
+	}
+	return specs
+}
+
+// clientSpec strips fields that can change without restarting the process
+func clientSpec(c config.ClientConfig) config.ClientConfig {
+	c.Alias = ""
+	c.RestartPolicy = ""
+	c.Schedule = nil
+	return c
+}
+
+// serverSpec strips fields that can change without restarting the process
+func serverSpec(s config.ServerConfig) config.ServerConfig {
+	s.Alias = ""
+	s.RestartPolicy = ""
+	s.Schedule = nil
+	return s
+}
+
+// scheduleOf returns the schedule of an instance in a snapshot, if any
+func scheduleOf(snap config.Snapshot, id string) *config.Schedule {
+	for _, c := range snap.Clients {
+		if c.ID == id {
+			return c.Schedule
+		}
+	}
+	for _, s := range snap.Servers {
+		if s.ID == id {
+			return s.Schedule
+		}
+	}
+	return nil
+}
+
+// startScheduled starts an added or changed instance, unless its schedule
+// holds it down. Caller must hold m.mu.
+func (m *Manager) startScheduled(id string, now time.Time) error {
+	if m.scheduledDown(id, now) {
+		m.setState(id, StateScheduledOff, nil)
+		return nil
+	}
+	return m.startInstance(id)
+}
+
+// refreshCosmetics copies non-effective settings (alias, restart policy,
+// schedule) from the current config into a running process. Caller must hold m.mu.
+func (m *Manager) refreshCosmetics(id string) {
+	p, ok := m.processes[id]
+	if !ok {
+		return
+	}
+	c, s := m.lookupInstance(id)
+	if c != nil {
+		p.ClientCfg.Alias = c.Alias
+		p.ClientCfg.RestartPolicy = c.RestartPolicy
+		p.ClientCfg.Schedule = c.Schedule
+	}
+	if s != nil {
+		p.ServerCfg.Alias = s.Alias
+		p.ServerCfg.RestartPolicy = s.RestartPolicy
+		p.ServerCfg.Schedule = s.Schedule
+	}
+}
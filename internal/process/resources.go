@@ -0,0 +1,152 @@
+package process
+
+import (
+	"time"
+
+	"phantun-docker/internal/system"
+)
+
+const (
+	resourceSampleInterval = 10 * time.Second
+	resourceHistoryLen     = 360 // One hour at the default interval
+)
+
+// ResourceSample is one /proc measurement of an instance
+type ResourceSample struct {
+	Time                   time.Time `json:"time"`
+	PID                    int       `json:"pid"`
+	CPUPercent             float64   `json:"cpu_percent"` // Of one core, since the previous sample
+	RSSBytes               uint64    `json:"rss_bytes"`
+	Threads                int       `json:"threads"`
+	OpenFDs                int       `json:"open_fds"`
+	VoluntaryCtxSwitches   uint64    `json:"voluntary_ctx_switches"`
+	InvoluntaryCtxSwitches uint64    `json:"involuntary_ctx_switches"`
+	ReadBytes              uint64    `json:"read_bytes"`  // Cumulative, includes socket and TUN I/O
+	WriteBytes             uint64    `json:"write_bytes"` // Cumulative, includes socket and TUN I/O
+}
+
+// resourceHistory is a ring of samples for one instance
+type resourceHistory struct {
+	samples  []ResourceSample
+	lastPID  int
+	lastCPU  uint64
+	lastTime time.Time
+}
+
+// StartResourceMonitor samples /proc for every running process on an interval
+func (m *Manager) StartResourceMonitor() {
+	go func() {
+		ticker := time.NewTicker(resourceSampleInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.sampleResources()
+		}
+	}()
+}
+
+// ResourceHistory returns the recorded samples of an instance, oldest first
+func (m *Manager) ResourceHistory(id string) ([]ResourceSample, error) {
+	m.mu.Lock()
+	c, s := m.lookupInstance(id)
+	m.mu.Unlock()
+	if c == nil && s == nil {
+		return nil, ErrInstanceNotFound
+	}
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+
+	h, ok := m.resources[id]
+	if !ok {
+		return []ResourceSample{}, nil
+	}
+	return append([]ResourceSample(nil), h.samples...), nil
+}
+
+// latestResources returns the newest sample of a running process, if any
+func (m *Manager) latestResources(id string, pid int) *ResourceSample {
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+
+	h, ok := m.resources[id]
+	if !ok || len(h.samples) == 0 {
+		return nil
+	}
+	last := h.samples[len(h.samples)-1]
+	if last.PID != pid {
+		return nil
+	}
+	return &last
+}
+
+// sampleResources records one sample per running process and forgets the
+// history of instances that the config in effect no longer has
+func (m *Manager) sampleResources() {
+	m.mu.Lock()
+	pids := make(map[string]int, len(m.processes))
+	for id, p := range m.processes {
+		if p.Cmd.Process != nil {
+			pids[id] = p.Cmd.Process.Pid
+		}
+	}
+	configured := make(map[string]bool)
+	for _, c := range m.conf.Clients {
+		configured[c.ID] = true
+	}
+	for _, s := range m.conf.Servers {
+		configured[s.ID] = true
+	}
+	m.mu.Unlock()
+
+	// Read /proc without holding any lock
+	now := time.Now()
+	stats := make(map[string]system.ProcStats, len(pids))
+	for id, pid := range pids {
+		if st, err := system.ReadProcStats(pid); err == nil {
+			stats[id] = st
+		}
+	}
+
+	m.resourcesMu.Lock()
+	defer m.resourcesMu.Unlock()
+
+	for id, st := range stats {
+		h, ok := m.resources[id]
+		if !ok {
+			h = &resourceHistory{}
+			m.resources[id] = h
+		}
+		pid := pids[id]
+
+		sample := ResourceSample{
+			Time:                   now,
+			PID:                    pid,
+			RSSBytes:               st.RSSBytes,
+			Threads:                st.Threads,
+			OpenFDs:                st.OpenFDs,
+			VoluntaryCtxSwitches:   st.VoluntaryCtxSwitches,
+			InvoluntaryCtxSwitches: st.InvoluntaryCtxSwitches,
+			ReadBytes:              st.ReadBytes,
+			WriteBytes:             st.WriteBytes,
+		}
+		// CPU% needs a previous sample of the same process
+		if h.lastPID == pid && st.CPUTicks >= h.lastCPU {
+			if elapsed := now.Sub(h.lastTime).Seconds(); elapsed > 0 {
+				used := float64(st.CPUTicks-h.lastCPU) / system.ClockTicks
+				sample.CPUPercent = used / elapsed * 100
+			}
+		}
+		h.lastPID, h.lastCPU, h.lastTime = pid, st.CPUTicks, now
+
+		h.samples = append(h.samples, sample)
+		if len(h.samples) > resourceHistoryLen {
+			h.samples = h.samples[len(h.samples)-resourceHistoryLen:]
+		}
+	}
+
+	// Forget instances that are no longer configured
+	for id := range m.resources {
+		if _, running := pids[id]; !running && !configured[id] {
+			delete(m.resources, id)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package process
+
+import (
+	"log"
+	"time"
+
+	"phantun-docker/internal/config"
+	"phantun-docker/internal/cron"
+)
+
+// schedulerMaxSleep bounds how long the scheduler sleeps, so schedules added
+// by a config change are picked up even without a wake-up
+const schedulerMaxSleep = time.Minute
+
+// ScheduleDTO describes the schedule window of an instance
+type ScheduleDTO struct {
+	InWindow   bool       `json:"in_window"`
+	NextAction string     `json:"next_action,omitempty"` // "start" or "stop"
+	NextAt     *time.Time `json:"next_at,omitempty"`
+	Timezone   string     `json:"timezone"`
+	Override   string     `json:"override,omitempty"` // "running" or "stopped": a manual start or stop held until NextAt
+}
+
+// compiledSchedule is a parsed config.Schedule
+type compiledSchedule struct {
+	start, stop *cron.Expr
+	loc         *time.Location
+}
+
+// scheduleOverride keeps a manually started or stopped instance in that state
+// until the next scheduled transition
+type scheduleOverride struct {
+	running bool
+	until   time.Time
+}
+
+// compileSchedule parses a schedule, caching the result. Caller must hold m.mu.
+func (m *Manager) compileSchedule(s config.Schedule) (*compiledSchedule, error) {
+	if cs, ok := m.schedules[s]; ok {
+		return cs, nil
+	}
+	start, err := cron.Parse(s.Start)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := cron.Parse(s.Stop)
+	if err != nil {
+		return nil, err
+	}
+	loc := time.Local
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	cs := &compiledSchedule{start: start, stop: stop, loc: loc}
+	m.schedules[s] = cs
+	return cs, nil
+}
+
+// window reports whether now lies inside a window (the last start fired after
+// the last stop) and when the next transition is due. A start and stop in the
+// same minute count as a stop.
+func (cs *compiledSchedule) window(now time.Time) (in bool, next time.Time, action string) {
+	t := now.In(cs.loc)
+	lastStart := cs.start.Prev(t)
+	in = !lastStart.IsZero() && lastStart.After(cs.stop.Prev(t))
+
+	nextStart, nextStop := cs.start.Next(t), cs.stop.Next(t)
+	switch {
+	case nextStop.IsZero() && nextStart.IsZero():
+		return in, time.Time{}, ""
+	case nextStop.IsZero() || (!nextStart.IsZero() && nextStart.Before(nextStop)):
+		return in, nextStart, "start"
+	default:
+		return in, nextStop, "stop"
+	}
+}
+
+// instanceSchedule returns the compiled schedule of an enabled instance, or
+// nil if it has none. Caller must hold m.mu.
+func (m *Manager) instanceSchedule(id string) *compiledSchedule {
+	var s *config.Schedule
+	c, srv := m.lookupInstance(id)
+	switch {
+	case c != nil && c.Enabled:
+		s = c.Schedule
+	case srv != nil && srv.Enabled:
+		s = srv.Schedule
+	}
+	if s == nil {
+		return nil
+	}
+	cs, err := m.compileSchedule(*s)
+	if err != nil {
+		log.Printf("[WARNING] Ignoring invalid schedule of instance %s: %v", id, err)
+		return nil
+	}
+	return cs
+}
+
+// scheduledDown reports whether the instance should stay down at now: it has
+// a schedule, now is outside its windows, and no manual start holds it up.
+// Caller must hold m.mu.
+func (m *Manager) scheduledDown(id string, now time.Time) bool {
+	cs := m.instanceSchedule(id)
+	if cs == nil {
+		return false
+	}
+	if o, ok := m.overrides[id]; ok && now.Before(o.until) {
+		return !o.running
+	}
+	in, _, _ := cs.window(now)
+	return !in
+}
+
+// overrideSchedule records a manual start or stop that goes against the
+// schedule, so it holds until the next transition. Caller must hold m.mu.
+func (m *Manager) overrideSchedule(id string, running bool) {
+	cs := m.instanceSchedule(id)
+	if cs == nil {
+		return
+	}
+	in, next, action := cs.window(time.Now())
+	if in == running || next.IsZero() {
+		delete(m.overrides, id)
+		return
+	}
+	m.overrides[id] = scheduleOverride{running: running, until: next}
+	m.instanceEvent(id, "info", "Manual override outside the schedule, holds until the scheduled %s at %s",
+		action, next.Format(time.RFC3339))
+}
+
+// applySchedule starts or stops the instance as its schedule says and drops
+// any manual override. Caller must hold m.mu.
+func (m *Manager) applySchedule(id string, up bool) {
+	delete(m.overrides, id)
+	if up {
+		if m.running(id) {
+			return
+		}
+		m.instanceEvent(id, "info", "Starting as scheduled")
+		if err := m.startInstance(id); err != nil {
+			log.Printf("[ERROR] Scheduled start of instance %s failed: %v", id, err)
+		}
+		return
+	}
+
+	if m.running(id) {
+		m.instanceEvent(id, "info", "Stopping as scheduled")
+	}
+	if err := m.stopInstance(id); err != nil {
+		log.Printf("[ERROR] Scheduled stop of instance %s failed: %v", id, err)
+		return
+	}
+	m.setState(id, StateScheduledOff, nil)
+}
+
+// runSchedules applies the transitions that fired in (from, to] and returns
+// when the next one is due, or the zero time if none is. Caller must hold m.mu.
+func (m *Manager) runSchedules(from, to time.Time) time.Time {
+	if !m.conf.General.Enabled {
+		return time.Time{}
+	}
+	var ids []string
+	for _, c := range m.conf.Clients {
+		ids = append(ids, c.ID)
+	}
+	for _, s := range m.conf.Servers {
+		ids = append(ids, s.ID)
+	}
+
+	var wake time.Time
+	for _, id := range ids {
+		cs := m.instanceSchedule(id)
+		if cs == nil {
+			continue
+		}
+		t := from.In(cs.loc)
+		nextStart, nextStop := cs.start.Next(t), cs.stop.Next(t)
+		started := !nextStart.IsZero() && !nextStart.After(to)
+		stopped := !nextStop.IsZero() && !nextStop.After(to)
+		switch {
+		case started && stopped:
+			// Both fired while we slept: the later one wins
+			m.applySchedule(id, nextStart.After(nextStop))
+		case started:
+			m.applySchedule(id, true)
+		case stopped:
+			m.applySchedule(id, false)
+		}
+
+		if _, next, _ := cs.window(to); !next.IsZero() && (wake.IsZero() || next.Before(wake)) {
+			wake = next
+		}
+	}
+	return wake
+}
+
+// StartScheduler starts and stops instances with a schedule as their windows
+// open and close
+func (m *Manager) StartScheduler() {
+	go func() {
+		last := time.Now()
+		for {
+			now := time.Now()
+			m.prepareBinaries()
+			m.mu.Lock()
+			next := m.runSchedules(last, now)
+			m.mu.Unlock()
+			last = now
+
+			sleep := schedulerMaxSleep
+			if d := time.Until(next); !next.IsZero() && d < sleep {
+				sleep = d
+			}
+			timer := time.NewTimer(sleep)
+			select {
+			case <-timer.C:
+			case <-m.scheduleWake:
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// wakeScheduler makes the scheduler recompute its next transition, e.g.
+// after a config change
+func (m *Manager) wakeScheduler() {
+	select {
+	case m.scheduleWake <- struct{}{}:
+	default:
+	}
+}
+
+// describeSchedule returns the API view of an instance's schedule, or nil if
+// it has none. Caller must hold m.mu.
+func (m *Manager) describeSchedule(id string) *ScheduleDTO {
+	cs := m.instanceSchedule(id)
+	if cs == nil {
+		return nil
+	}
+	now := time.Now()
+	in, next, action := cs.window(now)
+	d := &ScheduleDTO{InWindow: in, NextAction: action, Timezone: cs.loc.String()}
+	if !next.IsZero() {
+		d.NextAt = &next
+	}
+	if o, ok := m.overrides[id]; ok && now.Before(o.until) {
+		d.Override = "stopped"
+		if o.running {
+			d.Override = "running"
+		}
+	}
+	return d
+}
@@ -0,0 +1,121 @@
+package process
+
+import (
+	"log"
+	"time"
+)
+
+// State is the lifecycle state of an instance
+type State string
+
+const (
+	StatePending           State = "pending"             // Enabled, waiting to be launched
+	StateSettingUpFirewall State = "setting-up-firewall" // Installing iptables rules
+	StateStarting          State = "starting"            // Process spawned
+	StateRunning           State = "running"
+	StateStopping          State = "stopping"        // SIGTERM sent, waiting for exit
+	StateExited            State = "exited"          // Exited cleanly or was stopped
+	StateCrashed           State = "crashed"         // Exited with an error
+	StateBackoff           State = "backoff"         // Waiting for the supervisor to restart it
+	StateDisabled          State = "disabled"        // Disabled in config (or global switch off)
+	StateScheduledOff      State = "scheduled-off"   // Outside its schedule window
+	StateFailedToStart     State = "failed-to-start" // Firewall setup or spawn failed
+)
+
+// instanceState tracks the lifecycle of one instance across process lifetimes
+type instanceState struct {
+	State     State
+	Since     time.Time // Last transition
+	LastError string
+	ExitCode  *int
+	PID       int // PID of the process the state refers to, if any
+}
+
+// setState records a transition. A nil error keeps the previous error message,
+// so the reason for a crash stays visible while the instance is in backoff.
+// Caller must hold m.mu.
+func (m *Manager) setState(id string, state State, err error) {
+	st, ok := m.states[id]
+	if !ok {
+		st = &instanceState{}
+		m.states[id] = st
+	}
+	if st.State != state {
+		log.Printf("[DEBUG] Instance %s: %s -> %s", id, orNone(st.State), state)
+	}
+	st.State = state
+	st.Since = time.Now()
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	switch state {
+	case StatePending, StateSettingUpFirewall:
+		// A fresh start attempt: forget the previous exit
+		st.ExitCode = nil
+	}
+}
+
+// setExited records the exit of the process with the given PID
+// Caller must hold m.mu.
+func (m *Manager) setExited(id string, pid int, state State, exitErr error) {
+	m.setState(id, state, exitErr)
+	code := exitCode(exitErr)
+	st := m.states[id]
+	st.ExitCode = &code
+	st.PID = pid
+}
+
+// syncStates marks instances that should not run as disabled and drops the
+// state of instances that are no longer configured. Caller must hold m.mu.
+func (m *Manager) syncStates() {
+	known := make(map[string]bool)
+	for _, c := range m.conf.Clients {
+		known[c.ID] = true
+		if !c.Enabled || !m.conf.General.Enabled {
+			m.markDisabled(c.ID)
+		}
+	}
+	for _, s := range m.conf.Servers {
+		known[s.ID] = true
+		if !s.Enabled || !m.conf.General.Enabled {
+			m.markDisabled(s.ID)
+		}
+	}
+	for id := range m.states {
+		if !known[id] {
+			delete(m.states, id)
+		}
+	}
+	for id := range m.manualStops {
+		if !known[id] {
+			delete(m.manualStops, id)
+		}
+	}
+}
+
+// markDisabled moves an instance to the disabled state unless it is still alive
+func (m *Manager) markDisabled(id string) {
+	if _, running := m.processes[id]; running {
+		return
+	}
+	if st, ok := m.states[id]; ok && st.State == StateDisabled {
+		return
+	}
+	m.setState(id, StateDisabled, nil)
+}
+
+// pendingOrScheduled is the state of an instance about to be launched, unless
+// its schedule holds it down
+func pendingOrScheduled(held bool) State {
+	if held {
+		return StateScheduledOff
+	}
+	return StatePending
+}
+
+func orNone(s State) State {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
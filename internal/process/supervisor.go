@@ -0,0 +1,234 @@
+package process
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"os/exec"
+	"time"
+
+	"phantun-docker/internal/config"
+)
+
+// Supervisor defaults, used when the matching SupervisorConfig field is zero
+const (
+	defaultBackoffInitial  = 1 * time.Second
+	defaultBackoffMax      = 60 * time.Second
+	defaultCrashLoopMax    = 5
+	defaultCrashLoopWindow = 5 * time.Minute
+
+	// A process that stayed up this long is considered healthy again,
+	// so its next crash starts over at the initial backoff.
+	stableRunTime = 2 * time.Minute
+)
+
+// supervisor holds restart bookkeeping for one instance.
+// It outlives individual processes so backoff survives across crashes.
+type supervisor struct {
+	attempts  int         // Consecutive restarts since the last stable run
+	restarts  int         // Total automatic restarts
+	failures  []time.Time // Exit times inside the crash-loop window
+	nextRetry time.Time
+	timer     *time.Timer
+	pending   uint64 // Token of the scheduled retry, bumped to invalidate it
+	gaveUp    bool
+	lastError string
+	lastPID   int
+	last      *Process // Last known process, used to describe the instance while it is down
+}
+
+// BackoffDTO describes the supervisor state of an instance for the API
+type BackoffDTO struct {
+	Attempt        int        `json:"attempt"`
+	NextRetry      *time.Time `json:"next_retry,omitempty"`
+	RecentFailures int        `json:"recent_failures"`
+	GaveUp         bool       `json:"gave_up"` // Crash-loop breaker tripped
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// restartPolicy returns the effective policy of the instance
+func (p *Process) restartPolicy() config.RestartPolicy {
+	policy := p.ClientCfg.RestartPolicy
+	if p.Type == "server" {
+		policy = p.ServerCfg.RestartPolicy
+	}
+	if policy == "" {
+		return config.RestartOnFailure
+	}
+	return policy
+}
+
+// supervisorFor returns the supervisor of an instance, creating it on first use.
+// Caller must hold m.mu.
+func (m *Manager) supervisorFor(id string) *supervisor {
+	sv, ok := m.supervisors[id]
+	if !ok {
+		sv = &supervisor{}
+		m.supervisors[id] = sv
+	}
+	return sv
+}
+
+// resetSupervisors cancels all pending restarts and forgets backoff state.
+// Caller must hold m.mu.
+func (m *Manager) resetSupervisors() {
+	for id, sv := range m.supervisors {
+		if sv.timer != nil {
+			sv.timer.Stop()
+		}
+		delete(m.supervisors, id)
+	}
+}
+
+// handleExit applies the restart policy after a process exited on its own.
+// Caller must hold m.mu.
+func (m *Manager) handleExit(p *Process, exitErr error) {
+	sv := m.supervisorFor(p.ConfigID)
+	sv.last = p
+	if p.Cmd != nil && p.Cmd.Process != nil {
+		sv.lastPID = p.Cmd.Process.Pid
+	}
+	sv.lastError = ""
+	if exitErr != nil {
+		sv.lastError = exitErr.Error()
+	}
+
+	policy := p.restartPolicy()
+	if policy == config.RestartNever || (policy == config.RestartOnFailure && exitErr == nil) {
+		log.Printf("Process %s will not be restarted (policy: %s)", p.ConfigID, policy)
+		return
+	}
+
+	settings := m.conf.General.Supervisor
+	now := time.Now()
+
+	if now.Sub(p.StartTime) >= stableRunTime {
+		sv.attempts = 0
+	}
+
+	// Crash-loop breaker: too many exits within the window means something is
+	// structurally wrong (bad config, missing TUN device), so stop hammering it.
+	window := secondsOr(settings.CrashLoopWindowSec, defaultCrashLoopWindow)
+	recent := sv.failures[:0]
+	for _, t := range sv.failures {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	sv.failures = append(recent, now)
+
+	maxFailures := settings.CrashLoopMax
+	if maxFailures <= 0 {
+		maxFailures = defaultCrashLoopMax
+	}
+	if len(sv.failures) >= maxFailures {
+		sv.gaveUp = true
+		sv.nextRetry = time.Time{}
+		log.Printf("[ERROR] Process %s crashed %d times within %s. Giving up until manual restart.", p.ConfigID, len(sv.failures), window)
+		return
+	}
+
+	delay := backoffDelay(sv.attempts,
+		secondsOr(settings.BackoffInitialSec, defaultBackoffInitial),
+		secondsOr(settings.BackoffMaxSec, defaultBackoffMax))
+	sv.attempts++
+	sv.nextRetry = now.Add(delay)
+
+	sv.pending++
+	token := sv.pending
+	sv.timer = time.AfterFunc(delay, func() { m.retry(p.ConfigID, token) })
+	m.setState(p.ConfigID, StateBackoff, nil)
+	log.Printf("Restarting process %s in %s (attempt %d)", p.ConfigID, delay.Round(time.Millisecond), sv.attempts)
+}
+
+// retry is fired by the backoff timer and respawns the instance from the current config
+func (m *Manager) retry(id string, token uint64) {
+	m.prepareBinaries(id)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sv, ok := m.supervisors[id]
+	if !ok || sv.timer == nil || sv.pending != token {
+		// Cancelled by StopAll or superseded by a newer schedule
+		return
+	}
+	sv.timer = nil
+	sv.nextRetry = time.Time{}
+
+	if _, running := m.processes[id]; running || !m.conf.General.Enabled {
+		return
+	}
+
+	var err error
+	c, srv := m.lookupInstance(id)
+	switch {
+	case c != nil && c.Enabled:
+		err = m.startClient(*c)
+	case srv != nil && srv.Enabled:
+		err = m.startServer(*srv)
+	default:
+		// Removed or disabled while waiting
+		delete(m.supervisors, id)
+		return
+	}
+
+	sv.restarts++
+	if err != nil {
+		log.Printf("Restart of process %s failed: %v", id, err)
+		// Feed the failure back into the backoff loop
+		failed := *sv.last
+		failed.StartTime = time.Now()
+		m.handleExit(&failed, err)
+	}
+}
+
+// describe returns the API view of an instance's supervisor, or nil if it never restarted
+func (sv *supervisor) describe() *BackoffDTO {
+	if sv == nil || (sv.attempts == 0 && !sv.gaveUp && sv.timer == nil) {
+		return nil
+	}
+	dto := &BackoffDTO{
+		Attempt:        sv.attempts,
+		RecentFailures: len(sv.failures),
+		GaveUp:         sv.gaveUp,
+		LastError:      sv.lastError,
+	}
+	if !sv.nextRetry.IsZero() {
+		next := sv.nextRetry
+		dto.NextRetry = &next
+	}
+	return dto
+}
+
+// backoffDelay returns the exponential delay for the given attempt with +/-20%
+// jitter, never more than max
+func backoffDelay(attempt int, initial, max time.Duration) time.Duration {
+	delay := initial
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	delay += time.Duration(rand.Int64N(int64(delay)/5*2+1)) - delay/5
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func secondsOr(sec int, def time.Duration) time.Duration {
+	if sec <= 0 {
+		return def
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// exitCode extracts the exit status from a Wait error (-1 if unknown)
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,147 @@
+package system
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Instance cgroups are created next to the manager's own cgroup v2 group.
+// cgroup v2 only lets a group delegate controllers to children while it holds
+// no processes itself, so the manager moves into a "manager" leaf first.
+// Other processes in the group are left alone; if there are any, resource
+// limits that need a cgroup are unavailable.
+
+const (
+	cgroupMount       = "/sys/fs/cgroup"
+	cgroupManagerLeaf = "manager"
+	cgroupPrefix      = "phantun-"
+)
+
+var (
+	cgroupOnce   sync.Once
+	cgroupParent string
+	cgroupErr    error
+
+	unsafeCgroupName = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// CreateCgroup creates (or reuses) the cgroup of an instance and writes its
+// cpu.max and memory.max. Empty values write "max" (no limit). Returns the
+// cgroup directory.
+func CreateCgroup(name, cpuMax, memoryMax string) (string, error) {
+	parent, err := cgroupBase()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(parent, cgroupPrefix+unsafeCgroupName.ReplaceAllString(name, "_"))
+	if err := os.Mkdir(dir, 0o755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	if cpuMax == "" {
+		cpuMax = "max"
+	}
+	if memoryMax == "" {
+		memoryMax = "max"
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0o644); err != nil {
+		return "", fmt.Errorf("failed to set cpu.max: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memoryMax), 0o644); err != nil {
+		return "", fmt.Errorf("failed to set memory.max: %w", err)
+	}
+	return dir, nil
+}
+
+// RemoveCgroup deletes the cgroup of an instance. It must hold no processes.
+// A missing cgroup is not an error.
+func RemoveCgroup(name string) error {
+	parent, err := cgroupBase()
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Join(parent, cgroupPrefix+unsafeCgroupName.ReplaceAllString(name, "_"))
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cgroupBase finds the manager's cgroup and enables the cpu and memory
+// controllers for its children, once
+func cgroupBase() (string, error) {
+	cgroupOnce.Do(func() {
+		cgroupParent, cgroupErr = prepareCgroupBase()
+	})
+	return cgroupParent, cgroupErr
+}
+
+func prepareCgroupBase() (string, error) {
+	own, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	// After a restart the manager may already live in its leaf
+	if path.Base(own) == cgroupManagerLeaf {
+		own = path.Dir(own)
+	}
+	base := filepath.Join(cgroupMount, own)
+
+	controllers, err := os.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("cgroup v2 not available: %w", err)
+	}
+	for _, c := range []string{"cpu", "memory"} {
+		if !strings.Contains(" "+string(controllers)+" ", " "+c+" ") {
+			return "", fmt.Errorf("cgroup controller %q not available in %s", c, base)
+		}
+	}
+
+	enable := func() error {
+		return os.WriteFile(filepath.Join(base, "cgroup.subtree_control"), []byte("+cpu +memory"), 0o644)
+	}
+	if err := enable(); err == nil {
+		return base, nil
+	}
+
+	// Busy: move ourselves out of the way, then retry
+	leaf := filepath.Join(base, cgroupManagerLeaf)
+	if err := os.Mkdir(leaf, 0o755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create manager cgroup: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		return "", fmt.Errorf("failed to move the manager into %s: %w", leaf, err)
+	}
+	if err := enable(); err != nil {
+		return "", fmt.Errorf("failed to enable cgroup controllers in %s (other processes in it?): %w", base, err)
+	}
+	return base, nil
+}
+
+// ownCgroup returns the cgroup v2 path of this process from /proc/self/cgroup
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if rest, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+			return rest, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup v2 not available: no unified hierarchy entry in /proc/self/cgroup")
+}
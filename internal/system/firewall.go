@@ -0,0 +1,11 @@
+package system
+
+// FirewallRule is one installed rule as listed by a firewall backend
+type FirewallRule struct {
+	Family string `json:"family"` // "ipv4" or "ipv6" for iptables, "inet" for nftables
+	Table  string `json:"table"`
+	Chain  string `json:"chain"`
+	Tag    string `json:"tag,omitempty"`   // Ownership tag, "" if the rule has none
+	Owner  string `json:"owner,omitempty"` // Instance ID from the tag, "" for the manager's own rules
+	Spec   string `json:"spec"`            // The rule as the backend prints it
+}
@@ -0,0 +1,70 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// InterfaceCounters returns the receive and transmit byte counters of an
+// interface in the network namespace of the process, per /proc/<pid>/net/dev
+func InterfaceCounters(pid int, name string) (rx, tx uint64, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// "  tun0: rx_bytes rx_packets ... (8 receive fields) tx_bytes ..."
+		iface, counters, ok := strings.Cut(s.Text(), ":")
+		if !ok || strings.TrimSpace(iface) != name {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			return 0, 0, fmt.Errorf("malformed /proc/net/dev line for %s", name)
+		}
+		rx, _ = strconv.ParseUint(fields[0], 10, 64)
+		tx, _ = strconv.ParseUint(fields[8], 10, 64)
+		return rx, tx, nil
+	}
+	return 0, 0, fmt.Errorf("interface %s not found", name)
+}
+
+// ConntrackEstablished reports whether conntrack holds an ESTABLISHED TCP
+// connection to dport (and dst, unless empty) in the network namespace of the
+// process, per /proc/<pid>/net/nf_conntrack
+func ConntrackEstablished(pid int, dst, dport string) (bool, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/nf_conntrack", pid))
+	if err != nil {
+		return false, fmt.Errorf("conntrack table not available: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// ipv4 2 tcp 6 431999 ESTABLISHED src=... dst=... sport=... dport=... src=... (reply direction)
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || fields[2] != "tcp" || fields[5] != "ESTABLISHED" {
+			continue
+		}
+		// The first dst= and dport= belong to the original direction
+		var origDst, origDport string
+		for _, f := range fields[6:] {
+			if v, ok := strings.CutPrefix(f, "dst="); ok && origDst == "" {
+				origDst = v
+			}
+			if v, ok := strings.CutPrefix(f, "dport="); ok && origDport == "" {
+				origDport = v
+			}
+		}
+		if origDport == dport && (dst == "" || origDst == dst) {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
@@ -0,0 +1,71 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Per-thread settings (nice, affinity) are applied to every thread that
+// exists at the time of the call; threads created later inherit them.
+
+// SetNice sets the nice value of all threads of pid
+func SetNice(pid, nice int) error {
+	return forEachThread(pid, func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// SetCPUAffinity pins all threads of pid to the given CPUs
+func SetCPUAffinity(pid int, cpus []int) error {
+	var mask [1024 / 64]uint64
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= 1024 {
+			return fmt.Errorf("CPU %d out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	return forEachThread(pid, func(tid int) error {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// SetRlimit sets both the soft and hard limit of a resource of pid
+// (syscall.RLIMIT_NOFILE, syscall.RLIMIT_AS, ...)
+func SetRlimit(pid, resource int, limit uint64) error {
+	rl := struct{ Cur, Max uint64 }{limit, limit}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&rl)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// SetOOMScoreAdj sets /proc/<pid>/oom_score_adj
+func SetOOMScoreAdj(pid, adj int) error {
+	return os.WriteFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid), []byte(strconv.Itoa(adj)), 0o644)
+}
+
+func forEachThread(pid int, fn func(tid int) error) error {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// A thread may exit between listing and applying
+		if err := fn(tid); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
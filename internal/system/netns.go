@@ -0,0 +1,142 @@
+package system
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// NetnsPrefix starts the name of every namespace the manager creates
+const NetnsPrefix = "phantun-"
+
+// Netns describes the network namespace of one instance and the veth pair
+// that connects it to the host
+type Netns struct {
+	Name      string `json:"name"`
+	HostVeth  string `json:"host_veth"`
+	HostAddr  string `json:"host_addr"` // Host end of the veth pair, the namespace's gateway
+	NsAddr    string `json:"ns_addr"`   // Namespace end (eth0)
+	PrefixLen int    `json:"prefix_len"`
+}
+
+// Subnet returns the veth subnet in CIDR notation
+func (n Netns) Subnet() string {
+	_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", n.NsAddr, n.PrefixLen))
+	return ipnet.String()
+}
+
+// NetnsSlot carves the slot-th /30 out of pool for a namespace
+func NetnsSlot(pool string, slot int) (hostAddr, nsAddr string, err error) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid namespace pool %q: %w", pool, err)
+	}
+	base := ipnet.IP.To4()
+	if base == nil {
+		return "", "", fmt.Errorf("namespace pool %q is not IPv4", pool)
+	}
+	ones, _ := ipnet.Mask.Size()
+	if slot < 0 || ones > 30 || slot >= 1<<(30-ones) {
+		return "", "", fmt.Errorf("namespace pool %q has no room for slot %d", pool, slot)
+	}
+	n := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	n += uint32(slot) * 4
+	addr := func(off uint32) string {
+		v := n + off
+		return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).String()
+	}
+	return addr(1), addr(2), nil
+}
+
+// CreateNetns creates the namespace with loopback and a veth pair whose
+// namespace end is eth0 with a default route through the host. A leftover
+// namespace of the same name is replaced.
+func CreateNetns(n Netns) error {
+	if netnsExists(n.Name) {
+		DeleteNetns(n.Name)
+	}
+	// The host end of a veth pair from an older namespace may survive it briefly
+	runIP("link", "delete", n.HostVeth)
+
+	peer := n.HostVeth + "p"
+	steps := [][]string{
+		{"netns", "add", n.Name},
+		{"link", "add", n.HostVeth, "type", "veth", "peer", "name", peer, "netns", n.Name},
+		{"addr", "add", fmt.Sprintf("%s/%d", n.HostAddr, n.PrefixLen), "dev", n.HostVeth},
+		{"link", "set", n.HostVeth, "up"},
+		{"-n", n.Name, "link", "set", "lo", "up"},
+		{"-n", n.Name, "link", "set", peer, "name", "eth0"},
+		{"-n", n.Name, "addr", "add", fmt.Sprintf("%s/%d", n.NsAddr, n.PrefixLen), "dev", "eth0"},
+		{"-n", n.Name, "link", "set", "eth0", "up"},
+		{"-n", n.Name, "route", "add", "default", "via", n.HostAddr},
+		// phantun routes between its TUN device and eth0 inside the namespace
+		{"netns", "exec", n.Name, "sysctl", "-qw", "net.ipv4.ip_forward=1"},
+	}
+	for _, args := range steps {
+		if err := runIP(args...); err != nil {
+			DeleteNetns(n.Name)
+			return err
+		}
+	}
+
+	// The host forwards between the veth pair and its uplink
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0o644); err != nil {
+		DeleteNetns(n.Name)
+		return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
+	}
+	return nil
+}
+
+// DeleteNetns removes a namespace. Its TUN devices and the veth pair go with
+// it. A missing namespace is not an error.
+func DeleteNetns(name string) error {
+	if !netnsExists(name) {
+		return nil
+	}
+	return runIP("netns", "delete", name)
+}
+
+// ListNetns returns the namespaces created by the manager
+func ListNetns() ([]string, error) {
+	entries, err := os.ReadDir("/run/netns")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), NetnsPrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// NetnsCommand rewrites cmd to run inside the namespace via "ip netns exec",
+// which execs in place, so the PID stays that of the program
+func NetnsCommand(name string, cmd *exec.Cmd) error {
+	ip, err := exec.LookPath("ip")
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{"ip", "netns", "exec", name, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = ip
+	return nil
+}
+
+func netnsExists(name string) bool {
+	_, err := os.Stat("/run/netns/" + name)
+	return err == nil
+}
+
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package system
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 type InterfaceInfo struct {
@@ -78,3 +80,33 @@ func CleanupUnusedTunInterfaces(allowedNames []string) error {
 	}
 	return nil
 }
+
+// DeleteTunInterface removes a single TUN interface. A missing interface is not an error.
+func DeleteTunInterface(name string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return nil
+	}
+	cmd := exec.Command("ip", "link", "delete", name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if strings.Contains(string(out), "Cannot find device") {
+			return nil
+		}
+		return fmt.Errorf("failed to delete interface %s: %v, output: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// WaitTunGone polls until the named interface disappears or the timeout expires.
+// It reports whether the interface is gone.
+func WaitTunGone(name string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
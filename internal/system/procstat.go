@@ -0,0 +1,149 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ClockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat.
+// It is 100 on every Linux architecture we ship for.
+const ClockTicks = 100
+
+// ProcStats is a raw snapshot of a process from /proc
+type ProcStats struct {
+	CPUTicks               uint64 // utime + stime
+	RSSBytes               uint64
+	Threads                int
+	OpenFDs                int
+	VoluntaryCtxSwitches   uint64
+	InvoluntaryCtxSwitches uint64
+	ReadBytes              uint64 // rchar: all read syscalls, including sockets and TUN
+	WriteBytes             uint64 // wchar: all write syscalls, including sockets and TUN
+}
+
+// ReadProcStats samples /proc/<pid>/stat, status, io and fd.
+// Missing io or fd access (no ptrace permission) leaves those fields zero.
+func ReadProcStats(pid int) (ProcStats, error) {
+	var st ProcStats
+	dir := fmt.Sprintf("/proc/%d", pid)
+
+	data, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return st, err
+	}
+	if err := parseStat(string(data), &st); err != nil {
+		return st, fmt.Errorf("%s/stat: %w", dir, err)
+	}
+
+	data, err = os.ReadFile(dir + "/status")
+	if err != nil {
+		return st, err
+	}
+	parseStatus(string(data), &st)
+
+	if data, err := os.ReadFile(dir + "/io"); err == nil {
+		parseIO(string(data), &st)
+	}
+
+	if fds, err := os.ReadDir(dir + "/fd"); err == nil {
+		st.OpenFDs = len(fds)
+	}
+	return st, nil
+}
+
+// statFields splits the content of /proc/<pid>/stat after the command name,
+// which may contain spaces and parentheses. fields[0] is field 3 (state).
+func statFields(data string) ([]string, error) {
+	end := strings.LastIndexByte(data, ')')
+	if end < 0 {
+		return nil, fmt.Errorf("malformed stat")
+	}
+	return strings.Fields(data[end+1:]), nil
+}
+
+// parseStat reads the CPU times (fields 14/15) and thread count (field 20)
+func parseStat(data string, st *ProcStats) error {
+	fields, err := statFields(data)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 18 {
+		return fmt.Errorf("malformed stat: %d fields", len(fields)+2)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	st.CPUTicks = utime + stime
+	st.Threads, _ = strconv.Atoi(fields[17])
+	return nil
+}
+
+// parseStatus reads RSS and context switches from /proc/<pid>/status
+func parseStatus(data string, st *ProcStats) {
+	scanKeyValues(data, func(key, value string) {
+		switch key {
+		case "VmRSS":
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(value, " kB"), 10, 64)
+			st.RSSBytes = kb * 1024
+		case "voluntary_ctxt_switches":
+			st.VoluntaryCtxSwitches, _ = strconv.ParseUint(value, 10, 64)
+		case "nonvoluntary_ctxt_switches":
+			st.InvoluntaryCtxSwitches, _ = strconv.ParseUint(value, 10, 64)
+		}
+	})
+}
+
+// parseIO reads the syscall I/O counters from /proc/<pid>/io
+func parseIO(data string, st *ProcStats) {
+	scanKeyValues(data, func(key, value string) {
+		switch key {
+		case "rchar":
+			st.ReadBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "wchar":
+			st.WriteBytes, _ = strconv.ParseUint(value, 10, 64)
+		}
+	})
+}
+
+// ProcessIdentity returns the start time of a process (in clock ticks since
+// boot, which tells a PID apart from a later reuse) and its state letter
+func ProcessIdentity(pid int) (startTicks uint64, state string, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, "", err
+	}
+	return parseIdentity(string(data))
+}
+
+// parseIdentity reads the state (field 3) and starttime (field 22)
+func parseIdentity(data string) (startTicks uint64, state string, err error) {
+	fields, err := statFields(data)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(fields) < 20 {
+		return 0, "", fmt.Errorf("malformed stat: %d fields", len(fields)+2)
+	}
+	startTicks, _ = strconv.ParseUint(fields[19], 10, 64)
+	return startTicks, fields[0], nil
+}
+
+// ProcessCmdline returns the argument vector of a process
+func ProcessCmdline(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00"), nil
+}
+
+// scanKeyValues splits a "Key:   value" file such as /proc/<pid>/status
+func scanKeyValues(data string, fn func(key, value string)) {
+	for _, line := range strings.Split(data, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			fn(key, strings.TrimSpace(value))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package system
+
+import (
+	"os"
+	"testing"
+)
+
+// The command name may contain spaces and parentheses
+const statFixture = "4242 (phan tun) (x)) S 1 4242 4242 0 -1 4194560 1234 0 0 0 " +
+	"150 75 0 0 20 0 3 0 987654 123456789 512 18446744073709551615 1 1 0 0 0 0 0 4096 0 0 0 0 17 2 0 0 0 0 0\n"
+
+const statusFixture = `Name:	phantun_client
+State:	S (sleeping)
+Threads:	3
+VmRSS:	    5120 kB
+voluntary_ctxt_switches:	42
+nonvoluntary_ctxt_switches:	7
+`
+
+const ioFixture = `rchar: 1000
+wchar: 2000
+syscr: 10
+read_bytes: 0
+`
+
+func TestParseProcFiles(t *testing.T) {
+	var st ProcStats
+	if err := parseStat(statFixture, &st); err != nil {
+		t.Fatal(err)
+	}
+	parseStatus(statusFixture, &st)
+	parseIO(ioFixture, &st)
+	want := ProcStats{
+		CPUTicks: 225, Threads: 3, RSSBytes: 5120 * 1024,
+		VoluntaryCtxSwitches: 42, InvoluntaryCtxSwitches: 7,
+		ReadBytes: 1000, WriteBytes: 2000,
+	}
+	if st != want {
+		t.Errorf("want %+v, got %+v", want, st)
+	}
+
+	ticks, state, err := parseIdentity(statFixture)
+	if err != nil || ticks != 987654 || state != "S" {
+		t.Errorf("want start 987654 in state S, got %d %q %v", ticks, state, err)
+	}
+}
+
+func TestParseStatRejectsMalformed(t *testing.T) {
+	for _, data := range []string{"", "4242 phantun S 1", "4242 (phantun) S 1 2 3"} {
+		var st ProcStats
+		if err := parseStat(data, &st); err == nil {
+			t.Errorf("%q: want an error", data)
+		}
+		if _, _, err := parseIdentity(data); err == nil {
+			t.Errorf("%q: want an identity error", data)
+		}
+	}
+}
+
+func TestReadProcStatsSelf(t *testing.T) {
+	st, err := ReadProcStats(os.Getpid())
+	if err != nil {
+		t.Skipf("no /proc: %v", err)
+	}
+	if st.Threads < 1 || st.RSSBytes == 0 {
+		t.Errorf("implausible stats for ourselves: %+v", st)
+	}
+}
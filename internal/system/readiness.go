@@ -0,0 +1,95 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// TunState reports whether the interface is UP and which addresses it has
+// (without prefix length). netns selects a network namespace, "" is the host.
+func TunState(netns, name string) (up bool, addrs []string, err error) {
+	if netns == "" {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return false, nil, err
+		}
+		list, err := iface.Addrs()
+		if err != nil {
+			return false, nil, err
+		}
+		for _, a := range list {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				addrs = append(addrs, ipnet.IP.String())
+			}
+		}
+		return iface.Flags&net.FlagUp != 0, addrs, nil
+	}
+
+	// ip -o addr prints one line per address:
+	// 5: tun0    inet 192.168.200.1 peer 192.168.200.2/32 scope global tun0\ ...
+	link, err := exec.Command("ip", "-n", netns, "-o", "link", "show", "dev", name).CombinedOutput()
+	if err != nil {
+		return false, nil, fmt.Errorf("%s", strings.TrimSpace(string(link)))
+	}
+	out, err := exec.Command("ip", "-n", netns, "-o", "addr", "show", "dev", name).Output()
+	if err != nil {
+		return false, nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "inet" || fields[i] == "inet6" {
+				addrs = append(addrs, strings.SplitN(fields[i+1], "/", 2)[0])
+			}
+		}
+	}
+	// Flags look like <POINTOPOINT,MULTICAST,NOARP,UP,LOWER_UP>
+	flags := string(link)
+	if i := strings.Index(flags, "<"); i >= 0 {
+		if j := strings.Index(flags[i:], ">"); j >= 0 {
+			for _, f := range strings.Split(flags[i+1:i+j], ",") {
+				if f == "UP" {
+					up = true
+				}
+			}
+		}
+	}
+	return up, addrs, nil
+}
+
+// UDPPortBound reports whether a UDP socket is bound to the port in the
+// network namespace of the process, per /proc/<pid>/net/udp and udp6
+func UDPPortBound(pid, port int) (bool, error) {
+	want := fmt.Sprintf(":%04X", port)
+	var firstErr error
+	read := 0
+	for _, table := range []string{"udp", "udp6"} {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/net/%s", pid, table))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue // udp6 is missing without IPv6
+		}
+		read++
+		s := bufio.NewScanner(f)
+		s.Scan() // Header
+		for s.Scan() {
+			// sl local_address rem_address st ...
+			fields := strings.Fields(s.Text())
+			if len(fields) > 1 && strings.HasSuffix(fields[1], want) {
+				f.Close()
+				return true, nil
+			}
+		}
+		f.Close()
+	}
+	if read == 0 {
+		return false, firstErr
+	}
+	return false, nil
+}
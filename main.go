@@ -9,19 +9,21 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"phantun-docker/internal/api"
 	"phantun-docker/internal/config"
-	"phantun-docker/internal/iptables"
 	"phantun-docker/internal/process"
 )
 
@@ -35,8 +37,14 @@ var (
 var content embed.FS
 
 func main() {
+	// When launching an instance with resource limits, apply them and exec it
+	process.RunLimitedIfRequested()
+	// When launched by FakeRunner, act as a fake phantun binary instead
+	process.RunFakeIfRequested()
+
 	configPath := flag.String("config", "/etc/phantun/config.json", "Path to configuration file")
 	port := flag.Int("port", 8080, "Web UI port")
+	fake := flag.Bool("fake", false, "Run simulated phantun instances without touching iptables or TUN devices (no root needed)")
 	flag.Parse()
 
 	// 1. Load Config
@@ -47,28 +55,73 @@ func main() {
 	}
 
 	// 2. Initialize Dependencies
-	mgr := process.NewManager(cfg)
+	var mgr *process.Manager
+	if *fake {
+		mgr = process.NewManagerWithOptions(cfg, process.Options{
+			Runner:     process.FakeRunner{},
+			Firewall:   process.NoopFirewall{},
+			Tuns:       process.NoopTuns{},
+			Namespaces: process.NoopNamespaces{},
+			Readiness:  process.NoopReadiness{},
+		})
+	} else {
+		mgr = process.NewManager(cfg)
+	}
 	apiHandler := api.NewHandler(cfg, mgr)
 
 	// SETUP LOGGING: Redirect log.Println to both Stdout and Manager
-	// This ensures "Started Client..." messages appear in Web UI
-	logBroadcaster := &LogBroadcaster{Mgr: mgr}
-	log.SetOutput(io.MultiWriter(os.Stdout, logBroadcaster))
+	// This ensures "Started client..." messages appear in Web UI.
+	// Lines below general.log_level are dropped from both.
+	logBroadcaster := &LogBroadcaster{Mgr: mgr, Console: os.Stdout}
+	log.SetOutput(logBroadcaster)
+
+	// Persist logs next to the config file, one file per instance
+	logDir := filepath.Join(filepath.Dir(*configPath), "logs")
+	if err := mgr.OpenLogStore(logDir); err != nil {
+		log.Printf("[WARNING] Log files disabled: %v", err)
+	}
+
+	// Side-by-side phantun versions live next to the config file as well
+	binDir := filepath.Join(filepath.Dir(*configPath), "binaries")
+	if err := mgr.SetBinariesDir(binDir); err != nil {
+		log.Printf("[WARNING] Binary versions unavailable: %v", err)
+	}
+	mgr.SetChecksumManifest(filepath.Join(filepath.Dir(*configPath), "checksums.sha256"))
+
+	// PID files of processes that may outlive this manager (general.supervisor.adopt)
+	if err := mgr.SetRunDir(filepath.Join(filepath.Dir(*configPath), "run")); err != nil {
+		log.Printf("[WARNING] Process adoption unavailable: %v", err)
+	}
 
 	// STRICT LOGIC: Sanitize environment on startup
 	// We must remove ANY / ALL rules created by previous runs (crashes, restarts)
-	log.Println("Performing startup cleanup...")
-	if err := iptables.CleanupAll(); err != nil {
-		log.Printf("[WARNING] Startup cleanup failed: %v", err)
+	// In adopt mode the rules of surviving processes must stay; StartAll checks
+	// them and tears down the ones that are not adopted.
+	if !*fake {
+		if err := mgr.CleanupOtherFirewall(); err != nil {
+			log.Printf("[WARNING] Cleanup of the inactive firewall backend failed: %v", err)
+		}
+	}
+	if *fake {
+		log.Println("[WARNING] Fake mode: phantun instances are simulated, firewall and TUN devices are untouched.")
+	} else if cfg.General.Supervisor.Adopt {
+		log.Println("Adopt mode: keeping firewall rules of running instances.")
 	} else {
-		log.Println("Startup cleanup completed. Environment sanitized.")
+		log.Printf("Performing startup cleanup (%s)...", mgr.FirewallName())
+		if err := mgr.CleanupFirewall(); err != nil {
+			log.Printf("[WARNING] Startup cleanup failed: %v", err)
+		} else {
+			log.Println("Startup cleanup completed. Environment sanitized.")
+		}
 	}
 
 	// 3. Start Processes (if enabled)
 	if err := mgr.StartAll(); err != nil {
 		log.Fatalf("Failed to start processes: %v", err)
 	}
-	defer mgr.StopAll() // Cleanup on exit
+	defer mgr.Shutdown() // Cleanup on exit
+	mgr.StartResourceMonitor()
+	mgr.StartScheduler()
 
 	// 4. Initialize API
 	mux := http.NewServeMux()
@@ -142,8 +195,8 @@ func main() {
 	<-stop
 
 	log.Println("Shutting down...")
-	mgr.StopAll()
-	mgr.StopAll()
+	mgr.Shutdown()
+	mgr.CloseLogStore()
 }
 
 // --- Auth Helpers ---
@@ -174,7 +227,13 @@ func authMiddleware(next http.Handler) http.Handler {
 
 		// Check Cookie
 		cookie, err := r.Cookie("auth_token")
-		if err == nil && cookie.Value == authToken {
+		if err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(authToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// HTTP Basic credentials let scripts upload binaries (curl -u) without the login form
+		if r.Method == "POST" && r.URL.Path == "/api/binaries" && basicAuthOK(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -188,6 +247,21 @@ func authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// basicAuthOK reports whether the request carries the configured credentials
+// as HTTP Basic auth
+func basicAuthOK(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	return ok && credentialsOK(user, pass)
+}
+
+// credentialsOK compares in constant time, so timing does not reveal how much
+// of a guess matched
+func credentialsOK(user, pass string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(authUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(authPass)) == 1
+	return userOK && passOK
+}
+
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", 405)
@@ -203,7 +277,7 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if creds.Username == authUser && creds.Password == authPass {
+	if credentialsOK(creds.Username, creds.Password) {
 		// Set Cookie
 		http.SetCookie(w, &http.Cookie{
 			Name:    "auth_token",
@@ -218,20 +292,40 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// LogBroadcaster adapts io.Writer to Manager.BroadcastLog
+// LogBroadcaster adapts io.Writer to Manager.BroadcastLog, one message per line,
+// and mirrors the lines that pass the global log level to Console
 type LogBroadcaster struct {
-	Mgr *process.Manager
+	Mgr     *process.Manager
+	Console io.Writer
+
+	mu      sync.Mutex
+	pending []byte // Partial line waiting for its newline
 }
 
 func (lb *LogBroadcaster) Write(p []byte) (n int, err error) {
-	// We assume log output is line-based.
-	// But p might not contain newline or contain multiple.
-	// For simplicity, we just broadcast as "system" log.
-	lb.Mgr.BroadcastLog(process.LogMessage{
-		Timestamp: time.Now(),
-		ProcessID: "system",
-		Stream:    "stdout",
-		Content:   string(p),
-	})
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	// The log package writes whole lines, but a message may span several
+	lb.pending = append(lb.pending, p...)
+	for {
+		i := bytes.IndexByte(lb.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(lb.pending[:i])
+		lb.pending = lb.pending[i+1:]
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		msg := process.NewLogMessage("system", "stdout", line)
+		if !lb.Mgr.LogEnabled(msg.Level) {
+			continue
+		}
+		if lb.Console != nil {
+			fmt.Fprintln(lb.Console, line)
+		}
+		lb.Mgr.BroadcastLog(msg)
+	}
 	return len(p), nil
 }
@@ -306,7 +306,7 @@ const app = {
         const badge = document.getElementById('serviceStatus');
         const count = document.getElementById('tunnelCount');
         const running = (status.processes || []).filter(p => p.running).length;
-        const total = (status.processes || []).length;
+        const total = (status.processes || []).filter(p => p.state !== 'disabled').length;
 
         if (running > 0) {
             badge.textContent = 'Running';
@@ -333,7 +333,8 @@ const app = {
             // Find matching status
             const proc = this.lastStatus?.processes?.find(p => p.id === item.id);
             const isRunning = !!proc?.running;
-            const statusLabel = isRunning ? t('status.running') : t('status.stopped');
+            // Show the lifecycle state (crashed, backoff, failed-to-start...) when not running
+            const statusLabel = isRunning ? t('status.running') : this.escapeHtml(proc?.state || t('status.stopped'));
             const statusClass = isRunning ? 'running' : 'stopped';
 
             // Strict Config Display (Local: Bind IP:Port, Remote: Server IP:Port)
@@ -344,7 +345,7 @@ const app = {
         <tr>
             <td>${this.escapeHtml(item.alias || item.id.substring(0, 8))}</td>
             <td>${item._type === 'client' ? t('mode.client') : t('mode.server')}</td>
-            <td><span class="status-badge ${statusClass}">${statusLabel}</span></td>
+            <td><span class="status-badge ${statusClass}">${statusLabel}</span> ${isRunning ? this.healthBadge(proc.health) : ''}${this.scheduleNote(proc?.schedule)}</td>
             <td>${this.escapeHtml(localDisplay)}</td>
             <td>${this.escapeHtml(remoteDisplay)}</td>
         </tr>
@@ -352,6 +353,28 @@ const app = {
         }).join('');
     },
 
+    healthBadge(health) {
+        if (!health || health.status === 'unknown') return '';
+        if (health.status === 'healthy') {
+            return `<span class="status-badge running" title="${health.latency_ms.toFixed(1)} ms">Healthy</span>`;
+        }
+        const title = `${health.failure_streak} failures: ${health.last_error || ''}`;
+        return `<span class="status-badge stopped" title="${this.escapeHtml(title)}">Unhealthy</span>`;
+    },
+
+    scheduleNote(schedule) {
+        if (!schedule?.next_at) return '';
+        const when = new Date(schedule.next_at).toLocaleString();
+        const held = schedule.override ? ` (manually ${schedule.override})` : '';
+        return ` <small title="${this.escapeHtml(schedule.timezone)}">next ${schedule.next_action} ${this.escapeHtml(when)}${held}</small>`;
+    },
+
+    pinBadge(pin) {
+        if (pin === 'verified') return '<span class="status-badge running">Pinned</span>';
+        if (pin === 'mismatch') return '<span class="status-badge stopped">Mismatch</span>';
+        return '';
+    },
+
     updateDiagnostics(status) {
         if (!status?.diagnostics) {
             return;
@@ -368,14 +391,20 @@ const app = {
             <tr>
                 <td>Client Binary</td>
                 <td>${binClient !== 'missing' ? '<span class="status-badge running">Present</span>' : '<span class="status-badge stopped">Missing</span>'}</td>
-                <td class="text-mono">${binClient !== 'missing' ? this.escapeHtml(binClient) : '-'}</td>
+                <td class="text-mono" title="${this.escapeHtml(binClient)}">${binClient !== 'missing' ? this.escapeHtml(binClient.slice(0, 16)) + ' ' + this.pinBadge(d.binaries?.default?.client?.pin) : '-'}</td>
             </tr>
             <tr>
                 <td>Server Binary</td>
                 <td>${binServer !== 'missing' ? '<span class="status-badge running">Present</span>' : '<span class="status-badge stopped">Missing</span>'}</td>
-                <td class="text-mono">${binServer !== 'missing' ? this.escapeHtml(binServer) : '-'}</td>
+                <td class="text-mono" title="${this.escapeHtml(binServer)}">${binServer !== 'missing' ? this.escapeHtml(binServer.slice(0, 16)) + ' ' + this.pinBadge(d.binaries?.default?.server?.pin) : '-'}</td>
             </tr>
-        `;
+        ` + (d.binaries?.versions || []).map(v => ['client', 'server'].filter(k => v[k]).map(k => `
+            <tr>
+                <td>${k === 'client' ? 'Client' : 'Server'} <span class="text-mono">${this.escapeHtml(v.name)}</span></td>
+                <td>${v[k].version ? '<span class="status-badge running">Present</span>' : '<span class="status-badge stopped">Broken</span>'}</td>
+                <td class="text-mono" title="${this.escapeHtml((v[k].version || v[k].error || '') + ' ' + (v[k].sha256 || ''))}">${this.escapeHtml((v[k].sha256 || '-').slice(0, 16))} ${this.pinBadge(v[k].pin)}</td>
+            </tr>
+        `).join('')).join('');
 
         // 2. Interfaces
         const tbodyIf = document.getElementById('diagInterfacesBody');
@@ -481,18 +510,8 @@ const app = {
                 body: JSON.stringify(config)
             });
 
-            // Reload to reflect state (and maybe trigger restart if needed but for now just save config)
+            // The backend reconciles on save: only this instance is started or stopped
             this.showSuccess(`Instance ${mode === 'server' ? 'server' : 'client'} #${index + 1} toggled.`);
-
-            // Optionally auto-apply? For now, we just save config as user might want to toggle multiple.
-            // But user expectation "click checkbox" usually implies "it works". 
-            // Given the requirement "Live Checkboxes", we should probably apply. 
-            // However, applying restarts EVERYTHING. Let's just save for now, or trigger apply if critical.
-            // Let's stick to Save Only to avoid massive disruptions on every click, 
-            // unless user clicks "Save & Apply". (Or we can make it auto-restart).
-            // Re-reading expectation: "active/cancel". Let's auto-restart to be "Live".
-
-            await this.fetchWithError(CONFIG.API.ACTION_RESTART, { method: 'POST' });
             this.loadConfig(); // Refresh UI
 
         } catch (err) {